@@ -241,10 +241,7 @@ func (b *Build) attemptExecuteStage(buildStage BuildStage, executor Executor, ab
 func (b *Build) run(executor Executor) (err error) {
 	b.CurrentState = BuildRunRuntimeRunning
 
-	buildTimeout := b.Timeout
-	if buildTimeout <= 0 {
-		buildTimeout = DefaultTimeout
-	}
+	buildTimeout := b.GetBuildTimeout()
 
 	buildFinish := make(chan error, 1)
 	buildAbort := make(chan interface{})
@@ -432,6 +429,13 @@ func (b *Build) GetSubmoduleStrategy() SubmoduleStrategy {
 	}
 }
 
+func (b *Build) GetBuildTimeout() int {
+	if b.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return b.Timeout
+}
+
 func (b *Build) IsDebugTraceEnabled() bool {
 	trace, err := strconv.ParseBool(b.GetAllVariables().Get("CI_DEBUG_TRACE"))
 	if err != nil {
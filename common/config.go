@@ -45,31 +45,124 @@ func (p DockerPullPolicy) Get() (DockerPullPolicy, error) {
 	return p, nil
 }
 
+type DockerShutdownPolicy string
+
+const (
+	ShutdownPolicyKill   = "kill"
+	ShutdownPolicyStop   = "stop"
+	ShutdownPolicyDetach = "detach"
+)
+
+// Get returns one of the predefined values or returns an error if the value can't match the predefined
+func (p DockerShutdownPolicy) Get() (DockerShutdownPolicy, error) {
+	// Default policy is kill
+	if p == "" {
+		return ShutdownPolicyKill, nil
+	}
+
+	// Verify shutdown policy
+	if p != ShutdownPolicyKill &&
+		p != ShutdownPolicyStop &&
+		p != ShutdownPolicyDetach {
+		return "", fmt.Errorf("unsupported docker-shutdown-policy: %v", p)
+	}
+	return p, nil
+}
+
 type DockerConfig struct {
 	docker_helpers.DockerCredentials
-	Hostname               string           `toml:"hostname,omitempty" json:"hostname" long:"hostname" env:"DOCKER_HOSTNAME" description:"Custom container hostname"`
-	Image                  string           `toml:"image" json:"image" long:"image" env:"DOCKER_IMAGE" description:"Docker image to be used"`
-	CPUSetCPUs             string           `toml:"cpuset_cpus,omitempty" json:"cpuset_cpus" long:"cpuset-cpus" env:"DOCKER_CPUSET_CPUS" description:"String value containing the cgroups CpusetCpus to use"`
-	DNS                    []string         `toml:"dns,omitempty" json:"dns" long:"dns" env:"DOCKER_DNS" description:"A list of DNS servers for the container to use"`
-	DNSSearch              []string         `toml:"dns_search,omitempty" json:"dns_search" long:"dns-search" env:"DOCKER_DNS_SEARCH" description:"A list of DNS search domains"`
-	Privileged             bool             `toml:"privileged,omitzero" json:"privileged" long:"privileged" env:"DOCKER_PRIVILEGED" description:"Give extended privileges to container"`
-	CapAdd                 []string         `toml:"cap_add" json:"cap_add" long:"cap-add" env:"DOCKER_CAP_ADD" description:"Add Linux capabilities"`
-	CapDrop                []string         `toml:"cap_drop" json:"cap_drop" long:"cap-drop" env:"DOCKER_CAP_DROP" description:"Drop Linux capabilities"`
-	SecurityOpt            []string         `toml:"security_opt" json:"security_opt" long:"security-opt" env:"DOCKER_SECURITY_OPT" description:"Security Options"`
-	Devices                []string         `toml:"devices" json:"devices" long:"devices" env:"DOCKER_DEVICES" description:"Add a host device to the container"`
-	DisableCache           bool             `toml:"disable_cache,omitzero" json:"disable_cache" long:"disable-cache" env:"DOCKER_DISABLE_CACHE" description:"Disable all container caching"`
-	Volumes                []string         `toml:"volumes,omitempty" json:"volumes" long:"volumes" env:"DOCKER_VOLUMES" description:"Bind mount a volumes"`
-	VolumeDriver           string           `toml:"volume_driver,omitempty" json:"volume_driver" long:"volume-driver" env:"DOCKER_VOLUME_DRIVER" description:"Volume driver to be used"`
-	CacheDir               string           `toml:"cache_dir,omitempty" json:"cache_dir" long:"cache-dir" env:"DOCKER_CACHE_DIR" description:"Directory where to store caches"`
-	ExtraHosts             []string         `toml:"extra_hosts,omitempty" json:"extra_hosts" long:"extra-hosts" env:"DOCKER_EXTRA_HOSTS" description:"Add a custom host-to-IP mapping"`
-	VolumesFrom            []string         `toml:"volumes_from,omitempty" json:"volumes_from" long:"volumes-from" env:"DOCKER_VOLUMES_FROM" description:"A list of volumes to inherit from another container"`
-	NetworkMode            string           `toml:"network_mode,omitempty" json:"network_mode" long:"network-mode" env:"DOCKER_NETWORK_MODE" description:"Add container to a custom network"`
-	Links                  []string         `toml:"links,omitempty" json:"links" long:"links" env:"DOCKER_LINKS" description:"Add link to another container"`
-	Services               []string         `toml:"services,omitempty" json:"services" long:"services" env:"DOCKER_SERVICES" description:"Add service that is started with container"`
-	WaitForServicesTimeout int              `toml:"wait_for_services_timeout,omitzero" json:"wait_for_services_timeout" long:"wait-for-services-timeout" env:"DOCKER_WAIT_FOR_SERVICES_TIMEOUT" description:"How long to wait for service startup"`
-	AllowedImages          []string         `toml:"allowed_images,omitempty" json:"allowed_images" long:"allowed-images" env:"DOCKER_ALLOWED_IMAGES" description:"Whitelist allowed images"`
-	AllowedServices        []string         `toml:"allowed_services,omitempty" json:"allowed_services" long:"allowed-services" env:"DOCKER_ALLOWED_SERVICES" description:"Whitelist allowed services"`
-	PullPolicy             DockerPullPolicy `toml:"pull_policy,omitempty" json:"pull_policy" long:"pull-policy" env:"DOCKER_PULL_POLICY" description:"Image pull policy: never, if-not-present, always"`
+	Hostname                             string               `toml:"hostname,omitempty" json:"hostname" long:"hostname" env:"DOCKER_HOSTNAME" description:"Custom container hostname"`
+	Image                                string               `toml:"image" json:"image" long:"image" env:"DOCKER_IMAGE" description:"Docker image to be used"`
+	CPUSetCPUs                           string               `toml:"cpuset_cpus,omitempty" json:"cpuset_cpus" long:"cpuset-cpus" env:"DOCKER_CPUSET_CPUS" description:"String value containing the cgroups CpusetCpus to use"`
+	DNS                                  []string             `toml:"dns,omitempty" json:"dns" long:"dns" env:"DOCKER_DNS" description:"A list of DNS servers for the container to use"`
+	DNSSearch                            []string             `toml:"dns_search,omitempty" json:"dns_search" long:"dns-search" env:"DOCKER_DNS_SEARCH" description:"A list of DNS search domains"`
+	DNSOptions                           []string             `toml:"dns_opt,omitempty" json:"dns_opt" long:"dns-opt" env:"DOCKER_DNS_OPT" description:"A list of DNS resolver options (eg. ndots:2)"`
+	Privileged                           bool                 `toml:"privileged,omitzero" json:"privileged" long:"privileged" env:"DOCKER_PRIVILEGED" description:"Give extended privileges to container"`
+	CapAdd                               []string             `toml:"cap_add" json:"cap_add" long:"cap-add" env:"DOCKER_CAP_ADD" description:"Add Linux capabilities"`
+	CapDrop                              []string             `toml:"cap_drop" json:"cap_drop" long:"cap-drop" env:"DOCKER_CAP_DROP" description:"Drop Linux capabilities"`
+	ServicesCapAdd                       []string             `toml:"services_cap_add,omitempty" json:"services_cap_add" long:"services-cap-add" env:"DOCKER_SERVICES_CAP_ADD" description:"Add Linux capabilities to the service containers"`
+	ServicesCapDrop                      []string             `toml:"services_cap_drop,omitempty" json:"services_cap_drop" long:"services-cap-drop" env:"DOCKER_SERVICES_CAP_DROP" description:"Drop Linux capabilities from the service containers"`
+	AllowedServicesCapAdd                []string             `toml:"allowed_services_cap_add,omitempty" json:"allowed_services_cap_add" long:"allowed-services-cap-add" env:"DOCKER_ALLOWED_SERVICES_CAP_ADD" description:"Linux capabilities which can be added to the services defined in .gitlab-ci.yml"`
+	SecurityOpt                          []string             `toml:"security_opt" json:"security_opt" long:"security-opt" env:"DOCKER_SECURITY_OPT" description:"Security Options"`
+	ServicesSecurityOpt                  []string             `toml:"services_security_opt,omitempty" json:"services_security_opt" long:"services-security-opt" env:"DOCKER_SERVICES_SECURITY_OPT" description:"Security Options of the service containers"`
+	AllowedServicesSecurityOpt           []string             `toml:"allowed_services_security_opt,omitempty" json:"allowed_services_security_opt" long:"allowed-services-security-opt" env:"DOCKER_ALLOWED_SERVICES_SECURITY_OPT" description:"Security Options which can be used by the services defined in .gitlab-ci.yml"`
+	Devices                              []string             `toml:"devices" json:"devices" long:"devices" env:"DOCKER_DEVICES" description:"Add a host device to the container"`
+	DisableCache                         bool                 `toml:"disable_cache,omitzero" json:"disable_cache" long:"disable-cache" env:"DOCKER_DISABLE_CACHE" description:"Disable all container caching"`
+	DisableBuildVolume                   bool                 `toml:"disable_build_volume,omitzero" json:"disable_build_volume" long:"disable-build-volume" env:"DOCKER_DISABLE_BUILD_VOLUME" description:"Don't create a temporary cache container for the build directory when the sources are not reused between builds"`
+	Volumes                              []string             `toml:"volumes,omitempty" json:"volumes" long:"volumes" env:"DOCKER_VOLUMES" description:"Bind mount a volumes"`
+	VolumesBaseDir                       string               `toml:"volumes_base_dir,omitempty" json:"volumes_base_dir" long:"volumes-base-dir" env:"DOCKER_VOLUMES_BASE_DIR" description:"Directory against which the relative host paths of the volumes are resolved, defaults to the current working directory"`
+	VolumeDriver                         string               `toml:"volume_driver,omitempty" json:"volume_driver" long:"volume-driver" env:"DOCKER_VOLUME_DRIVER" description:"Volume driver to be used"`
+	VolumeDriverOpts                     map[string]string    `toml:"volume_driver_ops,omitempty" json:"volume_driver_ops" long:"volume-driver-ops" description:"A toml table/json object with the options of the volume driver used for the cache volumes"`
+	LogDriver                            string               `toml:"log_driver,omitempty" json:"log_driver" long:"log-driver" env:"DOCKER_LOG_DRIVER" description:"Log driver of the created containers (eg. journald, fluentd), json-file by default"`
+	LogOpts                              map[string]string    `toml:"log_opts,omitempty" json:"log_opts" long:"log-opts" description:"A toml table/json object with the options of the log driver"`
+	CacheDir                             string               `toml:"cache_dir,omitempty" json:"cache_dir" long:"cache-dir" env:"DOCKER_CACHE_DIR" description:"Directory where to store caches"`
+	CacheExpiry                          int                  `toml:"cache_expiry,omitzero" json:"cache_expiry" long:"cache-expiry" env:"DOCKER_CACHE_EXPIRY" description:"Remove cache containers created more than this many seconds ago, disabled by default"`
+	KeepFailedContainers                 int                  `toml:"keep_failed_containers,omitzero" json:"keep_failed_containers" long:"keep-failed-containers" env:"DOCKER_KEEP_FAILED_CONTAINERS" description:"Keep the build and service containers of failed builds for this many seconds for debugging, disabled by default"`
+	NamedCacheVolumes                    bool                 `toml:"named_cache_volumes,omitzero" json:"named_cache_volumes" long:"named-cache-volumes" env:"DOCKER_NAMED_CACHE_VOLUMES" description:"Store caches in named Docker volumes instead of cache containers (requires Docker 1.13 or newer)"`
+	ExtraHosts                           []string             `toml:"extra_hosts,omitempty" json:"extra_hosts" long:"extra-hosts" env:"DOCKER_EXTRA_HOSTS" description:"Add a custom host-to-IP mapping"`
+	ServicesExtraHosts                   []string             `toml:"services_extra_hosts,omitempty" json:"services_extra_hosts" long:"services-extra-hosts" env:"DOCKER_SERVICES_EXTRA_HOSTS" description:"Add a custom host-to-IP mapping to the service containers, defaults to extra_hosts"`
+	VolumesFrom                          []string             `toml:"volumes_from,omitempty" json:"volumes_from" long:"volumes-from" env:"DOCKER_VOLUMES_FROM" description:"A list of volumes to inherit from another container"`
+	NetworkMode                          string               `toml:"network_mode,omitempty" json:"network_mode" long:"network-mode" env:"DOCKER_NETWORK_MODE" description:"Add container to a custom network"`
+	Links                                []string             `toml:"links,omitempty" json:"links" long:"links" env:"DOCKER_LINKS" description:"Add link to another container"`
+	DisableLinksDeprecationWarning       bool                 `toml:"disable_links_deprecation_warning,omitzero" json:"disable_links_deprecation_warning" long:"disable-links-deprecation-warning" env:"DOCKER_DISABLE_LINKS_DEPRECATION_WARNING" description:"Don't warn that services use the legacy container links"`
+	Services                             []string             `toml:"services,omitempty" json:"services" long:"services" env:"DOCKER_SERVICES" description:"Add service that is started with container"`
+	WaitForServicesTimeout               int                  `toml:"wait_for_services_timeout,omitzero" json:"wait_for_services_timeout" long:"wait-for-services-timeout" env:"DOCKER_WAIT_FOR_SERVICES_TIMEOUT" description:"How long to wait for service startup"`
+	WaitForServicesInterval              int                  `toml:"wait_for_services_interval,omitzero" json:"wait_for_services_interval" long:"wait-for-services-interval" env:"DOCKER_WAIT_FOR_SERVICES_INTERVAL" description:"How often (in seconds) the service ports or health are checked while waiting for services, 1 by default"`
+	WaitForServicesByTCP                 bool                 `toml:"wait_for_services_by_tcp,omitzero" json:"wait_for_services_by_tcp" long:"wait-for-services-by-tcp" env:"DOCKER_WAIT_FOR_SERVICES_BY_TCP" description:"Wait for services by connecting to their exposed TCP ports from the runner instead of using a helper container"`
+	WaitForServicesHealthCheck           bool                 `toml:"wait_for_services_healthcheck,omitzero" json:"wait_for_services_healthcheck" long:"wait-for-services-healthcheck" env:"DOCKER_WAIT_FOR_SERVICES_HEALTHCHECK" description:"Wait for services to become healthy when their image defines a HEALTHCHECK"`
+	ServicesMustStart                    bool                 `toml:"services_must_start,omitzero" json:"services_must_start" long:"services-must-start" env:"DOCKER_SERVICES_MUST_START" description:"Fail the build when a service didn't start properly, instead of only printing a warning"`
+	AllowedImages                        []string             `toml:"allowed_images,omitempty" json:"allowed_images" long:"allowed-images" env:"DOCKER_ALLOWED_IMAGES" description:"Whitelist allowed images"`
+	AllowedServices                      []string             `toml:"allowed_services,omitempty" json:"allowed_services" long:"allowed-services" env:"DOCKER_ALLOWED_SERVICES" description:"Whitelist allowed services"`
+	DeniedImages                         []string             `toml:"denied_images,omitempty" json:"denied_images" long:"denied-images" env:"DOCKER_DENIED_IMAGES" description:"Blacklist denied images, checked before allowed_images"`
+	DeniedServices                       []string             `toml:"denied_services,omitempty" json:"denied_services" long:"denied-services" env:"DOCKER_DENIED_SERVICES" description:"Blacklist denied services, checked before allowed_services"`
+	AllowedPullPolicies                  []DockerPullPolicy   `toml:"allowed_pull_policies,omitempty" json:"allowed_pull_policies" long:"allowed-pull-policies" env:"DOCKER_ALLOWED_PULL_POLICIES" description:"Whitelist pull policies which can be requested by the job, only pull_policy by default"`
+	FallbackToDefaultImageWhenDisallowed bool                 `toml:"fallback_to_default_image_when_disallowed,omitzero" json:"fallback_to_default_image_when_disallowed" long:"fallback-to-default-image-when-disallowed" env:"DOCKER_FALLBACK_TO_DEFAULT_IMAGE_WHEN_DISALLOWED" description:"Use the default image instead of failing the build when the job image is not on the allowed_images list"`
+	PullPolicy                           DockerPullPolicy     `toml:"pull_policy,omitempty" json:"pull_policy" long:"pull-policy" env:"DOCKER_PULL_POLICY" description:"Image pull policy: never, if-not-present, always"`
+	ShutdownPolicy                       DockerShutdownPolicy `toml:"shutdown_policy,omitempty" json:"shutdown_policy" long:"shutdown-policy" env:"DOCKER_SHUTDOWN_POLICY" description:"What to do with the containers of running builds when the runner is shutting down: kill, stop, detach"`
+	ShutdownGracePeriod                  int                  `toml:"shutdown_grace_period,omitzero" json:"shutdown_grace_period" long:"shutdown-grace-period" env:"DOCKER_SHUTDOWN_GRACE_PERIOD" description:"Time (in seconds) given to the containers to exit with the stop shutdown policy, 10 by default"`
+	StopSignal                           string               `toml:"stop_signal,omitempty" json:"stop_signal" long:"stop-signal" env:"DOCKER_STOP_SIGNAL" description:"Signal (name or number) sent to stop the containers gracefully before they are killed"`
+	PullBuildImageWithServices           bool                 `toml:"pull_build_image_with_services,omitzero" json:"pull_build_image_with_services" long:"pull-build-image-with-services" env:"DOCKER_PULL_BUILD_IMAGE_WITH_SERVICES" description:"Pull the build image concurrently with starting the services"`
+	PrePullImages                        bool                 `toml:"pre_pull_images,omitzero" json:"pre_pull_images" long:"pre-pull-images" env:"DOCKER_PRE_PULL_IMAGES" description:"Pull the build image and all service images concurrently when the build is prepared"`
+	ServiceLogsTail                      int                  `toml:"service_logs_tail,omitzero" json:"service_logs_tail" long:"service-logs-tail" env:"DOCKER_SERVICE_LOGS_TAIL" description:"Number of service log lines shown when a service didn't start properly, set to -1 to show all lines"`
+	DisableServiceLogsTimestamps         bool                 `toml:"disable_service_logs_timestamps,omitzero" json:"disable_service_logs_timestamps" long:"disable-service-logs-timestamps" env:"DOCKER_DISABLE_SERVICE_LOGS_TIMESTAMPS" description:"Don't prefix service log lines with timestamps"`
+	ServiceLogsOnFailure                 bool                 `toml:"service_logs_on_failure,omitzero" json:"service_logs_on_failure" long:"service-logs-on-failure" env:"DOCKER_SERVICE_LOGS_ON_FAILURE" description:"Show the last service log lines in the build trace when the build script fails"`
+	PidsLimit                            int64                `toml:"pids_limit,omitzero" json:"pids_limit" long:"pids-limit" env:"DOCKER_PIDS_LIMIT" description:"Maximum number of processes in the build container, set to -1 for unlimited"`
+	ServicesPidsLimit                    int64                `toml:"services_pids_limit,omitzero" json:"services_pids_limit" long:"services-pids-limit" env:"DOCKER_SERVICES_PIDS_LIMIT" description:"Maximum number of processes in each service container, set to -1 for unlimited"`
+	Memory                               string               `toml:"memory,omitempty" json:"memory" long:"memory" env:"DOCKER_MEMORY" description:"Memory limit of the build container (eg. 512m, 2g)"`
+	ServicesMemory                       string               `toml:"services_memory,omitempty" json:"services_memory" long:"services-memory" env:"DOCKER_SERVICES_MEMORY" description:"Memory limit of each service container (eg. 512m, 2g)"`
+	OomKillDisable                       bool                 `toml:"oom_kill_disable,omitzero" json:"oom_kill_disable" long:"oom-kill-disable" env:"DOCKER_OOM_KILL_DISABLE" description:"Disable the OOM killer for the build and service containers with a memory limit, requires memory or services_memory to be set"`
+	OomScoreAdj                          int                  `toml:"oom_score_adj,omitzero" json:"oom_score_adj" long:"oom-score-adj" env:"DOCKER_OOM_SCORE_ADJ" description:"OOM score adjustment of the build and service containers, from -1000 to 1000"`
+	CgroupParent                         string               `toml:"cgroup_parent,omitempty" json:"cgroup_parent" long:"cgroup-parent" env:"DOCKER_CGROUP_PARENT" description:"Parent cgroup under which the build and service containers are placed"`
+	PullTimeout                          int                  `toml:"pull_timeout,omitzero" json:"pull_timeout" long:"pull-timeout" env:"DOCKER_PULL_TIMEOUT" description:"How long (in seconds) to wait for an image pull before aborting it, no timeout by default"`
+	MaxConcurrentPulls                   int                  `toml:"max_concurrent_pulls,omitzero" json:"max_concurrent_pulls" long:"max-concurrent-pulls" env:"DOCKER_MAX_CONCURRENT_PULLS" description:"Maximum number of image pulls running at the same time in the whole runner process, unlimited by default"`
+	FastExitThreshold                    int                  `toml:"fast_exit_threshold,omitzero" json:"fast_exit_threshold" long:"fast-exit-threshold" env:"DOCKER_FAST_EXIT_THRESHOLD" description:"Warn when the build script finishes successfully within this many seconds with almost no output, disabled by default"`
+	CleanupConcurrency                   int                  `toml:"cleanup_concurrency,omitzero" json:"cleanup_concurrency" long:"cleanup-concurrency" env:"DOCKER_CLEANUP_CONCURRENCY" description:"How many containers of a finished build are removed concurrently, 4 by default"`
+	ContainerInspectRetries              int                  `toml:"container_inspect_retries,omitzero" json:"container_inspect_retries" long:"container-inspect-retries" env:"DOCKER_CONTAINER_INSPECT_RETRIES" description:"How many times the inspect of a just created container is retried on transient errors, 3 by default"`
+	FailOnFastExit                       bool                 `toml:"fail_on_fast_exit,omitzero" json:"fail_on_fast_exit" long:"fail-on-fast-exit" env:"DOCKER_FAIL_ON_FAST_EXIT" description:"Fail the build instead of warning when fast_exit_threshold is exceeded"`
+	ContainerLabels                      map[string]string    `toml:"container_labels,omitempty" json:"container_labels" long:"container-labels" description:"A toml table/json object of custom labels added to all containers created by the runner"`
+	MacAddress                           string               `toml:"mac_address,omitempty" json:"mac_address" long:"mac-address" env:"DOCKER_MAC_ADDRESS" description:"MAC address of the build container (eg. 92:d0:c6:0a:29:33)"`
+	Entrypoint                           []string             `toml:"entrypoint,omitempty" json:"entrypoint" long:"entrypoint" env:"DOCKER_ENTRYPOINT" description:"Override the entrypoint of the build image, [\"\"] clears it"`
+	User                                 string               `toml:"user,omitempty" json:"user" long:"user" env:"DOCKER_USER" description:"Run the build container as the specified user or UID, optionally followed by :group or :GID"`
+	WorkingDir                           string               `toml:"working_dir,omitempty" json:"working_dir" long:"working-dir" env:"DOCKER_WORKING_DIR" description:"Absolute path of the working directory of the build container, the build scripts still change to the project directory"`
+	Isolation                            string               `toml:"isolation,omitempty" json:"isolation" long:"isolation" env:"DOCKER_ISOLATION" description:"Isolation technology of the Windows build and service containers (default, process or hyperv)"`
+	Runtime                              string               `toml:"runtime,omitempty" json:"runtime" long:"runtime" env:"DOCKER_RUNTIME" description:"Container runtime to be used for build containers (eg. runc, sysbox-runc)"`
+	ECRAuth                              bool                 `toml:"ecr_auth,omitzero" json:"ecr_auth" long:"ecr-auth" env:"DOCKER_ECR_AUTH" description:"Fetch Amazon ECR authorization tokens for *.dkr.ecr.*.amazonaws.com registries with the docker-credential-ecr-login helper installed on the runner host"`
+	RegistryMirror                       string               `toml:"registry_mirror,omitempty" json:"registry_mirror" long:"registry-mirror" env:"DOCKER_REGISTRY_MIRROR" description:"Registry mirror (eg. mirror.example.com:5000) used to pull images from Docker Hub"`
+	RegistryMirrorFallback               bool                 `toml:"registry_mirror_fallback,omitzero" json:"registry_mirror_fallback" long:"registry-mirror-fallback" env:"DOCKER_REGISTRY_MIRROR_FALLBACK" description:"Pull from Docker Hub when the image can't be pulled from the registry mirror"`
+	NetworkPerBuild                      bool                 `toml:"network_per_build,omitzero" json:"network_per_build" long:"network-per-build" env:"DOCKER_NETWORK_PER_BUILD" description:"Create a user-defined network for each build and connect the build and service containers to it"`
+	IPv4Subnet                           string               `toml:"ipv4_subnet,omitempty" json:"ipv4_subnet" long:"ipv4-subnet" env:"DOCKER_IPV4_SUBNET" description:"IPv4 subnet of the network created with network_per_build (eg. 172.28.0.0/16)"`
+	EnableIPv6                           bool                 `toml:"enable_ipv6,omitzero" json:"enable_ipv6" long:"enable-ipv6" env:"DOCKER_ENABLE_IPV6" description:"Enable IPv6 on the network created with network_per_build"`
+	IPv6Subnet                           string               `toml:"ipv6_subnet,omitempty" json:"ipv6_subnet" long:"ipv6-subnet" env:"DOCKER_IPV6_SUBNET" description:"IPv6 subnet of the network created with network_per_build (eg. fd00:1234::/64)"`
+	HelperImage                          string               `toml:"helper_image,omitempty" json:"helper_image" long:"helper-image" env:"DOCKER_HELPER_IMAGE" description:"[ADVANCED] Pull the helper image from this repository (eg. registry.example.com/gitlab-runner-helper) instead of loading the embedded one"`
+	HelperImageTag                       string               `toml:"helper_image_tag,omitempty" json:"helper_image_tag" long:"helper-image-tag" env:"DOCKER_HELPER_IMAGE_TAG" description:"[ADVANCED] Pin the tag of the helper image instead of using the one matching the runner revision"`
+	CacheImage                           string               `toml:"cache_image,omitempty" json:"cache_image" long:"cache-image" env:"DOCKER_CACHE_IMAGE" description:"[ADVANCED] Image providing the gitlab-runner-cache command used for the cache containers instead of the helper image"`
+	ImageValidationCommand               []string             `toml:"image_validation_command,omitempty" json:"image_validation_command" long:"image-validation-command" env:"DOCKER_IMAGE_VALIDATION_COMMAND" description:"Command executed on the runner host for every build and service image, receiving the image name and ID; a non-zero exit blocks the build"`
+	WarnMutableImageTags                 bool                 `toml:"warn_mutable_image_tags,omitzero" json:"warn_mutable_image_tags" long:"warn-mutable-image-tags" env:"DOCKER_WARN_MUTABLE_IMAGE_TAGS" description:"Warn when a build or service image is not referenced by digest and log the digest that was used"`
+	RequireImageDigest                   bool                 `toml:"require_image_digest,omitzero" json:"require_image_digest" long:"require-image-digest" env:"DOCKER_REQUIRE_IMAGE_DIGEST" description:"Fail builds using build or service images that are not referenced by digest"`
+	ScriptsAsFile                        bool                 `toml:"scripts_as_file,omitzero" json:"scripts_as_file" long:"scripts-as-file" env:"DOCKER_SCRIPTS_AS_FILE" description:"Pass build scripts as files mounted read-only into the build container instead of the standard input"`
+	ScriptsDir                           string               `toml:"scripts_dir,omitempty" json:"scripts_dir" long:"scripts-dir" env:"DOCKER_SCRIPTS_DIR" description:"Host directory in which the build scripts are stored when scripts_as_file is used, defaults to the system temporary directory"`
+	DisableStdin                         bool                 `toml:"disable_stdin,omitzero" json:"disable_stdin" long:"disable-stdin" env:"DOCKER_DISABLE_STDIN" description:"Don't attach the standard input of the build container, requires scripts_as_file"`
+	DryRun                               bool                 `toml:"dry_run,omitzero" json:"dry_run" long:"dry-run" env:"DOCKER_DRY_RUN" description:"[DEBUG] Print the docker run equivalent of the service and build containers to the build trace and fail the build instead of creating them"`
 }
 
 type DockerMachine struct {
@@ -181,7 +274,11 @@ type RunnerSettings struct {
 	PreBuildScript  string   `toml:"pre_build_script,omitempty" json:"pre_build_script" long:"pre-build-script" env:"RUNNER_PRE_BUILD_SCRIPT" description:"Runner-specific command script executed after code is pulled, just before build executes"`
 	PostBuildScript string   `toml:"post_build_script,omitempty" json:"post_build_script" long:"post-build-script" env:"RUNNER_POST_BUILD_SCRIPT" description:"Runner-specific command script executed after code is pulled and just after build executes"`
 
-	Shell string `toml:"shell,omitempty" json:"shell" long:"shell" env:"RUNNER_SHELL" description:"Select bash, cmd or powershell"`
+	Shell         string `toml:"shell,omitempty" json:"shell" long:"shell" env:"RUNNER_SHELL" description:"Select bash, cmd or powershell"`
+	DisableColors bool   `toml:"disable_colors,omitzero" json:"disable_colors" long:"disable-colors" env:"RUNNER_DISABLE_COLORS" description:"Don't use ANSI color codes in the messages printed by PowerShell scripts"`
+
+	UserScopeVariables    []string `toml:"user_scope_variables,omitempty" json:"user_scope_variables" long:"user-scope-variables" env:"RUNNER_USER_SCOPE_VARIABLES" description:"Keys of the variables which PowerShell scripts also set at the User scope, persisted after the build"`
+	MachineScopeVariables []string `toml:"machine_scope_variables,omitempty" json:"machine_scope_variables" long:"machine-scope-variables" env:"RUNNER_MACHINE_SCOPE_VARIABLES" description:"Keys of the variables which PowerShell scripts also set at the Machine scope, persisted after the build"`
 
 	SSH        *ssh.Config       `toml:"ssh,omitempty" json:"ssh" group:"ssh executor" namespace:"ssh"`
 	Docker     *DockerConfig     `toml:"docker,omitempty" json:"docker" group:"docker executor" namespace:"docker"`
@@ -241,6 +338,14 @@ func (c *KubernetesConfig) GetPollInterval() int {
 	return c.PollInterval
 }
 
+func (c *DockerConfig) GetServiceLogsTail() int {
+	if c.ServiceLogsTail == 0 {
+		return DefaultServiceLogsTail
+	}
+
+	return c.ServiceLogsTail
+}
+
 func (c *DockerMachine) GetIdleCount() int {
 	if c.isOffPeak() {
 		return c.OffPeakIdleCount
@@ -12,6 +12,7 @@ const ReloadConfigInterval = 3
 const HealthyChecks = 3
 const HealthCheckInterval = 3600
 const DefaultWaitForServicesTimeout = 30
+const DefaultServiceLogsTail = 100
 const ShutdownTimeout = 30
 const DefaultOutputLimit = 4096 // 4MB in kilobytes
 const ForceTraceSentInterval = 30 * time.Second
@@ -21,5 +22,6 @@ const DefaultArtifactDownloadAttempts = 1
 const DefaultRestoreCacheAttempts = 1
 const KubernetesPollInterval = 3
 const KubernetesPollTimeout = 180
+const MaxCommandLineLength = 32767 // limit of CreateProcess on Windows
 
 var PreparationRetryInterval = 3 * time.Second
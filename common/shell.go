@@ -1,7 +1,12 @@
 package common
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"strings"
+	"unicode/utf16"
+
 	log "github.com/Sirupsen/logrus"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers"
 )
@@ -13,6 +18,10 @@ type ShellConfiguration struct {
 	Arguments     []string
 	PassFile      bool
 	Extension     string
+
+	// EncodedCommandArguments precede the script passed inline as a base64
+	// encoded UTF-16LE argument, like PowerShell's -EncodedCommand
+	EncodedCommandArguments []string
 }
 
 type ShellType int
@@ -30,6 +39,35 @@ func (s *ShellConfiguration) GetCommandWithArguments() []string {
 	return parts
 }
 
+// GetEncodedCommand returns the command line passing the script inline. It
+// returns false if the shell doesn't support it or the command line would
+// exceed the maximum length, the script has to be passed as a file then.
+func (s *ShellConfiguration) GetEncodedCommand(script string) ([]string, bool) {
+	if len(s.EncodedCommandArguments) == 0 {
+		return nil, false
+	}
+
+	parts := []string{s.Command}
+	parts = append(parts, s.EncodedCommandArguments...)
+	parts = append(parts, encodeCommand(script))
+	if len(strings.Join(parts, " ")) > MaxCommandLineLength {
+		return nil, false
+	}
+	return parts, true
+}
+
+func encodeCommand(script string) string {
+	// the byte order mark is meaningless in UTF-16LE
+	script = strings.TrimPrefix(script, "\xef\xbb\xbf")
+
+	encoded := utf16.Encode([]rune(script))
+	data := make([]byte, len(encoded)*2)
+	for i, char := range encoded {
+		binary.LittleEndian.PutUint16(data[i*2:], char)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
 func (s *ShellConfiguration) String() string {
 	return helpers.ToYAML(s)
 }
@@ -43,6 +81,14 @@ type ShellScriptInfo struct {
 	PreCloneScript  string
 	PreBuildScript  string
 	PostBuildScript string
+	DisableColors   bool
+
+	// OS is the operating system running the script, the one of the
+	// runner when empty
+	OS string
+
+	UserScopeVariables    []string
+	MachineScopeVariables []string
 }
 
 type Shell interface {
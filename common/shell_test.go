@@ -0,0 +1,27 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellConfigurationGetEncodedCommand(t *testing.T) {
+	config := ShellConfiguration{
+		Command:   "powershell",
+		Arguments: []string{"-command"},
+		PassFile:  true,
+	}
+
+	_, ok := config.GetEncodedCommand("echo test")
+	assert.False(t, ok, "the shell doesn't support encoded commands")
+
+	config.EncodedCommandArguments = []string{"-EncodedCommand"}
+	command, ok := config.GetEncodedCommand("\xef\xbb\xbfecho ż")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"powershell", "-EncodedCommand", "ZQBjAGgAbwAgAHwB"}, command)
+
+	_, ok = config.GetEncodedCommand(strings.Repeat("a", MaxCommandLineLength/2))
+	assert.False(t, ok, "the command line would be too long")
+}
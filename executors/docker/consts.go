@@ -1,7 +1,82 @@
 package docker
 
+import "time"
+
 const DockerAPIVersion = "1.18"
+
+// linksDeprecatedAPIVersion introduced user-defined networks, since then
+// container links are considered a legacy feature
+const linksDeprecatedAPIVersion = "1.21"
+
+// hostGatewayAPIVersion (Docker 20.10) translates the host-gateway
+// of the extra hosts to the gateway address itself
+const hostGatewayAPIVersion = "1.41"
+const hostGateway = "host-gateway"
+
 const dockerLabelPrefix = "com.gitlab.gitlab-runner"
+const reservedLabelPrefix = "com.gitlab."
 
 const prebuiltImageName = "gitlab/gitlab-runner-helper"
 const prebuiltImageExtension = ".tar.xz"
+
+// pullProgressInterval limits how often the image pull progress is printed
+const pullProgressInterval = 5 * time.Second
+
+// staleCachesCleanupTimeout limits the time spent on removing expired cache containers
+const staleCachesCleanupTimeout = 5 * time.Minute
+
+// scriptsContainerDir is where the build scripts are mounted when scripts_as_file is used
+const scriptsContainerDir = "/gitlab-runner-scripts"
+
+// defaultContainerInspectRetries is how many times the inspect of a just
+// created container is retried, unless configured otherwise
+const defaultContainerInspectRetries = 3
+
+// defaultCleanupConcurrency limits the concurrent container removals of a
+// finished build, unless configured otherwise
+const defaultCleanupConcurrency = 4
+
+// containerRemoveRetries is how many times a removal failing with
+// a transient conflict is retried
+const containerRemoveRetries = 3
+
+// networkRemoveRetries is how many times the removal of a per-build
+// network still having active endpoints is retried
+const networkRemoveRetries = 3
+
+// maskedSecret replaces the values of secret variables in the build trace
+const maskedSecret = "[MASKED]"
+
+// minMaskedSecretLength keeps very short values, like 1 or true, from
+// being masked all over the trace
+const minMaskedSecretLength = 4
+
+// defaultShutdownGracePeriod is the time given to the build containers to exit
+// with the stop shutdown policy, the same as for `docker stop`
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// failedContainerSuffix is added, with the failure time, to the names of
+// the containers kept with keep_failed_containers
+const failedContainerSuffix = "-failed-"
+
+// fastExitMaximumOutputSize is the build output size (in bytes) below which
+// a quickly finished build is considered to not have run the script at all
+const fastExitMaximumOutputSize = 64
+
+// serviceHealthCheckRemoveTimeout limits the removal of the service health
+// check container, which isn't bounded by the wait for the service
+const serviceHealthCheckRemoveTimeout = 30 * time.Second
+
+// serviceDialTimeout limits a single connection attempt to a service port
+const serviceDialTimeout = time.Second
+
+// serviceHealthCheckLogLines is how many health check results are shown
+// when the service never becomes healthy
+const serviceHealthCheckLogLines = 3
+
+// Exit codes of the gitlab-runner-service health-check probe. Any other
+// non-zero exit code means that the probe itself failed unexpectedly.
+const (
+	serviceHealthCheckSuccessExitCode = 0 // service port is open
+	serviceHealthCheckNoPortExitCode  = 1 // service doesn't expose any TCP port
+)
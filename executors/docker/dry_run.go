@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers"
+)
+
+// errDryRun stops the build once its containers were printed with dry_run
+var errDryRun = errors.New("dry_run is enabled, the containers were printed but not created")
+
+// plainShellWordRegex matches the arguments printed without quotes
+var plainShellWordRegex = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// dockerRunCommand builds the docker run equivalent of a container
+type dockerRunCommand []string
+
+func (c *dockerRunCommand) add(flag string, values ...string) {
+	for _, value := range values {
+		if value != "" {
+			*c = append(*c, flag, value)
+		}
+	}
+}
+
+func (c *dockerRunCommand) addBool(flag string, value bool) {
+	if value {
+		*c = append(*c, flag)
+	}
+}
+
+func (c dockerRunCommand) String() string {
+	quoted := make([]string, len(c))
+	for i, argument := range c {
+		quoted[i] = argument
+		if !plainShellWordRegex.MatchString(argument) {
+			quoted[i] = helpers.ShellEscape(argument)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// maskSecretVariables replaces the values of the secret variables,
+// regardless of their length, as the printed command is meant to be copied
+func (s *executor) maskSecretVariables(env []string) []string {
+	secretKeys := make(map[string]bool)
+	for _, variable := range s.Build.GetAllVariables() {
+		if !variable.Public && !variable.Internal {
+			secretKeys[variable.Key] = true
+		}
+	}
+
+	masked := make([]string, len(env))
+	for i, variable := range env {
+		key := strings.SplitN(variable, "=", 2)[0]
+		if secretKeys[key] {
+			variable = key + "=" + maskedSecret
+		}
+		masked[i] = variable
+	}
+	return masked
+}
+
+func sortedKeyValues(values map[string]string) (pairs []string) {
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return
+}
+
+// getDockerRunCommand returns the docker run command creating
+// the same container as the given configuration
+func (s *executor) getDockerRunCommand(containerName, imageName string, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig) string {
+	command := dockerRunCommand{"docker", "run"}
+	command.add("--name", containerName)
+	command.add("--hostname", config.Hostname)
+	command.addBool("--interactive", config.OpenStdin)
+	command.add("--user", config.User)
+	command.add("--workdir", config.WorkingDir)
+	command.add("--mac-address", config.MacAddress)
+	command.add("--stop-signal", config.StopSignal)
+	command.add("--env", s.maskSecretVariables(config.Env)...)
+	command.add("--label", sortedKeyValues(config.Labels)...)
+	if len(config.Entrypoint) > 0 {
+		// an empty entrypoint resets the one of the image
+		command = append(command, "--entrypoint", config.Entrypoint[0])
+	}
+
+	command.add("--volume", hostConfig.Binds...)
+	command.add("--volumes-from", hostConfig.VolumesFrom...)
+	command.add("--volume-driver", hostConfig.VolumeDriver)
+	for _, mount := range hostConfig.Mounts {
+		command.add("--mount", fmt.Sprintf("type=%s,source=%s,target=%s", mount.Type, mount.Source, mount.Target))
+	}
+	command.add("--link", hostConfig.Links...)
+	command.add("--network", string(hostConfig.NetworkMode))
+	if networkingConfig != nil {
+		for _, endpoint := range networkingConfig.EndpointsConfig {
+			command.add("--network-alias", endpoint.Aliases...)
+		}
+	}
+	command.add("--add-host", hostConfig.ExtraHosts...)
+	command.add("--dns", hostConfig.DNS...)
+	command.add("--dns-search", hostConfig.DNSSearch...)
+	command.add("--dns-option", hostConfig.DNSOptions...)
+
+	command.addBool("--privileged", hostConfig.Privileged)
+	command.add("--cap-add", hostConfig.CapAdd...)
+	command.add("--cap-drop", hostConfig.CapDrop...)
+	command.add("--security-opt", hostConfig.SecurityOpt...)
+	command.add("--runtime", hostConfig.Runtime)
+	command.add("--isolation", string(hostConfig.Isolation))
+	command.add("--restart", hostConfig.RestartPolicy.Name)
+
+	command.add("--cpuset-cpus", hostConfig.CpusetCpus)
+	command.add("--cgroup-parent", hostConfig.CgroupParent)
+	if hostConfig.Memory > 0 {
+		command.add("--memory", fmt.Sprint(hostConfig.Memory))
+	}
+	if hostConfig.PidsLimit > 0 {
+		command.add("--pids-limit", fmt.Sprint(hostConfig.PidsLimit))
+	}
+	if hostConfig.OomKillDisable != nil {
+		command.addBool("--oom-kill-disable", *hostConfig.OomKillDisable)
+	}
+	if hostConfig.OomScoreAdj != 0 {
+		command.add("--oom-score-adj", fmt.Sprint(hostConfig.OomScoreAdj))
+	}
+	for _, device := range hostConfig.Devices {
+		command.add("--device", device.PathOnHost+":"+device.PathInContainer+":"+device.CgroupPermissions)
+	}
+	command.add("--log-driver", hostConfig.LogConfig.Type)
+	command.add("--log-opt", sortedKeyValues(hostConfig.LogConfig.Config)...)
+
+	command = append(command, imageName)
+	if len(config.Entrypoint) > 1 {
+		command = append(command, config.Entrypoint[1:]...)
+	}
+	command = append(command, config.Cmd...)
+	return command.String()
+}
+
+// printDockerRun prints the container instead of creating it, with dry_run
+func (s *executor) printDockerRun(containerName, imageName string, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig) {
+	s.Println("Dry run of", containerName+":", s.getDockerRunCommand(containerName, imageName, config, hostConfig, networkingConfig))
+}
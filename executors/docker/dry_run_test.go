@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers/docker"
+)
+
+func TestDryRunPrintsContainersWithoutCreatingThem(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	trace := &bytes.Buffer{}
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Variables = common.BuildVariables{
+		{Key: "PUBLIC", Value: "visible", Public: true},
+		{Key: "TOKEN", Value: "s3", Public: false},
+	}
+	e.BuildShell = &common.ShellConfiguration{}
+	e.BuildLogger = common.NewBuildLogger(&common.Trace{Writer: trace}, logrus.WithFields(logrus.Fields{}))
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.Config.Docker.DryRun = true
+	e.Config.Docker.Memory = "512m"
+	e.Config.Docker.CapAdd = []string{"NET_ADMIN"}
+	e.Config.Docker.Entrypoint = []string{""}
+	e.binds = []string{"/cache:/cache"}
+
+	// only the images are inspected, nothing is created nor removed
+	c.On("ImageInspectWithRaw", context.TODO(), "mysql:latest").
+		Return(types.ImageInspect{ID: "mysql-image"}, nil, nil).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+		Return(types.ImageInspect{ID: "alpine-image"}, nil, nil).
+		Once()
+
+	linksMap := make(map[string]*types.Container)
+	err := e.createFromServiceDescription(dockerService{Name: "mysql"}, linksMap)
+	require.NoError(t, err)
+	assert.Empty(t, e.services)
+	assert.Equal(t, []string{e.Build.ProjectUniqueName() + "-mysql:mysql"}, e.links)
+
+	_, err = e.createContainer("build", "alpine", []string{"sh", "-c", "echo test"})
+	require.Error(t, err)
+	assert.IsType(t, &common.BuildError{}, err)
+	assert.Empty(t, e.buildContainers)
+
+	output := trace.String()
+	assert.Contains(t, output, "Dry run of "+e.Build.ProjectUniqueName()+"-mysql: docker run --name "+e.Build.ProjectUniqueName()+"-mysql ")
+	assert.Contains(t, output, "--env $'TOKEN=[MASKED]'")
+	assert.Contains(t, output, "--env PUBLIC=visible")
+	assert.NotContains(t, output, "s3")
+	assert.Contains(t, output, "--volume /cache:/cache")
+	assert.Contains(t, output, "--link "+e.Build.ProjectUniqueName()+"-mysql:mysql")
+	assert.Contains(t, output, "--cap-add NET_ADMIN")
+	assert.Contains(t, output, "--memory 536870912")
+	assert.Contains(t, output, "--entrypoint '' ")
+	assert.Contains(t, output, "alpine sh -c $'echo test'")
+}
+
+func TestMaskSecretVariables(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Variables = common.BuildVariables{
+		{Key: "PUBLIC", Value: "value", Public: true},
+		{Key: "SECRET", Value: "a=b"},
+	}
+
+	masked := e.maskSecretVariables([]string{"PUBLIC=value", "SECRET=a=b", "OTHER=value"})
+	assert.Equal(t, []string{"PUBLIC=value", "SECRET=[MASKED]", "OTHER=value"}, masked)
+}
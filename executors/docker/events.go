@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Types of the lifecycle events emitted by the Docker executors
+const (
+	EventImagePullStarted  = "image_pull_started"
+	EventImagePullFinished = "image_pull_finished"
+	EventContainerCreated  = "container_created"
+	EventServiceReady      = "service_ready"
+	EventBuildFinished     = "build_finished"
+	EventCleanupFinished   = "cleanup_finished"
+)
+
+// LifecycleEvent describes a step of the build, only the fields relevant
+// for the type of the event are set
+type LifecycleEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	BuildID   int       `json:"build_id"`
+	ProjectID int       `json:"project_id"`
+
+	Image         string  `json:"image,omitempty"`
+	ContainerID   string  `json:"container_id,omitempty"`
+	ContainerName string  `json:"container_name,omitempty"`
+	ContainerType string  `json:"container_type,omitempty"`
+	ExitCode      *int    `json:"exit_code,omitempty"`
+	Duration      float64 `json:"duration_seconds,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// LifecycleHook receives the lifecycle events of all Docker executors of the
+// process. The hooks are called synchronously, so they should return quickly.
+type LifecycleHook interface {
+	OnLifecycleEvent(event LifecycleEvent)
+}
+
+var lifecycleHooks struct {
+	sync.RWMutex
+	hooks []LifecycleHook
+}
+
+// RegisterLifecycleHook adds the hook called on the lifecycle events,
+// without any registered hook the events are not even created
+func RegisterLifecycleHook(hook LifecycleHook) {
+	lifecycleHooks.Lock()
+	defer lifecycleHooks.Unlock()
+	lifecycleHooks.hooks = append(lifecycleHooks.hooks, hook)
+}
+
+func getLifecycleHooks() []LifecycleHook {
+	lifecycleHooks.RLock()
+	defer lifecycleHooks.RUnlock()
+	return lifecycleHooks.hooks
+}
+
+// JSONLifecycleHook writes the events as a stream of JSON objects,
+// one per line, eg. to a file read by a logging pipeline
+type JSONLifecycleHook struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONLifecycleHook(w io.Writer) *JSONLifecycleHook {
+	return &JSONLifecycleHook{encoder: json.NewEncoder(w)}
+}
+
+// OnLifecycleEvent implements LifecycleHook.
+func (h *JSONLifecycleHook) OnLifecycleEvent(event LifecycleEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	err := h.encoder.Encode(event)
+	if err != nil {
+		logrus.Warningln("Failed to write the", event.Type, "lifecycle event:", err)
+	}
+}
+
+func (s *executor) emitEvent(event LifecycleEvent) {
+	hooks := getLifecycleHooks()
+	if len(hooks) == 0 {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	if s.Build != nil {
+		event.BuildID = s.Build.ID
+		event.ProjectID = s.Build.ProjectID
+	}
+	for _, hook := range hooks {
+		hook.OnLifecycleEvent(event)
+	}
+}
+
+func getEventError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers/docker"
+)
+
+type recordingLifecycleHook struct {
+	events []LifecycleEvent
+}
+
+func (h *recordingLifecycleHook) OnLifecycleEvent(event LifecycleEvent) {
+	h.events = append(h.events, event)
+}
+
+func withLifecycleHook(t *testing.T, hook LifecycleHook, fn func()) {
+	defer func(hooks []LifecycleHook) {
+		lifecycleHooks.hooks = hooks
+	}(lifecycleHooks.hooks)
+	lifecycleHooks.hooks = nil
+
+	RegisterLifecycleHook(hook)
+	fn()
+}
+
+func TestEmitEventWithoutHooks(t *testing.T) {
+	e := executor{}
+	assert.NotPanics(t, func() {
+		e.emitEvent(LifecycleEvent{Type: EventCleanupFinished})
+	})
+}
+
+func TestEmitEvent(t *testing.T) {
+	hook := &recordingLifecycleHook{}
+	withLifecycleHook(t, hook, func() {
+		e := executor{}
+		e.Build = &common.Build{
+			GetBuildResponse: common.GetBuildResponse{ID: 10, ProjectID: 20},
+		}
+		e.emitEvent(LifecycleEvent{Type: EventContainerCreated, ContainerID: "id", ContainerType: "build"})
+	})
+
+	require.Equal(t, 1, len(hook.events))
+	event := hook.events[0]
+	assert.Equal(t, EventContainerCreated, event.Type)
+	assert.Equal(t, 10, event.BuildID)
+	assert.Equal(t, 20, event.ProjectID)
+	assert.Equal(t, "id", event.ContainerID)
+	assert.False(t, event.Time.IsZero())
+}
+
+func TestPullDockerImageEmitsEvents(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	options := buildImagePullOptions(e, "test")
+
+	c.On("ImagePullBlocking", context.TODO(), "test:latest", options, mock.Anything).
+		Return(os.ErrNotExist).
+		Once()
+
+	hook := &recordingLifecycleHook{}
+	withLifecycleHook(t, hook, func() {
+		_, err := e.pullDockerImage("test", nil)
+		assert.Error(t, err)
+	})
+
+	require.Equal(t, 2, len(hook.events))
+	assert.Equal(t, EventImagePullStarted, hook.events[0].Type)
+	assert.Equal(t, "test", hook.events[0].Image)
+	assert.Equal(t, EventImagePullFinished, hook.events[1].Type)
+	assert.Equal(t, os.ErrNotExist.Error(), hook.events[1].Error)
+}
+
+func TestJSONLifecycleHook(t *testing.T) {
+	var buffer bytes.Buffer
+	hook := NewJSONLifecycleHook(&buffer)
+
+	exitCode := 1
+	hook.OnLifecycleEvent(LifecycleEvent{Type: EventBuildFinished, BuildID: 10, ExitCode: &exitCode})
+	hook.OnLifecycleEvent(LifecycleEvent{Type: EventCleanupFinished, BuildID: 10})
+
+	lines := bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n"))
+	require.Equal(t, 2, len(lines))
+
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &event))
+	assert.Equal(t, EventBuildFinished, event["type"])
+	assert.Equal(t, float64(1), event["exit_code"])
+	_, hasImage := event["image"]
+	assert.False(t, hasImage, "the fields not set are omitted")
+
+	event = nil
+	require.NoError(t, json.Unmarshal(lines[1], &event))
+	assert.Equal(t, EventCleanupFinished, event["type"])
+}
@@ -3,22 +3,36 @@ package docker
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/executors"
@@ -30,9 +44,191 @@ import (
 
 var neverRestartPolicy = container.RestartPolicy{Name: "no"}
 
+// containerInspectRetryInterval is the delay between inspects of a just created container
+var containerInspectRetryInterval = time.Second
+
+// containerRemoveRetryInterval is the delay before the first retry of
+// a container removal, it's doubled with each following attempt
+var containerRemoveRetryInterval = time.Second
+
+// networkRemoveRetryInterval is the delay before the first retry of
+// a network removal, doubled with each further retry
+var networkRemoveRetryInterval = time.Second
+
+// serviceDialInterval is the delay between checks of the service ports or health
+var serviceDialInterval = time.Second
+
+// dockerService describes a service defined in .gitlab-ci.yml. It can be
+// given either as a plain image name or as an object with additional settings.
+type dockerService struct {
+	Name string `json:"name"`
+
+	// NoReadinessCheck disables waiting for the service ports to be open,
+	// useful for sidecars which don't expose any network
+	NoReadinessCheck bool `json:"no_readiness_check"`
+
+	// Hostname is set as the service container hostname and as an
+	// additional alias under which the build can reach the service
+	Hostname string `json:"hostname"`
+
+	// NameSuffix is appended to the service container name, which allows
+	// running the same image as multiple services
+	NameSuffix string `json:"name_suffix"`
+
+	// ReadinessTimeout overrides wait_for_services_timeout (in seconds)
+	ReadinessTimeout int `json:"readiness_timeout"`
+
+	// Variables, when defined, are the only build variables passed to the
+	// service next to the ones predefined by the runner
+	Variables map[string]string `json:"variables"`
+
+	// MacAddress is set as the MAC address of the service container
+	MacAddress string `json:"mac_address"`
+
+	// IPAddress is the static IPv4 or IPv6 address of the service
+	// on the network created with network_per_build
+	IPAddress string `json:"ip_address"`
+
+	// Privileged overrides the privileged setting of the runner for the
+	// service, it can only be enabled when the runner allows it
+	Privileged *bool `json:"privileged"`
+
+	// CapAdd and CapDrop are added to services_cap_add and services_cap_drop,
+	// the added capabilities need to be allowed by allowed_services_cap_add
+	CapAdd  []string `json:"cap_add"`
+	CapDrop []string `json:"cap_drop"`
+
+	// SecurityOpt replaces services_security_opt, the options need
+	// to be allowed by allowed_services_security_opt
+	SecurityOpt []string `json:"security_opt"`
+
+	// Volumes, when defined, are the container paths of the build volumes and
+	// host volumes mounted into the service instead of the whole build volume
+	Volumes []string `json:"volumes"`
+
+	// Restart is the restart policy of the service, like on-failure:2,
+	// for images which crash once on startup
+	Restart string `json:"restart"`
+
+	// ConfigFiles maps the container paths of files mounted read-only into
+	// the service to their content, which can reference the build variables
+	ConfigFiles map[string]string `json:"config_files"`
+}
+
+var serviceHostnameLabelRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+var serviceNameSuffixRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+var containerUserRegex = regexp.MustCompile(`^[^:\s]+(:[^:\s]+)?$`)
+var macAddressRegex = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+var securityOptRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*([=:].+)?$`)
+
+// validate checks the service settings which are used in the container configuration
+func (d *dockerService) validate() error {
+	if d.Hostname != "" && !isValidHostname(d.Hostname) {
+		return fmt.Errorf("service %s: hostname %q is not a valid RFC 1123 hostname", d.Name, d.Hostname)
+	}
+	if d.NameSuffix != "" && !serviceNameSuffixRegex.MatchString(d.NameSuffix) {
+		return fmt.Errorf("service %s: name suffix %q can contain only [a-zA-Z0-9_.-] characters", d.Name, d.NameSuffix)
+	}
+	if err := validateMacAddress(d.MacAddress); err != nil {
+		return fmt.Errorf("service %s: %v", d.Name, err)
+	}
+	if d.IPAddress != "" && net.ParseIP(d.IPAddress) == nil {
+		return fmt.Errorf("service %s: ip address %q is not a valid IPv4 or IPv6 address", d.Name, d.IPAddress)
+	}
+	if err := validateSecurityOpt("security_opt", d.SecurityOpt); err != nil {
+		return fmt.Errorf("service %s: %v", d.Name, err)
+	}
+	if _, err := parseRestartPolicy(d.Restart); err != nil {
+		return fmt.Errorf("service %s: %v", d.Name, err)
+	}
+	for containerPath := range d.ConfigFiles {
+		if !path.IsAbs(containerPath) || strings.Contains(containerPath, ":") || path.Base(containerPath) == "/" {
+			return fmt.Errorf("service %s: config file %q needs to be an absolute container path of a file", d.Name, containerPath)
+		}
+	}
+	for _, volume := range d.Volumes {
+		if volume == "" || strings.Contains(volume, ":") {
+			return fmt.Errorf("service %s: volume %q needs to be the container path of a build or host volume", d.Name, volume)
+		}
+	}
+	return nil
+}
+
+// parseRestartPolicy accepts no and on-failure with an optional maximum
+// retry count, the other policies would restart the service forever
+func parseRestartPolicy(policy string) (container.RestartPolicy, error) {
+	parts := strings.SplitN(policy, ":", 2)
+	switch {
+	case policy == "" || policy == "no":
+		return neverRestartPolicy, nil
+	case parts[0] != "on-failure":
+		return container.RestartPolicy{}, fmt.Errorf("restart policy %q is not supported, only no and on-failure[:max-retries] can be used", policy)
+	case len(parts) == 1:
+		return container.RestartPolicy{Name: "on-failure"}, nil
+	}
+
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 1 {
+		return container.RestartPolicy{}, fmt.Errorf("restart policy %q needs a positive number of retries", policy)
+	}
+	return container.RestartPolicy{Name: "on-failure", MaximumRetryCount: count}, nil
+}
+
+// validateSecurityOpt only checks the form of the options, like
+// apparmor=profile or seccomp=unconfined, they are passed to Docker unchanged
+func validateSecurityOpt(optionName string, options []string) error {
+	for _, option := range options {
+		if !securityOptRegex.MatchString(option) {
+			return fmt.Errorf("%s needs to contain key=value options (eg. apparmor=profile), got %q", optionName, option)
+		}
+	}
+	return nil
+}
+
+func isValidHostname(hostname string) bool {
+	if len(hostname) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if !serviceHostnameLabelRegex.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *dockerService) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		d.Name = name
+		return nil
+	}
+
+	type serviceObject dockerService
+	return json.Unmarshal(data, (*serviceObject)(d))
+}
+
+// getExtraLinkNames returns the aliases of a service with a name suffix or
+// a custom hostname, so differently named instances of the same image get
+// their own aliases
+func (d *dockerService) getExtraLinkNames(linkNames []string) (extraNames []string) {
+	if d.NameSuffix != "" {
+		for _, linkName := range linkNames {
+			extraNames = append(extraNames, linkName+"-"+d.NameSuffix)
+		}
+	}
+	if d.Hostname != "" {
+		extraNames = append(extraNames, d.Hostname)
+	}
+	return
+}
+
 type dockerOptions struct {
-	Image    string   `json:"image"`
-	Services []string `json:"services"`
+	Image      string                  `json:"image"`
+	Services   []dockerService         `json:"services"`
+	PullPolicy common.DockerPullPolicy `json:"pull_policy"`
+	Entrypoint []string                `json:"entrypoint"`
 }
 
 type executor struct {
@@ -44,14 +240,121 @@ type executor struct {
 	caches      []string // IDs of cache containers
 	options     dockerOptions
 	info        types.Info
+	version     types.Version
 	binds       []string
+	bindPaths   map[string]string // binds by their container path
 	volumesFrom []string
+	buildBinds  []string // mounted only into the build container
+	volumes     []string // temporary volumes removed in Cleanup
+	networks    []string // IDs of the per-build networks removed in Cleanup
+	mounts      []mount.Mount
 	devices     []container.DeviceMapping
 	links       []string
+
+	buildVolumeDir string // kept in the predefined container when disable_build_volume is used
+	networkMode    string // name of the user-defined network the containers are connected to
+	detached       bool   // containers are left running on runner shutdown
+
+	buildContainerID string // its address is exposed once the container is started
+
+	buildContainers []*types.Container // predefined and build containers, replaced by name in the next build
+	buildFailure    string             // why the build failed, its containers are kept with keep_failed_containers
+
+	volumePaths map[string]string // container paths of the volumesFrom entries
+	gatewayIP   string            // resolved for the host-gateway extra hosts
+
+	buildDeadline  time.Time
+	serviceImages  map[string]*types.ImageInspect // service images already validated in this build
+	resolvedImages map[string]*types.ImageInspect // images already inspected or pulled in this build
+	pendingImages  map[string]*imagePull          // images being pulled in background with pre_pull_images
+
+	// supportsScriptFiles is set by executors able to pass the build
+	// scripts as files with the scripts_as_file option
+	supportsScriptFiles bool
+	serviceDefinitions  map[string]dockerService // service definitions by service container ID
+
+	secrets []string // values of the secret variables masked in the build trace
+
+	serviceFilesDir string // host directory with the config files of the services
+
+	pullPolicy common.DockerPullPolicy // requested by the job, if allowed
+}
+
+// maskedTrace redacts the secrets in everything written to the build trace.
+// Secrets split between two writes aren't detected.
+type maskedTrace struct {
+	common.BuildTrace
+	mask func(string) string
+}
+
+func (t *maskedTrace) Write(p []byte) (int, error) {
+	_, err := io.WriteString(t.BuildTrace, t.mask(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// getSecrets returns the values of the variables which are neither public
+// nor defined by the runner, the longest first so they're masked whole
+func (s *executor) getSecrets() (secrets []string) {
+	for _, variable := range s.Build.GetAllVariables() {
+		if !variable.Public && !variable.Internal && len(variable.Value) >= minMaskedSecretLength {
+			secrets = append(secrets, variable.Value)
+		}
+	}
+	sort.Sort(longestFirst(secrets))
+	return
+}
+
+type longestFirst []string
+
+func (l longestFirst) Len() int           { return len(l) }
+func (l longestFirst) Less(i, j int) bool { return len(l[i]) > len(l[j]) }
+func (l longestFirst) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (s *executor) maskSecrets(text string) string {
+	for _, secret := range s.secrets {
+		text = strings.Replace(text, secret, maskedSecret, -1)
+	}
+	return text
+}
+
+// maskBuildTrace makes all writes of the executor to the build trace
+// go through maskSecrets
+func (s *executor) maskBuildTrace() {
+	s.secrets = s.getSecrets()
+	if len(s.secrets) == 0 || s.BuildTrace == nil {
+		return
+	}
+
+	s.BuildTrace = &maskedTrace{BuildTrace: s.BuildTrace, mask: s.maskSecrets}
+	s.BuildLogger = common.NewBuildLogger(s.BuildTrace, s.Build.Log())
 }
 
-func (s *executor) getServiceVariables() []string {
-	return s.Build.GetAllVariables().PublicOrInternal().StringList()
+func (s *executor) getServiceVariables(definition dockerService) []string {
+	allVariables := s.Build.GetAllVariables()
+	if definition.Variables == nil {
+		return allVariables.PublicOrInternal().StringList()
+	}
+
+	// the declared variables are added to the ones exposed to every service,
+	// they come last so they override these
+	variables := allVariables.PublicOrInternal()
+
+	keys := make([]string, 0, len(definition.Variables))
+	for key := range definition.Variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		variables = append(variables, common.BuildVariable{
+			Key:   key,
+			Value: allVariables.ExpandValue(definition.Variables[key]),
+		})
+	}
+	return variables.StringList()
 }
 
 func (s *executor) getUserAuthConfiguration(indexName string) *types.AuthConfig {
@@ -93,6 +396,13 @@ func (s *executor) getBuildAuthConfiguration(indexName string) *types.AuthConfig
 }
 
 func (s *executor) getHomeDirAuthConfiguration(indexName string) *types.AuthConfig {
+	authConfig, err := docker_helpers.ReadDockerCredentialHelperAuthConfig(s.Shell().User, indexName)
+	if err != nil {
+		s.Warningln("Failed to get credentials for", indexName, "from the credential helper:", err)
+	} else if authConfig != nil {
+		return authConfig
+	}
+
 	authConfigs, _ := docker_helpers.ReadDockerAuthConfigsFromHomeDir(s.Shell().User)
 	if authConfigs != nil {
 		return docker_helpers.ResolveDockerAuthConfig(indexName, authConfigs)
@@ -100,10 +410,26 @@ func (s *executor) getHomeDirAuthConfiguration(indexName string) *types.AuthConf
 	return nil
 }
 
+func (s *executor) getECRAuthConfiguration(indexName string) *types.AuthConfig {
+	if s.Config.Docker == nil || !s.Config.Docker.ECRAuth {
+		return nil
+	}
+
+	authConfig, err := docker_helpers.GetECRAuthConfig(indexName)
+	if err != nil {
+		s.Warningln("Failed to get Amazon ECR authorization token for", indexName+":", err)
+		return nil
+	}
+	return authConfig
+}
+
 func (s *executor) getAuthConfig(imageName string) *types.AuthConfig {
 	indexName, _ := docker_helpers.SplitDockerImageName(imageName)
 
 	authConfig := s.getUserAuthConfiguration(indexName)
+	if authConfig == nil {
+		authConfig = s.getECRAuthConfiguration(indexName)
+	}
 	if authConfig == nil {
 		authConfig = s.getHomeDirAuthConfiguration(indexName)
 	}
@@ -122,6 +448,18 @@ func (s *executor) getAuthConfig(imageName string) *types.AuthConfig {
 }
 
 func (s *executor) pullDockerImage(imageName string, ac *types.AuthConfig) (*types.ImageInspect, error) {
+	var err error
+	started := time.Now()
+	s.emitEvent(LifecycleEvent{Type: EventImagePullStarted, Image: imageName})
+	defer func() {
+		s.emitEvent(LifecycleEvent{
+			Type:     EventImagePullFinished,
+			Image:    imageName,
+			Duration: time.Since(started).Seconds(),
+			Error:    getEventError(err),
+		})
+	}()
+
 	s.Println("Pulling docker image", imageName, "...")
 
 	ref := imageName
@@ -135,10 +473,23 @@ func (s *executor) pullDockerImage(imageName string, ac *types.AuthConfig) (*typ
 		options.RegistryAuth, _ = docker_helpers.EncodeAuthConfig(ac)
 	}
 
-	if err := s.client.ImagePullBlocking(context.TODO(), ref, options); err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			return nil, &common.BuildError{Inner: err}
+	if mirrorRef := s.getRegistryMirrorReference(ref); mirrorRef != "" {
+		// the Docker Hub credentials are sent only to Docker Hub itself
+		mirrorOptions := types.ImagePullOptions{}
+		if mirrorAuth := s.getAuthConfig(mirrorRef); mirrorAuth != nil {
+			mirrorOptions.RegistryAuth, _ = docker_helpers.EncodeAuthConfig(mirrorAuth)
 		}
+
+		err = s.pullDockerImageFromMirror(mirrorRef, ref, mirrorOptions)
+		if err != nil && s.Config.Docker.RegistryMirrorFallback {
+			s.Warningln("Failed to pull", ref, "from registry mirror:", err)
+			s.Println("Falling back to the upstream registry for", ref, "...")
+			err = s.pullDockerImageReference(ref, options)
+		}
+	} else {
+		err = s.pullDockerImageReference(ref, options)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -146,8 +497,178 @@ func (s *executor) pullDockerImage(imageName string, ac *types.AuthConfig) (*typ
 	return &image, err
 }
 
+func (s *executor) pullDockerImageReference(ref string, options types.ImagePullOptions) error {
+	// the pull timeout doesn't include the time spent waiting for other pulls
+	pullLimiter.acquire(s.getMaxConcurrentPulls(), func() {
+		s.Println("Waiting for other image pulls to finish before pulling", ref, "...")
+	})
+	defer pullLimiter.release()
+
+	ctx := context.TODO()
+	if pullTimeout := s.getPullTimeout(); pullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), pullTimeout)
+		defer cancel()
+	}
+
+	if err := s.client.ImagePullBlocking(ctx, ref, options, s.getPullProgressFunc(ref)); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("pulling docker image %s timed out after %v", ref, s.getPullTimeout())
+		}
+		if strings.Contains(err.Error(), "not found") {
+			return &common.BuildError{Inner: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// getPullProgressFunc returns the reporter of the image pull progress. The
+// per-layer updates are summarized and printed at most once per pullProgressInterval.
+func (s *executor) getPullProgressFunc(ref string) docker_helpers.PullProgressFunc {
+	lastUpdate := time.Now()
+
+	return func(progress docker_helpers.PullProgress) {
+		if time.Since(lastUpdate) < pullProgressInterval {
+			return
+		}
+		lastUpdate = time.Now()
+
+		s.Println(fmt.Sprintf("Pulling %s: %d/%d layers, %s/%s", ref,
+			progress.CompletedLayers, progress.Layers,
+			units.HumanSize(float64(progress.Downloaded)), units.HumanSize(float64(progress.Total))))
+	}
+}
+
+// pullDockerImageFromMirror pulls the image through the mirror and tags it
+// with the original reference, so it can be found by the regular inspect
+func (s *executor) pullDockerImageFromMirror(mirrorRef, ref string, options types.ImagePullOptions) error {
+	s.Debugln("Using registry mirror", mirrorRef, "for", ref, "...")
+	err := s.pullDockerImageReference(mirrorRef, options)
+	if err != nil {
+		return err
+	}
+
+	return s.client.ImageTag(context.TODO(), mirrorRef, ref)
+}
+
+// getRegistryMirrorReference returns the reference of the image in the
+// registry mirror, or an empty string when the image should be pulled directly
+func (s *executor) getRegistryMirrorReference(ref string) string {
+	if s.Config.Docker == nil || s.Config.Docker.RegistryMirror == "" {
+		return ""
+	}
+
+	// digest references can't be tagged back with the original name
+	if strings.Contains(ref, "@") {
+		return ""
+	}
+
+	indexName, remoteName := docker_helpers.SplitDockerImageName(ref)
+	if indexName != docker_helpers.DefaultDockerRegistry {
+		return ""
+	}
+
+	// official images live in the library namespace
+	if !strings.Contains(remoteName, "/") {
+		remoteName = "library/" + remoteName
+	}
+
+	mirror := s.Config.Docker.RegistryMirror
+	if index := strings.Index(mirror, "://"); index >= 0 {
+		mirror = mirror[index+3:]
+	}
+	return strings.TrimSuffix(mirror, "/") + "/" + remoteName
+}
+
+func (s *executor) getPullTimeout() time.Duration {
+	if s.Config.Docker == nil {
+		return 0
+	}
+	return time.Duration(s.Config.Docker.PullTimeout) * time.Second
+}
+
+func (s *executor) getMaxConcurrentPulls() int {
+	if s.Config.Docker == nil {
+		return 0
+	}
+	return s.Config.Docker.MaxConcurrentPulls
+}
+
+// getDockerImage returns the image, pulling it according to the pull policy.
+// Images don't change during the build, so each reference is resolved once.
 func (s *executor) getDockerImage(imageName string) (*types.ImageInspect, error) {
-	pullPolicy, err := s.Config.Docker.PullPolicy.Get()
+	if image := s.resolvedImages[imageName]; image != nil {
+		s.Debugln("Using already resolved image", imageName, "...")
+		return image, nil
+	}
+
+	if pull := s.pendingImages[imageName]; pull != nil {
+		s.Debugln("Waiting for the background pull of", imageName, "...")
+		return s.finishImagePull(imageName, pull)
+	}
+
+	image, err := s.resolveDockerImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.addResolvedImage(imageName, image)
+	return image, nil
+}
+
+func (s *executor) addResolvedImage(imageName string, image *types.ImageInspect) {
+	if s.resolvedImages == nil {
+		s.resolvedImages = make(map[string]*types.ImageInspect)
+	}
+	s.resolvedImages[imageName] = image
+}
+
+// getPullPolicy returns the pull policy requested by the job,
+// or the one configured for the runner
+func (s *executor) getPullPolicy() (common.DockerPullPolicy, error) {
+	if s.pullPolicy != "" {
+		return s.pullPolicy, nil
+	}
+	return s.Config.Docker.PullPolicy.Get()
+}
+
+// verifyAllowedPullPolicy checks the pull policy requested by the job against
+// allowed_pull_policies. Without the list only the runner's pull_policy is
+// allowed, since other policies could give access to images of other projects.
+func (s *executor) verifyAllowedPullPolicy(pullPolicy common.DockerPullPolicy) error {
+	pullPolicy, err := pullPolicy.Get()
+	if err != nil {
+		return err
+	}
+
+	allowedPullPolicies := s.Config.Docker.AllowedPullPolicies
+	if len(allowedPullPolicies) == 0 {
+		defaultPullPolicy, err := s.Config.Docker.PullPolicy.Get()
+		if err != nil {
+			return err
+		}
+		allowedPullPolicies = []common.DockerPullPolicy{defaultPullPolicy}
+	}
+
+	for _, allowedPullPolicy := range allowedPullPolicies {
+		if allowedPullPolicy == pullPolicy {
+			return nil
+		}
+	}
+
+	s.Println()
+	s.Errorln("The", pullPolicy, "pull policy is not present on list of allowed pull policies")
+	for _, allowedPullPolicy := range allowedPullPolicies {
+		s.Println("-", allowedPullPolicy)
+	}
+	s.Println()
+	s.Println("Please check runner's configuration: allowed_pull_policies")
+	return errors.New("invalid pull policy")
+}
+
+func (s *executor) resolveDockerImage(imageName string) (*types.ImageInspect, error) {
+	pullPolicy, err := s.getPullPolicy()
 	if err != nil {
 		return nil, err
 	}
@@ -159,29 +680,152 @@ func (s *executor) getDockerImage(imageName string) (*types.ImageInspect, error)
 
 	// If never is specified then we return what inspect did return
 	if pullPolicy == common.PullPolicyNever {
+		if err == nil {
+			pullMetrics.observeLocalHit(pullPolicy)
+		}
 		return &image, err
 	}
 
 	if err == nil {
 		// Don't pull image that is passed by ID
 		if image.ID == imageName {
+			pullMetrics.observeLocalHit(pullPolicy)
 			return &image, nil
 		}
 
 		// If not-present is specified
 		if pullPolicy == common.PullPolicyIfNotPresent {
 			s.Println("Using locally found image version due to if-not-present pull policy")
+			pullMetrics.observeLocalHit(pullPolicy)
 			return &image, err
 		}
 	}
 
+	started := time.Now()
 	newImage, err := s.pullDockerImage(imageName, authConfig)
+	pullMetrics.observePull(pullPolicy, started, err)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyImageDigest(imageName, newImage)
 	if err != nil {
 		return nil, err
 	}
 	return newImage, nil
 }
 
+// validateImage checks the image reference, then runs the configured
+// image_validation_command for the image and blocks the build when the
+// command rejects it. The command receives the image name and the resolved
+// image ID as the last two arguments.
+func (s *executor) validateImage(imageName string, image *types.ImageInspect) error {
+	err := s.checkImageReference(imageName, image)
+	if err != nil {
+		return err
+	}
+
+	command := s.Config.Docker.ImageValidationCommand
+	if len(command) == 0 {
+		return nil
+	}
+
+	s.Debugln("Validating image", imageName, "("+image.ID+")", "...")
+
+	args := append(append([]string{}, command[1:]...), imageName, image.ID)
+	cmd := exec.Command(command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"IMAGE_NAME="+imageName,
+		"IMAGE_ID="+image.ID,
+		"IMAGE_REPO_DIGESTS="+strings.Join(image.RepoDigests, " "))
+
+	output, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); ok {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			s.Errorln(message)
+		}
+		return &common.BuildError{
+			Inner: fmt.Errorf("image %s (%s) was rejected by the image validation policy: %v", imageName, image.ID, err),
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to run image validation command for %s: %v", imageName, err)
+	}
+	return nil
+}
+
+// isMutableImageReference returns true when the image isn't referenced by
+// a digest or an ID, so it may resolve to a different image in the future
+func isMutableImageReference(imageName string, image *types.ImageInspect) bool {
+	if imageName == image.ID {
+		return false
+	}
+
+	ref, err := reference.Parse(imageName)
+	if err != nil {
+		return true
+	}
+
+	_, digested := ref.(reference.Digested)
+	return !digested
+}
+
+// checkImageReference reports images referenced by mutable tags together
+// with the digest that was actually used, or rejects them if digests are required
+func (s *executor) checkImageReference(imageName string, image *types.ImageInspect) error {
+	if !s.Config.Docker.WarnMutableImageTags && !s.Config.Docker.RequireImageDigest {
+		return nil
+	}
+
+	if !isMutableImageReference(imageName, image) {
+		return nil
+	}
+
+	if s.Config.Docker.RequireImageDigest {
+		return &common.BuildError{
+			Inner: fmt.Errorf("image %s is not referenced by digest, which is required by the runner configuration", imageName),
+		}
+	}
+
+	resolved := strings.Join(image.RepoDigests, ", ")
+	if resolved == "" {
+		resolved = image.ID
+	}
+
+	s.Build.Log().WithFields(logrus.Fields{
+		"image":    imageName,
+		"image_id": image.ID,
+		"digests":  image.RepoDigests,
+	}).Warningln("Image referenced by mutable tag")
+	s.Warningln("Image", imageName, "is referenced by a mutable tag, it resolved to", resolved)
+	return nil
+}
+
+// verifyImageDigest checks that an image referenced by digest really resolved
+// to that digest, which guards against registries serving a different image
+func verifyImageDigest(imageName string, image *types.ImageInspect) error {
+	ref, err := reference.Parse(imageName)
+	if err != nil {
+		return nil
+	}
+
+	digested, ok := ref.(reference.Digested)
+	if !ok {
+		return nil
+	}
+
+	expectedDigest := digested.Digest().String()
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+expectedDigest) {
+			return nil
+		}
+	}
+
+	return &common.BuildError{
+		Inner: fmt.Errorf("image %s resolved to %s which doesn't match the requested digest %s (found: %s)",
+			imageName, image.ID, expectedDigest, strings.Join(image.RepoDigests, ", ")),
+	}
+}
+
 func (s *executor) getArchitecture() string {
 	architecture := s.info.Architecture
 	switch architecture {
@@ -203,22 +847,59 @@ func (s *executor) getArchitecture() string {
 	}
 }
 
-func (s *executor) getPrebuiltImage() (*types.ImageInspect, error) {
+// getPlatform names the prebuilt image matching the daemon. The Linux images
+// are named after the architecture only, other systems prefix it with the OS.
+func (s *executor) getPlatform() string {
 	architecture := s.getArchitecture()
 	if architecture == "" {
-		return nil, errors.New("unsupported docker architecture")
+		return ""
 	}
 
-	imageName := prebuiltImageName + ":" + architecture + "-" + common.REVISION
-	s.Debugln("Looking for prebuilt image", imageName, "...")
-	image, _, err := s.client.ImageInspectWithRaw(context.TODO(), imageName)
-	if err == nil {
-		return &image, nil
+	osType := s.info.OSType
+	if osType == "" {
+		osType = runtime.GOOS
 	}
 
-	data, err := Asset("prebuilt-" + architecture + prebuiltImageExtension)
-	if err != nil {
-		return nil, fmt.Errorf("Unsupported architecture: %s: %q", architecture, err.Error())
+	if osType == "linux" {
+		return architecture
+	}
+
+	// unlike Linux, Windows has separate images for 64-bit ARM
+	switch s.info.Architecture {
+	case "aarch64", "arm64":
+		architecture = "arm64"
+	}
+	return osType + "-" + architecture
+}
+
+func (s *executor) getPrebuiltImage() (*types.ImageInspect, error) {
+	platform := s.getPlatform()
+	if platform == "" {
+		return nil, errors.New("unsupported docker platform")
+	}
+
+	imageName, pinned := s.getPrebuiltImageReference(platform)
+	if image := s.resolvedImages[imageName]; image != nil {
+		return image, nil
+	}
+
+	s.Debugln("Looking for prebuilt image", imageName, "...")
+	image, _, err := s.client.ImageInspectWithRaw(context.TODO(), imageName)
+	if err == nil {
+		s.verifyPrebuiltImageArchitecture(imageName, &image, pinned)
+		s.addResolvedImage(imageName, &image)
+		return &image, nil
+	}
+
+	// the configured or pinned helper image is never replaced by the
+	// embedded one, which is built for the runner revision
+	if s.Config.Docker.HelperImage != "" || pinned {
+		return s.pullPrebuiltImage(imageName, pinned)
+	}
+
+	data, err := Asset("prebuilt-" + platform + prebuiltImageExtension)
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported platform: %s: %q", platform, err.Error())
 	}
 
 	s.Debugln("Loading prebuilt image...")
@@ -229,7 +910,7 @@ func (s *executor) getPrebuiltImage() (*types.ImageInspect, error) {
 		SourceName: "-",
 	}
 	options := types.ImageImportOptions{
-		Tag: architecture + "-" + common.REVISION,
+		Tag: platform + "-" + common.REVISION,
 	}
 
 	if err := s.client.ImageImportBlocking(context.TODO(), source, ref, options); err != nil {
@@ -242,9 +923,78 @@ func (s *executor) getPrebuiltImage() (*types.ImageInspect, error) {
 		return nil, err
 	}
 
+	s.addResolvedImage(imageName, &image)
 	return &image, err
 }
 
+// getPrebuiltImageReference returns the reference of the helper image and
+// whether it is pinned, with helper_image_tag or a tag or digest of helper_image,
+// instead of following the runner revision
+func (s *executor) getPrebuiltImageReference(platform string) (string, bool) {
+	imageName := prebuiltImageName
+	if s.Config.Docker.HelperImage != "" {
+		imageName = s.Config.Docker.HelperImage
+	}
+
+	if hasImageTagOrDigest(imageName) {
+		return imageName, true
+	}
+	if s.Config.Docker.HelperImageTag != "" {
+		return imageName + ":" + s.Config.Docker.HelperImageTag, true
+	}
+	return imageName + ":" + platform + "-" + common.REVISION, false
+}
+
+func hasImageTagOrDigest(imageName string) bool {
+	ref, err := reference.Parse(imageName)
+	if err != nil {
+		return false
+	}
+
+	_, tagged := ref.(reference.Tagged)
+	_, digested := ref.(reference.Digested)
+	return tagged || digested
+}
+
+// pullPrebuiltImage pulls the helper image from the registry of helper_image
+func (s *executor) pullPrebuiltImage(imageName string, pinned bool) (*types.ImageInspect, error) {
+	image, err := s.pullDockerImage(imageName, s.getAuthConfig(imageName))
+	if err != nil {
+		return nil, err
+	}
+
+	s.verifyPrebuiltImageArchitecture(imageName, image, pinned)
+	s.addResolvedImage(imageName, image)
+	return image, nil
+}
+
+// verifyPrebuiltImageArchitecture warns when the pinned helper image was
+// built for another architecture than the one of the docker daemon. The
+// tag of a pinned image doesn't name the platform, so it can't be trusted.
+func (s *executor) verifyPrebuiltImageArchitecture(imageName string, image *types.ImageInspect, pinned bool) {
+	if !pinned || image.Architecture == "" {
+		return
+	}
+
+	architecture := getImageArchitecture(image.Architecture)
+	if architecture != s.getArchitecture() {
+		s.Warningln("The helper image", imageName, "is built for", image.Architecture,
+			"but the docker daemon runs on", s.getArchitecture()+". The build will probably fail!")
+	}
+}
+
+// getImageArchitecture translates the GOARCH-style architecture of the image
+// to the naming of getArchitecture
+func getImageArchitecture(architecture string) string {
+	switch architecture {
+	case "amd64":
+		return "x86_64"
+	case "arm", "arm64":
+		return "arm"
+	}
+	return architecture
+}
+
 func (s *executor) getAbsoluteContainerPath(dir string) string {
 	if path.IsAbs(dir) {
 		return dir
@@ -252,15 +1002,85 @@ func (s *executor) getAbsoluteContainerPath(dir string) string {
 	return path.Join(s.Build.FullProjectDir(), dir)
 }
 
-func (s *executor) addHostVolume(hostPath, containerPath string) error {
-	containerPath = s.getAbsoluteContainerPath(containerPath)
+func (s *executor) getHostVolumeBind(hostPath, containerPath string, options []string) string {
+	bind := fmt.Sprintf("%v:%v", hostPath, s.getAbsoluteContainerPath(containerPath))
+	if len(options) > 0 {
+		bind += ":" + strings.Join(options, ",")
+	}
+	return bind
+}
+
+// namedVolumeRegex matches the host side of the volumes that are
+// names of Docker volumes rather than host paths
+var namedVolumeRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// getAbsoluteHostPath resolves the relative host path against volumes_base_dir,
+// or the current working directory, like the container path is resolved
+// against the project directory
+func (s *executor) getAbsoluteHostPath(hostPath string) (string, error) {
+	if filepath.IsAbs(hostPath) || namedVolumeRegex.MatchString(hostPath) {
+		return hostPath, nil
+	}
+	return filepath.Abs(filepath.Join(s.Config.Docker.VolumesBaseDir, hostPath))
+}
+
+func (s *executor) addHostVolume(hostPath, containerPath string, options []string) error {
+	hostPath, err := s.getAbsoluteHostPath(hostPath)
+	if err != nil {
+		return err
+	}
+
+	containerPath = path.Clean(s.getAbsoluteContainerPath(containerPath))
 	s.Debugln("Using host-based", hostPath, "for", containerPath, "...")
-	s.binds = append(s.binds, fmt.Sprintf("%v:%v", hostPath, containerPath))
+	return s.addBind(s.getHostVolumeBind(hostPath, containerPath, options), containerPath)
+}
+
+// addBind adds the bind mounted at containerPath. Identical binds are added
+// only once, while different binds at the same path are rejected, since the
+// container couldn't be created with a duplicate mount point.
+func (s *executor) addBind(bind, containerPath string) error {
+	if s.bindPaths == nil {
+		s.bindPaths = make(map[string]string)
+	}
+
+	containerPath = path.Clean(containerPath)
+	if existing, ok := s.bindPaths[containerPath]; ok {
+		if existing == bind {
+			s.Debugln("Skipping duplicate volume", bind, "...")
+			return nil
+		}
+		return fmt.Errorf("volumes %q and %q are both mounted at %s", existing, bind, containerPath)
+	}
+
+	s.bindPaths[containerPath] = bind
+	s.binds = append(s.binds, bind)
 	return nil
 }
 
+// addVolumesFrom shares the volumes of the container, containerPath is used
+// to select them for the services with their own list of volumes
+func (s *executor) addVolumesFrom(volumesFrom, containerPath string) {
+	if s.volumePaths == nil {
+		s.volumePaths = make(map[string]string)
+	}
+	s.volumePaths[volumesFrom] = containerPath
+	s.volumesFrom = append(s.volumesFrom, volumesFrom)
+}
+
+// getBuildDeadline estimates when the build will time out. It's exposed in the
+// container labels, so external tools can tell running builds from leftovers.
+func (s *executor) getBuildDeadline() time.Time {
+	if s.buildDeadline.IsZero() {
+		s.buildDeadline = time.Now().UTC().Add(time.Duration(s.Build.GetBuildTimeout()) * time.Second)
+	}
+	return s.buildDeadline
+}
+
 func (s *executor) getLabels(containerType string, otherLabels ...string) map[string]string {
 	labels := make(map[string]string)
+	for key, value := range s.Config.Docker.ContainerLabels {
+		labels[key] = value
+	}
 	labels[dockerLabelPrefix+".build.id"] = strconv.Itoa(s.Build.ID)
 	labels[dockerLabelPrefix+".build.sha"] = s.Build.Sha
 	labels[dockerLabelPrefix+".build.before_sha"] = s.Build.BeforeSha
@@ -269,6 +1089,8 @@ func (s *executor) getLabels(containerType string, otherLabels ...string) map[st
 	labels[dockerLabelPrefix+".runner.id"] = s.Build.Runner.ShortDescription()
 	labels[dockerLabelPrefix+".runner.local_id"] = strconv.Itoa(s.Build.RunnerID)
 	labels[dockerLabelPrefix+".type"] = containerType
+	labels[dockerLabelPrefix+".build.timeout"] = strconv.Itoa(s.Build.GetBuildTimeout())
+	labels[dockerLabelPrefix+".build.deadline"] = s.getBuildDeadline().Format(time.RFC3339)
 	for _, label := range otherLabels {
 		keyValue := strings.SplitN(label, "=", 2)
 		if len(keyValue) == 2 {
@@ -278,10 +1100,36 @@ func (s *executor) getLabels(containerType string, otherLabels ...string) map[st
 	return labels
 }
 
+// getCacheImage returns the configured cache_image, or the prebuilt one
+func (s *executor) getCacheImage() (*types.ImageInspect, error) {
+	if s.Config.Docker.CacheImage != "" {
+		return s.getDockerImage(s.Config.Docker.CacheImage)
+	}
+
+	// get busybox image
+	return s.getPrebuiltImage()
+}
+
+// cacheImageError explains the failure of the cache container, which with
+// the cache_image usually means that the image doesn't provide gitlab-runner-cache
+func (s *executor) cacheImageError(err error) error {
+	if s.Config.Docker.CacheImage == "" {
+		return err
+	}
+
+	exitCode, exited := getContainerExitCode(err)
+	if exited && exitCode != 126 && exitCode != 127 {
+		return err
+	}
+	if !exited && !strings.Contains(err.Error(), "executable file not found") {
+		return err
+	}
+	return fmt.Errorf("cache_image %q needs to provide the gitlab-runner-cache command: %v", s.Config.Docker.CacheImage, err)
+}
+
 // createCacheVolume returns the id of the created container, or an error
 func (s *executor) createCacheVolume(containerName, containerPath string) (string, error) {
-	// get busybox image
-	cacheImage, err := s.getPrebuiltImage()
+	cacheImage, err := s.getCacheImage()
 	if err != nil {
 		return "", err
 	}
@@ -298,9 +1146,19 @@ func (s *executor) createCacheVolume(containerName, containerPath string) (strin
 	}
 
 	hostConfig := &container.HostConfig{
-		LogConfig: container.LogConfig{
-			Type: "json-file",
-		},
+		LogConfig: s.getLogConfig(),
+	}
+
+	// anonymous volumes are always created by the local driver
+	if s.Config.Docker.VolumeDriver != "" {
+		volumeName, err := s.createDriverCacheVolume(containerName, containerPath)
+		if err != nil {
+			return "", err
+		}
+
+		config.Volumes = nil
+		hostConfig.VolumeDriver = s.Config.Docker.VolumeDriver
+		hostConfig.Binds = []string{volumeName + ":" + containerPath}
 	}
 
 	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, nil, containerName)
@@ -315,23 +1173,76 @@ func (s *executor) createCacheVolume(containerName, containerPath string) (strin
 	err = s.client.ContainerStart(context.TODO(), resp.ID, types.ContainerStartOptions{})
 	if err != nil {
 		s.failures = append(s.failures, resp.ID)
-		return "", err
+		return "", s.cacheImageError(err)
 	}
 
 	s.Debugln("Waiting for cache container", resp.ID, "...")
-	err = s.waitForContainer(resp.ID)
+	err = s.waitForContainer(context.TODO(), resp.ID)
 	if err != nil {
 		s.failures = append(s.failures, resp.ID)
-		return "", err
+		return "", s.cacheImageError(err)
 	}
 
 	return resp.ID, nil
 }
 
-func (s *executor) addCacheVolume(containerPath string) error {
+// createDriverCacheVolume creates the volume of a cache container through the
+// configured volume driver. Volumes of temporary caches are removed in Cleanup.
+func (s *executor) createDriverCacheVolume(containerName, containerPath string) (string, error) {
+	options := volume.VolumesCreateBody{
+		Name:       containerName,
+		Driver:     s.Config.Docker.VolumeDriver,
+		DriverOpts: s.getVolumeDriverOpts(),
+		Labels:     s.getLabels("cache", "cache.dir="+containerPath),
+	}
+
+	created, err := s.client.VolumeCreate(context.TODO(), options)
+	if err != nil {
+		return "", err
+	}
+
+	if containerName == "" {
+		s.volumes = append(s.volumes, created.Name)
+	}
+
+	s.Debugln("Using", s.Config.Docker.VolumeDriver, "volume", created.Name, "for cache", containerPath, "...")
+	return created.Name, nil
+}
+
+// getLogConfig returns the log driver of all created containers,
+// json-file by default
+func (s *executor) getLogConfig() container.LogConfig {
+	logConfig := container.LogConfig{
+		Type:   "json-file",
+		Config: map[string]string{},
+	}
+	if s.Config.Docker.LogDriver != "" {
+		logConfig.Type = s.Config.Docker.LogDriver
+	}
+	for key, value := range s.Config.Docker.LogOpts {
+		logConfig.Config[key] = value
+	}
+	return logConfig
+}
+
+func (s *executor) getVolumeDriverOpts() map[string]string {
+	opts := map[string]string{}
+	for key, value := range s.Config.Docker.VolumeDriverOpts {
+		opts[key] = value
+	}
+	return opts
+}
+
+func (s *executor) addCacheVolume(containerPath string, readOnly bool) error {
 	var err error
 	containerPath = s.getAbsoluteContainerPath(containerPath)
 
+	// the path is already shared with the host, creating a cache would only shadow it
+	if s.isHostMountedVolume(containerPath, s.Config.Docker.Volumes...) {
+		s.Debugln("Using existing host volume for", containerPath, "...")
+		return nil
+	}
+
 	// disable cache for automatic container cache, but leave it for host volumes (they are shared on purpose)
 	if s.Config.Docker.DisableCache {
 		s.Debugln("Container cache for", containerPath, " is disabled.")
@@ -347,9 +1258,24 @@ func (s *executor) addCacheVolume(containerPath string) error {
 		if err != nil {
 			return err
 		}
+		if resolvedPath := resolveSymlinks(hostPath); resolvedPath != hostPath {
+			s.Println("Cache path", hostPath, "is a symlink, using", resolvedPath, "instead...")
+			hostPath = resolvedPath
+		}
 		s.Debugln("Using path", hostPath, "as cache for", containerPath, "...")
-		s.binds = append(s.binds, fmt.Sprintf("%v:%v", filepath.ToSlash(hostPath), containerPath))
-		return nil
+		bind := fmt.Sprintf("%v:%v", filepath.ToSlash(hostPath), containerPath)
+		if readOnly {
+			bind += ":ro"
+		}
+		return s.addBind(bind, containerPath)
+	}
+
+	// use named volume
+	if s.Config.Docker.NamedCacheVolumes {
+		if s.supportsNamedVolumeMounts() {
+			return s.addNamedCacheVolume(fmt.Sprintf("%s-cache-%x", s.Build.ProjectUniqueName(), hash), containerPath, readOnly)
+		}
+		s.Debugln("Docker", s.info.ServerVersion, "doesn't support volume mounts, using cache container for", containerPath, "...")
 	}
 
 	// get existing cache container
@@ -358,7 +1284,7 @@ func (s *executor) addCacheVolume(containerPath string) error {
 	if inspected, err := s.client.ContainerInspect(context.TODO(), containerName); err == nil {
 		// check if we have valid cache, if not remove the broken container
 		if _, stale := inspected.Config.Volumes[containerPath]; stale {
-			s.removeContainer(inspected.ID)
+			s.removeContainer(context.TODO(), inspected.ID)
 		} else {
 			containerID = inspected.ID
 		}
@@ -373,20 +1299,152 @@ func (s *executor) addCacheVolume(containerPath string) error {
 	}
 
 	s.Debugln("Using container", containerID, "as cache", containerPath, "...")
-	s.volumesFrom = append(s.volumesFrom, containerID)
+	if readOnly {
+		s.addVolumesFrom(containerID+":ro", containerPath)
+	} else {
+		s.addVolumesFrom(containerID, containerPath)
+	}
 	return nil
 }
 
-func (s *executor) addVolume(volume string) error {
-	var err error
-	hostVolume := strings.SplitN(volume, ":", 2)
-	switch len(hostVolume) {
-	case 2:
-		err = s.addHostVolume(hostVolume[0], hostVolume[1])
+// resolveSymlinks resolves symlinks in the longest existing part of the
+// path, since the Docker daemon would bind mount the symlink target anyway
+func resolveSymlinks(dir string) string {
+	var missing []string
+	for current := dir; ; current = filepath.Dir(current) {
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...)
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return dir
+		}
+		missing = append([]string{filepath.Base(current)}, missing...)
+	}
+}
+
+// addNamedCacheVolume creates (or reuses) a named volume for the cache, which
+// is mounted directly instead of being inherited from a cache container
+func (s *executor) addNamedCacheVolume(volumeName, containerPath string, readOnly bool) error {
+	options := volume.VolumesCreateBody{
+		Name:       volumeName,
+		Driver:     s.Config.Docker.VolumeDriver,
+		DriverOpts: s.getVolumeDriverOpts(),
+		Labels:     s.getLabels("cache", "cache.dir="+containerPath),
+	}
+
+	created, err := s.client.VolumeCreate(context.TODO(), options)
+	if err != nil {
+		return err
+	}
+
+	s.Debugln("Using volume", created.Name, "as cache", containerPath, "...")
+	s.mounts = append(s.mounts, mount.Mount{
+		Type:     mount.TypeVolume,
+		Source:   created.Name,
+		Target:   containerPath,
+		ReadOnly: readOnly,
+	})
+	return nil
+}
+
+// supportsNamedVolumeMounts checks if the daemon understands HostConfig.Mounts,
+// which were added in Docker 1.13 (API 1.25)
+func (s *executor) supportsNamedVolumeMounts() bool {
+	parts := strings.SplitN(s.info.ServerVersion, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major > 1 || (major == 1 && minor >= 13)
+}
+
+// volumeOptions are the mode options accepted in the volumes entries
+var volumeOptions = []string{"ro", "rw", "z", "Z", "nocopy",
+	"shared", "rshared", "slave", "rslave", "private", "rprivate"}
 
+func isVolumeOption(option string) bool {
+	for _, volumeOption := range volumeOptions {
+		if option == volumeOption {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVolume splits the `<path>[:<options>]` or
+// `<host-path>:<path>[:<options>]` volume definition
+func parseVolume(volume string) (hostPath, containerPath string, options []string, err error) {
+	parts := strings.Split(volume, ":")
+
+	var rawOptions string
+	switch len(parts) {
 	case 1:
+		containerPath = parts[0]
+	case 2:
+		// the options can't be told apart from a relative path, the known options win
+		if areVolumeOptions(parts[1]) {
+			containerPath, rawOptions = parts[0], parts[1]
+		} else {
+			hostPath, containerPath = parts[0], parts[1]
+		}
+	case 3:
+		hostPath, containerPath, rawOptions = parts[0], parts[1], parts[2]
+	default:
+		return "", "", nil, fmt.Errorf("invalid volume specification: %q", volume)
+	}
+
+	if rawOptions != "" {
+		options = strings.Split(rawOptions, ",")
+	}
+	for _, option := range options {
+		if !isVolumeOption(option) {
+			return "", "", nil, fmt.Errorf("unknown option %q of volume %q, supported options are: %s",
+				option, volume, strings.Join(volumeOptions, ", "))
+		}
+		if hostPath == "" && option != "ro" && option != "rw" {
+			return "", "", nil, fmt.Errorf("option %q of volume %q is not supported for cache volumes, only ro or rw can be used",
+				option, volume)
+		}
+	}
+	return
+}
+
+func areVolumeOptions(rawOptions string) bool {
+	for _, option := range strings.Split(rawOptions, ",") {
+		if !isVolumeOption(option) {
+			return false
+		}
+	}
+	return true
+}
+
+func isReadOnlyVolume(options []string) bool {
+	for _, option := range options {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *executor) addVolume(volume string) error {
+	hostPath, containerPath, options, err := parseVolume(volume)
+	if err == nil && hostPath != "" {
+		err = s.addHostVolume(hostPath, containerPath, options)
+	} else if err == nil {
 		// disable cache disables
-		err = s.addCacheVolume(hostVolume[0])
+		err = s.addCacheVolume(containerPath, isReadOnlyVolume(options))
 	}
 
 	if err != nil {
@@ -418,6 +1476,14 @@ func (s *executor) createBuildVolume() error {
 		return s.addVolume(parentDir)
 	}
 
+	if s.Config.Docker.DisableBuildVolume {
+		// sources are not reused between builds, so keep them in the predefined
+		// container and share them with the build container
+		s.Debugln("Skipping build volume for", parentDir)
+		s.buildVolumeDir = parentDir
+		return nil
+	}
+
 	// create temporary cache container
 	id, err := s.createCacheVolume("", parentDir)
 	if err != nil {
@@ -425,7 +1491,7 @@ func (s *executor) createBuildVolume() error {
 	}
 
 	s.caches = append(s.caches, id)
-	s.volumesFrom = append(s.volumesFrom, id)
+	s.addVolumesFrom(id, parentDir)
 
 	return nil
 }
@@ -536,600 +1602,2646 @@ func (s *executor) splitServiceAndVersion(serviceDescription string) (service, v
 	return
 }
 
-func (s *executor) createService(service, version, image string) (*types.Container, error) {
-	if len(service) == 0 {
-		return nil, errors.New("invalid service name")
+// getServiceImage resolves and validates the service image only once per
+// build, so services sharing the same image are not admitted repeatedly
+func (s *executor) getServiceImage(imageName string) (*types.ImageInspect, error) {
+	if image := s.serviceImages[imageName]; image != nil {
+		s.Debugln("Using already resolved image", imageName, "...")
+		return image, nil
 	}
 
-	s.Println("Starting service", service+":"+version, "...")
-	serviceImage, err := s.getDockerImage(image)
+	image, err := s.getDockerImage(imageName)
 	if err != nil {
 		return nil, err
 	}
 
-	containerName := s.Build.ProjectUniqueName() + "-" + strings.Replace(service, "/", "__", -1)
-
-	// this will fail potentially some builds if there's name collision
-	s.removeContainer(containerName)
-
-	config := &container.Config{
-		Image:  serviceImage.ID,
-		Labels: s.getLabels("service", "service="+service, "service.version="+version),
-		Env:    s.getServiceVariables(),
-	}
-
-	hostConfig := &container.HostConfig{
-		RestartPolicy: neverRestartPolicy,
-		Privileged:    s.Config.Docker.Privileged,
-		NetworkMode:   container.NetworkMode(s.Config.Docker.NetworkMode),
-		Binds:         s.binds,
-		VolumesFrom:   s.volumesFrom,
-		LogConfig: container.LogConfig{
-			Type: "json-file",
-		},
-	}
-
-	s.Debugln("Creating service container", containerName, "...")
-	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, nil, containerName)
+	err = s.validateImage(imageName, image)
 	if err != nil {
 		return nil, err
 	}
 
-	s.Debugln("Starting service container", resp.ID, "...")
-	err = s.client.ContainerStart(context.TODO(), resp.ID, types.ContainerStartOptions{})
-	if err != nil {
-		s.failures = append(s.failures, resp.ID)
-		return nil, err
+	if s.serviceImages == nil {
+		s.serviceImages = make(map[string]*types.ImageInspect)
 	}
+	s.serviceImages[imageName] = image
+	return image, nil
+}
 
-	return fakeContainer(resp.ID, containerName), nil
+// getServiceExtraHosts returns services_extra_hosts, or extra_hosts when it's not set
+func (s *executor) getServiceExtraHosts() []string {
+	if len(s.Config.Docker.ServicesExtraHosts) > 0 {
+		return s.Config.Docker.ServicesExtraHosts
+	}
+	return s.Config.Docker.ExtraHosts
 }
 
-func (s *executor) getServiceNames() ([]string, error) {
-	services := s.Config.Docker.Services
+// getExtraHosts replaces host-gateway in the extra hosts with the gateway of
+// the default bridge network, for daemons which don't do it themselves
+func (s *executor) getExtraHosts(extraHosts []string) ([]string, error) {
+	if s.version.APIVersion != "" && !versions.LessThan(s.version.APIVersion, hostGatewayAPIVersion) {
+		return extraHosts, nil
+	}
 
-	for _, service := range s.options.Services {
-		service = s.Build.GetAllVariables().ExpandValue(service)
-		err := s.verifyAllowedImage(service, "services", s.Config.Docker.AllowedServices, s.Config.Docker.Services)
-		if err != nil {
-			return nil, err
+	var hosts []string
+	for _, host := range extraHosts {
+		if !strings.HasSuffix(host, ":"+hostGateway) {
+			hosts = append(hosts, host)
+			continue
 		}
 
-		services = append(services, service)
+		gatewayIP, err := s.getGatewayIP()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s of extra host %q: %v", hostGateway, host, err)
+		}
+		hosts = append(hosts, strings.TrimSuffix(host, hostGateway)+gatewayIP)
 	}
-
-	return services, nil
+	return hosts, nil
 }
 
-func (s *executor) waitForServices() {
-	waitForServicesTimeout := s.Config.Docker.WaitForServicesTimeout
-	if waitForServicesTimeout == 0 {
-		waitForServicesTimeout = common.DefaultWaitForServicesTimeout
+func (s *executor) getGatewayIP() (string, error) {
+	if s.gatewayIP != "" {
+		return s.gatewayIP, nil
 	}
 
-	// wait for all services to came up
-	if waitForServicesTimeout > 0 && len(s.services) > 0 {
-		s.Println("Waiting for services to be up and running...")
-		wg := sync.WaitGroup{}
-		for _, service := range s.services {
-			wg.Add(1)
-			go func(service *types.Container) {
-				s.waitForServiceContainer(service, time.Duration(waitForServicesTimeout)*time.Second)
-				wg.Done()
-			}(service)
-		}
-		wg.Wait()
+	bridge, err := s.client.NetworkInspect(context.TODO(), "bridge")
+	if err != nil {
+		return "", err
 	}
-}
 
-func (s *executor) buildServiceLinks(linksMap map[string]*types.Container) (links []string) {
-	for linkName, linkee := range linksMap {
-		newContainer, err := s.client.ContainerInspect(context.TODO(), linkee.ID)
-		if err != nil {
-			continue
-		}
-		if newContainer.State.Running {
-			links = append(links, linkee.ID+":"+linkName)
+	for _, config := range bridge.IPAM.Config {
+		if ip := net.ParseIP(config.Gateway); ip != nil && ip.To4() != nil {
+			s.gatewayIP = config.Gateway
+			return s.gatewayIP, nil
 		}
 	}
-	return
+	return "", errors.New("the bridge network doesn't have an IPv4 gateway")
 }
 
-func (s *executor) createFromServiceDescription(description string, linksMap map[string]*types.Container) (err error) {
-	var container *types.Container
-
-	service, version, imageName, linkNames := s.splitServiceAndVersion(description)
+func (s *executor) createService(definition dockerService, service, version, image string, aliases []string) (*types.Container, error) {
+	if len(service) == 0 {
+		return nil, errors.New("invalid service name")
+	}
 
-	for _, linkName := range linkNames {
-		if linksMap[linkName] != nil {
-			s.Warningln("Service", description, "is already created. Ignoring.")
-			continue
-		}
-
-		// Create service if not yet created
-		if container == nil {
-			container, err = s.createService(service, version, imageName)
-			if err != nil {
-				return
-			}
-			s.Debugln("Created service", description, "as", container.ID)
-			s.services = append(s.services, container)
-		}
-		linksMap[linkName] = container
-	}
-	return
-}
-
-func (s *executor) createServices() (err error) {
-	serviceNames, err := s.getServiceNames()
+	s.Println("Starting service", service+":"+version, "...")
+	serviceImage, err := s.getServiceImage(image)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	linksMap := make(map[string]*types.Container)
-
-	for _, serviceDescription := range serviceNames {
-		err = s.createFromServiceDescription(serviceDescription, linksMap)
-		if err != nil {
-			return
-		}
+	containerName := s.Build.ProjectUniqueName() + "-" + strings.Replace(service, "/", "__", -1)
+	if definition.NameSuffix != "" {
+		containerName += "-" + definition.NameSuffix
 	}
 
-	s.waitForServices()
-
-	s.links = s.buildServiceLinks(linksMap)
-	return
-}
+	config := &container.Config{
+		Image:      serviceImage.ID,
+		Hostname:   definition.Hostname,
+		Labels:     s.getLabels("service", "service="+service, "service.version="+version),
+		Env:        s.getServiceVariables(definition),
+		MacAddress: definition.MacAddress,
+		StopSignal: s.Config.Docker.StopSignal,
+	}
 
-func (s *executor) createContainer(containerType, imageName string, cmd []string) (*types.ContainerJSON, error) {
-	// Fetch image
-	image, err := s.getDockerImage(imageName)
+	memory, err := parseMemoryLimit("services_memory", s.Config.Docker.ServicesMemory)
 	if err != nil {
 		return nil, err
 	}
 
-	hostname := s.Config.Docker.Hostname
-	if hostname == "" {
-		hostname = s.Build.ProjectUniqueName()
+	restartPolicy, err := parseRestartPolicy(definition.Restart)
+	if err != nil {
+		return nil, &common.BuildError{Inner: err}
 	}
 
-	containerName := s.Build.ProjectUniqueName() + "-" + containerType
-	config := &container.Config{
-		Image:        image.ID,
-		Hostname:     hostname,
-		Cmd:          cmd,
-		Labels:       s.getLabels(containerType),
-		Tty:          false,
-		AttachStdin:  true,
-		AttachStdout: true,
-		AttachStderr: true,
-		OpenStdin:    true,
-		StdinOnce:    true,
-		Env:          append(s.Build.GetAllVariables().StringList(), s.BuildShell.Environment...),
+	extraHosts, err := s.getExtraHosts(s.getServiceExtraHosts())
+	if err != nil {
+		return nil, err
 	}
 
 	hostConfig := &container.HostConfig{
 		Resources: container.Resources{
-			CpusetCpus: s.Config.Docker.CPUSetCPUs,
-			Devices:    s.devices,
-		},
-		DNS:           s.Config.Docker.DNS,
-		DNSSearch:     s.Config.Docker.DNSSearch,
-		Privileged:    s.Config.Docker.Privileged,
-		CapAdd:        s.Config.Docker.CapAdd,
-		CapDrop:       s.Config.Docker.CapDrop,
-		SecurityOpt:   s.Config.Docker.SecurityOpt,
-		RestartPolicy: neverRestartPolicy,
-		ExtraHosts:    s.Config.Docker.ExtraHosts,
-		NetworkMode:   container.NetworkMode(s.Config.Docker.NetworkMode),
-		Links:         append(s.Config.Docker.Links, s.links...),
-		Binds:         s.binds,
-		VolumeDriver:  s.Config.Docker.VolumeDriver,
-		VolumesFrom:   append(s.Config.Docker.VolumesFrom, s.volumesFrom...),
-		LogConfig: container.LogConfig{
-			Type: "json-file",
+			CgroupParent:   s.Config.Docker.CgroupParent,
+			PidsLimit:      s.Config.Docker.ServicesPidsLimit,
+			Memory:         memory,
+			OomKillDisable: s.getOomKillDisable(memory),
 		},
+		OomScoreAdj:   s.Config.Docker.OomScoreAdj,
+		Isolation:     container.Isolation(s.Config.Docker.Isolation),
+		RestartPolicy: restartPolicy,
+		DNSOptions:    s.Config.Docker.DNSOptions,
+		Privileged:    s.isServicePrivileged(definition),
+		CapAdd:        append(append([]string{}, s.Config.Docker.ServicesCapAdd...), definition.CapAdd...),
+		CapDrop:       append(append([]string{}, s.Config.Docker.ServicesCapDrop...), definition.CapDrop...),
+		SecurityOpt:   s.getServiceSecurityOpt(definition),
+		ExtraHosts:    extraHosts,
+		NetworkMode:   s.getNetworkMode(),
+		LogConfig:     s.getLogConfig(),
+	}
+
+	err = s.setServiceVolumes(hostConfig, definition)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.addServiceConfigFiles(hostConfig, definition, containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	networkingConfig := s.getServiceNetworkingConfig(definition, aliases)
+	if s.Config.Docker.DryRun {
+		s.printDockerRun(containerName, image, config, hostConfig, networkingConfig)
+		return fakeContainer("", containerName), nil
 	}
 
 	// this will fail potentially some builds if there's name collision
-	s.removeContainer(containerName)
+	s.removeContainer(context.TODO(), containerName)
 
-	s.Debugln("Creating container", containerName, "...")
-	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, nil, containerName)
+	s.Debugln("Creating service container", containerName, "...")
+	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, networkingConfig, containerName)
 	if err != nil {
-		if resp.ID != "" {
-			s.failures = append(s.failures, resp.ID)
-		}
 		return nil, err
 	}
+	s.emitEvent(LifecycleEvent{Type: EventContainerCreated, Image: image, ContainerID: resp.ID, ContainerName: containerName, ContainerType: "service"})
 
-	inspect, err := s.client.ContainerInspect(context.TODO(), resp.ID)
+	s.Debugln("Starting service container", resp.ID, "...")
+	err = s.client.ContainerStart(context.TODO(), resp.ID, types.ContainerStartOptions{})
 	if err != nil {
 		s.failures = append(s.failures, resp.ID)
 		return nil, err
 	}
-	return &inspect, nil
+
+	return fakeContainer(resp.ID, containerName), nil
 }
 
-func (s *executor) killContainer(id string, waitCh chan error) (err error) {
-	for {
-		s.disconnectNetwork(id)
-		s.Debugln("Killing container", id, "...")
-		s.client.ContainerKill(context.TODO(), id, "SIGKILL")
+// listServices returns the services of the runner and of the build,
+// without verifying them
+func (s *executor) listServices() (services []dockerService) {
+	for _, service := range s.Config.Docker.Services {
+		services = append(services, dockerService{Name: service})
+	}
 
-		// Wait for signal that container were killed
-		// or retry after some time
-		select {
-		case err = <-waitCh:
-			return
+	for _, service := range s.options.Services {
+		service.Name = s.Build.GetAllVariables().ExpandValue(service.Name)
+		services = append(services, service)
+	}
+	return
+}
 
-		case <-time.After(time.Second):
+func (s *executor) getServices() ([]dockerService, error) {
+	services := s.listServices()
+
+	// only the services of the build need to be allowed
+	for _, service := range services[len(s.Config.Docker.Services):] {
+		err := s.verifyAllowedImage(service.Name, "services", s.Config.Docker.AllowedServices, s.Config.Docker.DeniedServices, s.Config.Docker.Services)
+		if err != nil {
+			return nil, err
+		}
+
+		err = service.validate()
+		if err != nil {
+			return nil, &common.BuildError{Inner: err}
 		}
 	}
-}
 
-func (s *executor) waitForContainer(id string) error {
-	s.Debugln("Waiting for container", id, "...")
+	err := s.verifyServiceIPAddresses(services)
+	if err != nil {
+		return nil, &common.BuildError{Inner: err}
+	}
 
-	retries := 0
+	for _, service := range services {
+		if service.Privileged != nil && *service.Privileged && !s.Config.Docker.Privileged {
+			return nil, &common.BuildError{Inner: fmt.Errorf("service %s: privileged mode is not enabled for the runner", service.Name)}
+		}
 
-	// Use active wait
-	for {
-		container, err := s.client.ContainerInspect(context.TODO(), id)
+		err = s.verifyServiceCapabilities(service)
 		if err != nil {
-			if docker_helpers.IsErrNotFound(err) {
-				return err
-			}
+			return nil, &common.BuildError{Inner: err}
+		}
 
-			if retries > 3 {
-				return err
-			}
+		err = s.verifyServiceSecurityOpt(service)
+		if err != nil {
+			return nil, &common.BuildError{Inner: err}
+		}
+	}
 
-			retries++
-			time.Sleep(time.Second)
+	return services, nil
+}
+
+// verifyServiceIPAddresses checks that the static addresses of the services
+// belong to the subnets of the per-build network and are not used twice
+func (s *executor) verifyServiceIPAddresses(services []dockerService) error {
+	usedBy := make(map[string]string)
+
+	for _, service := range services {
+		if service.IPAddress == "" {
 			continue
 		}
+		if !s.Config.Docker.NetworkPerBuild {
+			return fmt.Errorf("service %s: ip address can be used only with network_per_build", service.Name)
+		}
 
-		// Reset retry timer
-		retries = 0
+		ip := net.ParseIP(service.IPAddress)
+		optionName, subnet := "ipv6_subnet", s.Config.Docker.IPv6Subnet
+		if ip.To4() != nil {
+			optionName, subnet = "ipv4_subnet", s.Config.Docker.IPv4Subnet
+		}
+		if subnet == "" {
+			return fmt.Errorf("service %s: ip address %s requires %s to be configured", service.Name, service.IPAddress, optionName)
+		}
 
-		if container.State.Running {
-			time.Sleep(time.Second)
-			continue
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		if !ipNet.Contains(ip) {
+			return fmt.Errorf("service %s: ip address %s is not a part of the %s subnet", service.Name, service.IPAddress, subnet)
 		}
 
-		if container.State.ExitCode != 0 {
-			return &common.BuildError{
-				Inner: fmt.Errorf("exit code %d", container.State.ExitCode),
-			}
+		if other, ok := usedBy[ip.String()]; ok {
+			return fmt.Errorf("service %s: ip address %s is already used by service %s", service.Name, service.IPAddress, other)
 		}
+		usedBy[ip.String()] = service.Name
+	}
+	return nil
+}
 
-		return nil
+// normalizeCapability allows the capabilities to be named with or without
+// the CAP_ prefix and in any case, like Docker does
+func normalizeCapability(capability string) string {
+	capability = strings.ToUpper(capability)
+	return strings.TrimPrefix(capability, "CAP_")
+}
+
+// verifyServiceCapabilities checks that the capabilities added by the service
+// are allowed by allowed_services_cap_add. Those which the runner adds to all
+// services don't need to be allowed explicitly.
+func (s *executor) verifyServiceCapabilities(service dockerService) error {
+	allowed := make(map[string]bool)
+	for _, capability := range s.Config.Docker.AllowedServicesCapAdd {
+		allowed[normalizeCapability(capability)] = true
+	}
+	for _, capability := range s.Config.Docker.ServicesCapAdd {
+		allowed[normalizeCapability(capability)] = true
 	}
+
+	for _, capability := range service.CapAdd {
+		if !allowed[normalizeCapability(capability)] {
+			return fmt.Errorf("service %s: capability %s is not present on list of allowed_services_cap_add", service.Name, capability)
+		}
+	}
+	return nil
 }
 
-func (s *executor) watchContainer(id string, input io.Reader, abort chan interface{}) (err error) {
-	options := types.ContainerAttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
+// verifyServiceSecurityOpt checks that the security options of the service
+// are allowed by allowed_services_security_opt or used for all services
+func (s *executor) verifyServiceSecurityOpt(service dockerService) error {
+	allowed := make(map[string]bool)
+	for _, option := range s.Config.Docker.AllowedServicesSecurityOpt {
+		allowed[option] = true
+	}
+	for _, option := range s.Config.Docker.ServicesSecurityOpt {
+		allowed[option] = true
 	}
 
-	s.Debugln("Attaching to container", id, "...")
-	hijacked, err := s.client.ContainerAttach(context.TODO(), id, options)
-	if err != nil {
-		return
+	for _, option := range service.SecurityOpt {
+		if !allowed[option] {
+			return fmt.Errorf("service %s: security option %s is not present on list of allowed_services_security_opt", service.Name, option)
+		}
 	}
-	defer hijacked.Close()
+	return nil
+}
 
-	s.Debugln("Starting container", id, "...")
-	err = s.client.ContainerStart(context.TODO(), id, types.ContainerStartOptions{})
-	if err != nil {
-		return
+func (s *executor) getServiceSecurityOpt(definition dockerService) []string {
+	if definition.SecurityOpt != nil {
+		return definition.SecurityOpt
 	}
+	return s.Config.Docker.ServicesSecurityOpt
+}
 
-	s.Debugln("Waiting for attach to finish", id, "...")
-	attachCh := make(chan error, 2)
+// setServiceVolumes shares the build volume with the service, or only the
+// build volumes and host volumes selected by the service definition
+func (s *executor) setServiceVolumes(hostConfig *container.HostConfig, definition dockerService) error {
+	if definition.Volumes == nil {
+		hostConfig.Binds = s.binds
+		hostConfig.VolumesFrom = s.volumesFrom
+		hostConfig.Mounts = s.mounts
+		return nil
+	}
 
-	// Copy any output to the build trace
-	go func() {
-		_, err := stdcopy.StdCopy(s.BuildTrace, s.BuildTrace, hijacked.Reader)
-		if err != nil {
-			attachCh <- err
+	// the user-defined volumes are created after the services,
+	// so the host volumes are taken directly from the configuration
+	var hostBinds []string
+	for _, volume := range s.Config.Docker.Volumes {
+		hostPath, containerPath, options, err := parseVolume(volume)
+		if err == nil && hostPath != "" {
+			hostPath, err = s.getAbsoluteHostPath(hostPath)
+			if err != nil {
+				return err
+			}
+			hostBinds = append(hostBinds, s.getHostVolumeBind(hostPath, containerPath, options))
 		}
-	}()
+	}
 
-	// Write the input to the container and close its STDIN to get it to finish
-	go func() {
-		_, err := io.Copy(hijacked.Conn, input)
-		hijacked.CloseWrite()
-		if err != nil {
-			attachCh <- err
-		}
-	}()
+	for _, volume := range definition.Volumes {
+		containerPath := s.getAbsoluteContainerPath(volume)
+		found := false
 
-	waitCh := make(chan error, 1)
-	go func() {
-		waitCh <- s.waitForContainer(id)
-	}()
+		for _, bind := range append(append([]string{}, s.binds...), hostBinds...) {
+			_, bindPath, _, err := parseVolume(bind)
+			if err == nil && path.Clean(bindPath) == path.Clean(containerPath) && !found {
+				hostConfig.Binds = append(hostConfig.Binds, bind)
+				found = true
+			}
+		}
 
-	select {
-	case <-abort:
-		s.killContainer(id, waitCh)
-		err = errors.New("Aborted")
+		for _, volumesFrom := range s.volumesFrom {
+			if path.Clean(s.volumePaths[volumesFrom]) == path.Clean(containerPath) && !found {
+				hostConfig.VolumesFrom = append(hostConfig.VolumesFrom, volumesFrom)
+				found = true
+			}
+		}
 
-	case err = <-attachCh:
-		s.killContainer(id, waitCh)
-		s.Debugln("Container", id, "finished with", err)
+		for _, volumeMount := range s.mounts {
+			if path.Clean(volumeMount.Target) == path.Clean(containerPath) && !found {
+				hostConfig.Mounts = append(hostConfig.Mounts, volumeMount)
+				found = true
+			}
+		}
 
-	case err = <-waitCh:
-		s.Debugln("Container", id, "finished with", err)
+		if !found {
+			return &common.BuildError{Inner: fmt.Errorf("service %s: volume %s is not a build volume or a host volume of the runner", definition.Name, containerPath)}
+		}
 	}
-	return
+	return nil
 }
 
-func (s *executor) removeContainer(id string) error {
-	s.disconnectNetwork(id)
-	options := types.ContainerRemoveOptions{
-		RemoveVolumes: true,
-		Force:         true,
+// isLocalDockerDaemon tells whether the Docker daemon shares the
+// filesystem of the runner, so the runner's files can be bind-mounted
+func (s *executor) isLocalDockerDaemon() bool {
+	host := s.Config.Docker.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		return true
+	}
+
+	daemonURL, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	if daemonURL.Scheme == "unix" || daemonURL.Scheme == "npipe" {
+		return true
+	}
+
+	switch daemonURL.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	default:
+		return false
 	}
-	err := s.client.ContainerRemove(context.TODO(), id, options)
-	s.Debugln("Removed container", id, "with", err)
-	return err
 }
 
-func (s *executor) disconnectNetwork(id string) error {
-	netList, err := s.client.NetworkList(context.TODO(), types.NetworkListOptions{})
+// addServiceConfigFiles writes the config files of the service to a private
+// host directory, removed in Cleanup, and mounts them read-only into the service
+func (s *executor) addServiceConfigFiles(hostConfig *container.HostConfig, definition dockerService, containerName string) error {
+	if len(definition.ConfigFiles) == 0 {
+		return nil
+	}
+
+	if !s.isLocalDockerDaemon() {
+		return &common.BuildError{Inner: fmt.Errorf("service %s: config_files require the Docker daemon to run on the runner host, "+
+			"the files can't be mounted from the runner into containers of a remote daemon", definition.Name)}
+	}
+
+	if s.serviceFilesDir == "" {
+		serviceFilesDir, err := ioutil.TempDir(s.Config.Docker.ScriptsDir, "gitlab-runner-service-files")
+		if err != nil {
+			return err
+		}
+		s.serviceFilesDir = serviceFilesDir
+	}
+
+	serviceDir, err := ioutil.TempDir(s.serviceFilesDir, containerName)
 	if err != nil {
-		s.Debugln("Can't get network list. ListNetworks exited with", err)
 		return err
 	}
 
-	for _, network := range netList {
-		for _, pluggedContainer := range network.Containers {
-			if id == pluggedContainer.Name {
-				err = s.client.NetworkDisconnect(context.TODO(), network.ID, id, true)
-				if err != nil {
-					s.Warningln("Can't disconnect possibly zombie container", pluggedContainer.Name, "from network", network.Name, "->", err)
-				} else {
-					s.Warningln("Possibly zombie container", pluggedContainer.Name, "is disconnected from network", network.Name)
-				}
-				break
-			}
+	containerPaths := make([]string, 0, len(definition.ConfigFiles))
+	for containerPath := range definition.ConfigFiles {
+		containerPaths = append(containerPaths, containerPath)
+	}
+	sort.Strings(containerPaths)
+
+	// the binds of the service may be shared with the build
+	binds := append([]string{}, hostConfig.Binds...)
+	variables := s.Build.GetAllVariables()
+	for i, containerPath := range containerPaths {
+		// the index keeps the files with the same name apart
+		hostPath := filepath.Join(serviceDir, fmt.Sprintf("%d-%s", i, path.Base(containerPath)))
+		content := variables.ExpandValue(definition.ConfigFiles[containerPath])
+		// readable by the non-root users of the services, the directory
+		// itself is still accessible only by the runner user
+		err = ioutil.WriteFile(hostPath, []byte(content), 0644)
+		if err != nil {
+			return err
 		}
+		binds = append(binds, filepath.ToSlash(hostPath)+":"+containerPath+":ro")
 	}
-	return err
+	hostConfig.Binds = binds
+	return nil
 }
 
-func (s *executor) verifyAllowedImage(image, optionName string, allowedImages []string, internalImages []string) error {
-	for _, allowedImage := range allowedImages {
-		ok, _ := filepath.Match(allowedImage, image)
-		if ok {
-			return nil
-		}
+func (s *executor) isServicePrivileged(definition dockerService) bool {
+	if definition.Privileged != nil {
+		return *definition.Privileged && s.Config.Docker.Privileged
 	}
+	return s.Config.Docker.Privileged
+}
 
-	for _, internalImage := range internalImages {
-		if internalImage == image {
+// getServiceNetworkingConfig connects the service to the user-defined network
+// under its aliases, and assigns its static address on the per-build network
+func (s *executor) getServiceNetworkingConfig(definition dockerService, aliases []string) *network.NetworkingConfig {
+	if s.networkMode == "" {
+		return nil
+	}
+
+	endpoint := &network.EndpointSettings{Aliases: aliases}
+	if definition.IPAddress != "" {
+		endpoint.IPAMConfig = &network.EndpointIPAMConfig{}
+		if net.ParseIP(definition.IPAddress).To4() != nil {
+			endpoint.IPAMConfig.IPv4Address = definition.IPAddress
+		} else {
+			endpoint.IPAMConfig.IPv6Address = definition.IPAddress
+		}
+	}
+
+	return &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			s.networkMode: endpoint,
+		},
+	}
+}
+
+// getServiceWaitTimeout returns the readiness timeout of the service in
+// seconds, a non-positive value means that the service is not waited for
+func (s *executor) getServiceWaitTimeout(definition dockerService) int {
+	if definition.NoReadinessCheck {
+		return 0
+	}
+
+	if definition.ReadinessTimeout > 0 {
+		return definition.ReadinessTimeout
+	}
+
+	waitForServicesTimeout := s.Config.Docker.WaitForServicesTimeout
+	if waitForServicesTimeout == 0 {
+		waitForServicesTimeout = common.DefaultWaitForServicesTimeout
+	}
+	return waitForServicesTimeout
+}
+
+// getServiceRetryInterval returns the delay between the checks of the service readiness
+func (s *executor) getServiceRetryInterval() time.Duration {
+	if s.Config.Docker.WaitForServicesInterval > 0 {
+		return time.Duration(s.Config.Docker.WaitForServicesInterval) * time.Second
+	}
+	return serviceDialInterval
+}
+
+func (s *executor) waitForServices() error {
+	waiting := false
+	wg := sync.WaitGroup{}
+	failed := make(chan string, len(s.services))
+
+	// wait for all services to came up, each one within its own timeout
+	for _, service := range s.services {
+		timeout := s.getServiceWaitTimeout(s.serviceDefinitions[service.ID])
+		if timeout <= 0 {
+			s.Debugln("Skipping readiness check of", service.Names[0], "...")
+			continue
+		}
+
+		if !waiting {
+			s.Println("Waiting for services to be up and running...")
+			waiting = true
+		}
+
+		wg.Add(1)
+		go func(service *types.Container, timeout time.Duration) {
+			started := time.Now()
+			err := s.waitForServiceContainer(service, timeout)
+			s.emitEvent(LifecycleEvent{
+				Type:          EventServiceReady,
+				ContainerID:   service.ID,
+				ContainerName: service.Names[0],
+				ContainerType: "service",
+				Duration:      time.Since(started).Seconds(),
+				Error:         getEventError(err),
+			})
+			if err != nil {
+				failed <- service.Names[0]
+			}
+			wg.Done()
+		}(service, time.Duration(timeout)*time.Second)
+	}
+	wg.Wait()
+	close(failed)
+
+	if !s.Config.Docker.ServicesMustStart {
+		return nil
+	}
+
+	var failedServices []string
+	for name := range failed {
+		failedServices = append(failedServices, name)
+	}
+	if len(failedServices) == 0 {
+		return nil
+	}
+
+	sort.Strings(failedServices)
+	return &common.BuildError{
+		Inner: fmt.Errorf("services didn't start properly: %s", strings.Join(failedServices, ", ")),
+	}
+}
+
+func (s *executor) buildServiceLinks(linksMap map[string]*types.Container) (links []string) {
+	for linkName, linkee := range linksMap {
+		newContainer, err := s.client.ContainerInspect(context.TODO(), linkee.ID)
+		if err != nil {
+			continue
+		}
+		if newContainer.State.Running {
+			links = append(links, linkee.ID+":"+linkName)
+		}
+	}
+	return
+}
+
+func (s *executor) createFromServiceDescription(definition dockerService, linksMap map[string]*types.Container) (err error) {
+	var container *types.Container
+
+	description := definition.Name
+	service, version, imageName, linkNames := s.splitServiceAndVersion(description)
+	linkNames = append(linkNames, definition.getExtraLinkNames(linkNames)...)
+
+	var aliases []string
+	for _, linkName := range linkNames {
+		if linksMap[linkName] != nil {
+			s.Warningln("Service", description, "is already created. Ignoring.")
+			continue
+		}
+		aliases = append(aliases, linkName)
+	}
+	if len(aliases) == 0 {
+		return
+	}
+
+	container, err = s.createService(definition, service, version, imageName, aliases)
+	if err != nil {
+		return
+	}
+
+	// the service was only printed with dry_run, it's linked by its name
+	if container.ID == "" {
+		for _, alias := range aliases {
+			if s.networkMode == "" {
+				s.links = append(s.links, container.Names[0]+":"+alias)
+			}
+		}
+		return
+	}
+
+	s.Debugln("Created service", description, "as", container.ID)
+	s.services = append(s.services, container)
+
+	if s.serviceDefinitions == nil {
+		s.serviceDefinitions = make(map[string]dockerService)
+	}
+	s.serviceDefinitions[container.ID] = definition
+
+	for _, alias := range aliases {
+		linksMap[alias] = container
+	}
+	return
+}
+
+func (s *executor) createServices() (err error) {
+	services, err := s.getServices()
+	if err != nil {
+		return
+	}
+
+	linksMap := make(map[string]*types.Container)
+
+	for _, service := range services {
+		err = s.createFromServiceDescription(service, linksMap)
+		if err != nil {
+			return
+		}
+	}
+
+	err = s.waitForServices()
+	if err != nil {
+		return
+	}
+
+	// on user-defined networks the services are reachable by their aliases
+	if s.networkMode == "" && !s.Config.Docker.DryRun {
+		s.links = s.buildServiceLinks(linksMap)
+	}
+	s.warnAboutDeprecatedLinks()
+	return
+}
+
+// warnAboutDeprecatedLinks explains that services rely on container links,
+// which newer Docker daemons consider a legacy feature
+func (s *executor) warnAboutDeprecatedLinks() {
+	if len(s.links) == 0 && len(s.Config.Docker.Links) == 0 {
+		return
+	}
+	if s.Config.Docker.DisableLinksDeprecationWarning || s.version.APIVersion == "" {
+		return
+	}
+	if versions.LessThan(s.version.APIVersion, linksDeprecatedAPIVersion) {
+		return
+	}
+
+	s.Warningln("Services are connected to the build container with container links,",
+		"which are a legacy feature since Docker API", linksDeprecatedAPIVersion,
+		"(the daemon uses API "+s.version.APIVersion+") and may be removed in future Docker releases.",
+		"Set disable_links_deprecation_warning in the [runners.docker] section to hide this warning.")
+}
+
+// getWorkingDir returns the configured working directory of the build container.
+// Writes outside of the build and user-defined volumes are lost with the container.
+func (s *executor) getWorkingDir() string {
+	workingDir := s.Config.Docker.WorkingDir
+	if workingDir == "" {
+		return ""
+	}
+
+	if !s.isMountedPath(workingDir) {
+		s.Warningln("The working_dir", workingDir, "is not in any of the mounted volumes,",
+			"files written there are lost when the build container is removed")
+	}
+	return workingDir
+}
+
+// isMountedPath checks if the dir is stored in the build volume or in one of
+// the user-defined volumes
+func (s *executor) isMountedPath(dir string) bool {
+	volumes := []string{path.Dir(s.Build.FullProjectDir())}
+	for _, volume := range s.Config.Docker.Volumes {
+		_, containerPath, _, err := parseVolume(volume)
+		if err == nil {
+			volumes = append(volumes, s.getAbsoluteContainerPath(containerPath))
+		}
+	}
+
+	dir = path.Clean(dir)
+	for _, volume := range volumes {
+		volume = path.Clean(volume)
+		if dir == volume || strings.HasPrefix(dir, strings.TrimSuffix(volume, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// getEntrypoint returns the entrypoint of the build container requested by
+// the job, or the one configured for the runner. The command running the
+// build script is passed to the entrypoint as its arguments.
+func (s *executor) getEntrypoint() []string {
+	if s.options.Entrypoint != nil {
+		return s.options.Entrypoint
+	}
+	return s.Config.Docker.Entrypoint
+}
+
+func (s *executor) createContainer(containerType, imageName string, cmd []string) (*types.ContainerJSON, error) {
+	// Fetch image
+	image, err := s.getDockerImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the predefined container uses the runner's own helper image
+	if containerType == "build" {
+		err = s.validateImage(imageName, image)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostname := s.Config.Docker.Hostname
+	if hostname == "" {
+		hostname = s.Build.ProjectUniqueName()
+	}
+
+	if containerType == "build" {
+		s.setBuildVariable("CI_BUILD_CONTAINER_HOSTNAME", hostname)
+	}
+
+	containerName := s.Build.ProjectUniqueName() + "-" + containerType
+	config := &container.Config{
+		Image:        image.ID,
+		Hostname:     hostname,
+		Cmd:          cmd,
+		Labels:       s.getLabels(containerType),
+		Tty:          false,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		Env:          append(s.Build.GetAllVariables().StringList(), s.BuildShell.Environment...),
+		StopSignal:   s.Config.Docker.StopSignal,
+	}
+
+	// helper commands of the predefined container still run as root
+	if containerType == "build" {
+		config.User = s.Config.Docker.User
+		config.MacAddress = s.Config.Docker.MacAddress
+		config.Entrypoint = s.getEntrypoint()
+		config.WorkingDir = s.getWorkingDir()
+	}
+
+	// the script is read from the mounted file, nothing is written to the standard input
+	if containerType == "build" && s.isBuildStdinDisabled() {
+		config.AttachStdin = false
+		config.OpenStdin = false
+		config.StdinOnce = false
+	}
+
+	if containerType == "predefined" && s.buildVolumeDir != "" {
+		config.Volumes = map[string]struct{}{
+			s.buildVolumeDir: {},
+		}
+	}
+
+	binds := s.binds
+	if containerType == "build" && len(s.buildBinds) > 0 {
+		binds = append(append([]string{}, s.binds...), s.buildBinds...)
+	}
+
+	memory, err := parseMemoryLimit("memory", s.Config.Docker.Memory)
+	if err != nil {
+		return nil, err
+	}
+
+	extraHosts, err := s.getExtraHosts(s.Config.Docker.ExtraHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	hostConfig := &container.HostConfig{
+		Resources: container.Resources{
+			CpusetCpus:     s.Config.Docker.CPUSetCPUs,
+			Devices:        s.devices,
+			CgroupParent:   s.Config.Docker.CgroupParent,
+			PidsLimit:      s.Config.Docker.PidsLimit,
+			Memory:         memory,
+			OomKillDisable: s.getOomKillDisable(memory),
+		},
+		OomScoreAdj:   s.Config.Docker.OomScoreAdj,
+		Isolation:     container.Isolation(s.Config.Docker.Isolation),
+		DNS:           s.Config.Docker.DNS,
+		DNSSearch:     s.Config.Docker.DNSSearch,
+		DNSOptions:    s.Config.Docker.DNSOptions,
+		Privileged:    s.Config.Docker.Privileged,
+		CapAdd:        s.Config.Docker.CapAdd,
+		CapDrop:       s.Config.Docker.CapDrop,
+		SecurityOpt:   s.Config.Docker.SecurityOpt,
+		RestartPolicy: neverRestartPolicy,
+		ExtraHosts:    extraHosts,
+		NetworkMode:   s.getNetworkMode(),
+		Links:         append(s.Config.Docker.Links, s.links...),
+		Binds:         binds,
+		VolumeDriver:  s.Config.Docker.VolumeDriver,
+		VolumesFrom:   append(s.Config.Docker.VolumesFrom, s.volumesFrom...),
+		Mounts:        s.mounts,
+		Runtime:       s.Config.Docker.Runtime,
+		LogConfig:     s.getLogConfig(),
+	}
+
+	if s.Config.Docker.DryRun {
+		s.printDockerRun(containerName, imageName, config, hostConfig, nil)
+		if containerType == "build" {
+			return nil, &common.BuildError{Inner: errDryRun}
+		}
+		return &types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{Name: containerName}}, nil
+	}
+
+	// this will fail potentially some builds if there's name collision
+	s.removeContainer(context.TODO(), containerName)
+
+	s.Debugln("Creating container", containerName, "...")
+	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, nil, containerName)
+	if err != nil {
+		if resp.ID != "" {
+			s.failures = append(s.failures, resp.ID)
+		}
+		return nil, err
+	}
+
+	s.emitEvent(LifecycleEvent{Type: EventContainerCreated, Image: imageName, ContainerID: resp.ID, ContainerName: containerName, ContainerType: containerType})
+
+	if containerType == "predefined" && s.buildVolumeDir != "" {
+		s.addVolumesFrom(resp.ID, s.buildVolumeDir)
+	}
+	if containerType == "build" {
+		s.buildContainerID = resp.ID
+	}
+	s.buildContainers = append(s.buildContainers, fakeContainer(resp.ID, containerName))
+
+	inspect, err := s.inspectCreatedContainer(resp.ID)
+	if err != nil {
+		s.failures = append(s.failures, resp.ID)
+		return nil, err
+	}
+	return &inspect, nil
+}
+
+// inspectCreatedContainer retries the inspect of a just created container,
+// as heavily loaded daemons sometimes fail to answer it
+func (s *executor) inspectCreatedContainer(id string) (types.ContainerJSON, error) {
+	retries := s.Config.Docker.ContainerInspectRetries
+	if retries <= 0 {
+		retries = defaultContainerInspectRetries
+	}
+
+	for attempt := 1; ; attempt++ {
+		inspect, err := s.client.ContainerInspect(context.TODO(), id)
+		if err == nil || docker_helpers.IsErrNotFound(err) || attempt > retries {
+			return inspect, err
+		}
+
+		s.Debugln("Failed to inspect container", id, "with", err, "retrying...")
+		time.Sleep(containerInspectRetryInterval)
+	}
+}
+
+// usesGracefulStop checks if the containers are first stopped with their stop
+// signal (the configured one, or the STOPSIGNAL of the image) before being killed
+func (s *executor) usesGracefulStop() bool {
+	return s.Config.Docker.StopSignal != "" || s.Config.Docker.ShutdownGracePeriod > 0
+}
+
+func (s *executor) getShutdownGracePeriod() time.Duration {
+	gracePeriod := time.Duration(s.Config.Docker.ShutdownGracePeriod) * time.Second
+	if gracePeriod <= 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	return gracePeriod
+}
+
+func (s *executor) killContainer(id string, waitCh chan error) (err error) {
+	if s.usesGracefulStop() {
+		gracePeriod := s.getShutdownGracePeriod()
+		s.Debugln("Stopping container", id, "...")
+		stopErr := s.client.ContainerStop(context.TODO(), id, &gracePeriod)
+		if stopErr != nil {
+			s.Debugln("Failed to stop container", id, "with", stopErr)
+		}
+
+		select {
+		case err = <-waitCh:
+			return
+
+		case <-time.After(time.Second):
+		}
+	}
+
+	for {
+		s.disconnectNetwork(context.TODO(), id)
+		s.Debugln("Killing container", id, "...")
+		s.client.ContainerKill(context.TODO(), id, "SIGKILL")
+
+		// Wait for signal that container were killed
+		// or retry after some time
+		select {
+		case err = <-waitCh:
+			return
+
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+type containerExitError struct {
+	ExitCode int
+}
+
+func (e *containerExitError) Error() string {
+	return fmt.Sprintf("exit code %d", e.ExitCode)
+}
+
+func getContainerExitCode(err error) (int, bool) {
+	if buildErr, ok := err.(*common.BuildError); ok {
+		if exitErr, ok := buildErr.Inner.(*containerExitError); ok {
+			return exitErr.ExitCode, true
+		}
+	}
+	return 0, false
+}
+
+func sleepWithContext(ctx context.Context, duration time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(duration):
+		return nil
+	}
+}
+
+func (s *executor) waitForContainer(ctx context.Context, id string) error {
+	s.Debugln("Waiting for container", id, "...")
+
+	retries := 0
+
+	// Use active wait
+	for {
+		container, err := s.client.ContainerInspect(ctx, id)
+		if err != nil {
+			if docker_helpers.IsErrNotFound(err) {
+				return err
+			}
+
+			if retries > 3 || ctx.Err() != nil {
+				return err
+			}
+
+			retries++
+			if err := sleepWithContext(ctx, time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Reset retry timer
+		retries = 0
+
+		if container.State.Running {
+			if err := sleepWithContext(ctx, time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if container.State.ExitCode != 0 {
+			return &common.BuildError{
+				Inner: &containerExitError{ExitCode: container.State.ExitCode},
+			}
+		}
+
+		return nil
+	}
+}
+
+func (s *executor) watchContainer(id string, input io.Reader, abort chan interface{}) (err error) {
+	return s.watchContainerOutput(id, input, s.BuildTrace, abort)
+}
+
+// isBuildStdinDisabled checks if the build container is created without the
+// standard input, the build script is then passed only through the script file
+func (s *executor) isBuildStdinDisabled() bool {
+	return s.supportsScriptFiles && s.Config.Docker.DisableStdin
+}
+
+// watchContainerOutput attaches to the container, writes the input to its
+// standard input and copies its output. With a nil input the standard input
+// is not attached at all.
+func (s *executor) watchContainerOutput(id string, input io.Reader, output io.Writer, abort chan interface{}) (err error) {
+	options := types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  input != nil,
+		Stdout: true,
+		Stderr: true,
+	}
+
+	s.Debugln("Attaching to container", id, "...")
+	hijacked, err := s.client.ContainerAttach(context.TODO(), id, options)
+	if err != nil {
+		return
+	}
+	defer hijacked.Close()
+
+	s.Debugln("Starting container", id, "...")
+	err = s.client.ContainerStart(context.TODO(), id, types.ContainerStartOptions{})
+	if err != nil {
+		return
+	}
+
+	if id == s.buildContainerID {
+		inspect, err := s.client.ContainerInspect(context.TODO(), id)
+		if err == nil {
+			s.exposeBuildContainerAddress(inspect)
+		}
+	}
+
+	s.Debugln("Waiting for attach to finish", id, "...")
+	attachCh := make(chan error, 2)
+
+	// Copy any output to the build trace
+	go func() {
+		_, err := stdcopy.StdCopy(output, output, hijacked.Reader)
+		if err != nil {
+			attachCh <- err
+		}
+	}()
+
+	// Write the input to the container and close its STDIN to get it to finish
+	if input != nil {
+		go func() {
+			_, err := io.Copy(hijacked.Conn, input)
+			hijacked.CloseWrite()
+			if err != nil {
+				attachCh <- err
+			}
+		}()
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- s.waitForContainer(context.TODO(), id)
+	}()
+
+	select {
+	case <-abort:
+		if s.Build.CurrentStage == common.BuildRunRuntimeTerminated {
+			s.shutdownContainers()
+		}
+		if !s.detached {
+			s.killContainer(id, waitCh)
+		}
+		err = errors.New("Aborted")
+
+	case err = <-attachCh:
+		s.killContainer(id, waitCh)
+		s.Debugln("Container", id, "finished with", err)
+
+	case err = <-waitCh:
+		s.Debugln("Container", id, "finished with", err)
+	}
+	return
+}
+
+// shutdownContainers applies the shutdown policy to the running containers
+// of the build, when it's aborted because the runner is shutting down
+func (s *executor) shutdownContainers() {
+	policy, _ := s.Config.Docker.ShutdownPolicy.Get()
+	if policy == common.ShutdownPolicyDetach {
+		s.Warningln("Runner is shutting down, leaving the build containers running")
+		s.detached = true
+		return
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", dockerLabelPrefix+".build.id="+strconv.Itoa(s.Build.ID))
+	args.Add("label", dockerLabelPrefix+".runner.id="+s.Build.Runner.ShortDescription())
+	containers, err := s.client.ContainerList(context.TODO(), types.ContainerListOptions{Filters: args})
+	if err != nil {
+		s.Warningln("Failed to list the build containers:", err)
+		return
+	}
+
+	gracePeriod := s.getShutdownGracePeriod()
+	for _, container := range containers {
+		if policy == common.ShutdownPolicyStop {
+			s.Debugln("Stopping container", container.ID, "...")
+			err = s.client.ContainerStop(context.TODO(), container.ID, &gracePeriod)
+		} else {
+			s.Debugln("Killing container", container.ID, "...")
+			err = s.client.ContainerKill(context.TODO(), container.ID, "SIGKILL")
+		}
+		if err != nil {
+			s.Debugln("Failed to shutdown container", container.ID, "with", err)
+		}
+	}
+}
+
+func (s *executor) removeContainer(ctx context.Context, id string) error {
+	s.disconnectNetwork(ctx, id)
+	options := types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	}
+
+	interval := containerRemoveRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := s.client.ContainerRemove(ctx, id, options)
+		s.Debugln("Removed container", id, "with", err)
+		if err == nil || !isTransientRemoveError(err) || attempt > containerRemoveRetries {
+			return err
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// isTransientRemoveError checks for conflicts which usually go away
+// after a moment, like a removal still being done by the daemon
+func isTransientRemoveError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "already in progress") ||
+		strings.Contains(message, "device or resource busy")
+}
+
+func (s *executor) getCleanupConcurrency() int {
+	if s.Config.Docker != nil && s.Config.Docker.CleanupConcurrency > 0 {
+		return s.Config.Docker.CleanupConcurrency
+	}
+	return defaultCleanupConcurrency
+}
+
+// removeContainers removes the containers by a limited number of workers,
+// so many builds finishing at once don't flood the daemon with requests
+func (s *executor) removeContainers(ids []string) (errs []error) {
+	queue := make(chan string)
+	results := make(chan error, len(ids))
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.getCleanupConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range queue {
+				if err := s.removeContainer(context.TODO(), id); err != nil {
+					results <- fmt.Errorf("%s: %v", id, err)
+				}
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		queue <- id
+	}
+	close(queue)
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		errs = append(errs, err)
+	}
+	return
+}
+
+func (s *executor) getNetworkMode() container.NetworkMode {
+	if s.networkMode != "" {
+		return container.NetworkMode(s.networkMode)
+	}
+	return container.NetworkMode(s.Config.Docker.NetworkMode)
+}
+
+// isUserDefinedNetwork checks whether network_mode names a network,
+// rather than one of the network stacks built into Docker
+func isUserDefinedNetwork(networkMode string) bool {
+	switch networkMode {
+	case "", "default", "bridge", "host", "none", "nat":
+		return false
+	}
+	return !strings.HasPrefix(networkMode, "container:")
+}
+
+// useExternalNetwork verifies that the network named by network_mode exists,
+// the build and service containers are then connected to it
+func (s *executor) useExternalNetwork() error {
+	networkName := s.Config.Docker.NetworkMode
+
+	s.Debugln("Looking for network", networkName, "...")
+	_, err := s.client.NetworkInspect(context.TODO(), networkName)
+	if err != nil {
+		return fmt.Errorf("The %q network of network_mode can't be used, it has to be created before the build: %v", networkName, err)
+	}
+
+	s.networkMode = networkName
+	return nil
+}
+
+// createNetwork creates the user-defined network of the build when
+// network_per_build is used, the external network isn't ever created
+func (s *executor) createNetwork() error {
+	if isUserDefinedNetwork(s.Config.Docker.NetworkMode) {
+		return s.useExternalNetwork()
+	}
+	if !s.Config.Docker.NetworkPerBuild {
+		return nil
+	}
+
+	networkName := s.Build.ProjectUniqueName() + "-network"
+
+	// this will fail potentially some builds if there's name collision
+	s.client.NetworkRemove(context.TODO(), networkName)
+
+	options := types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		EnableIPv6:     s.Config.Docker.EnableIPv6,
+		Labels:         s.getLabels("network"),
+	}
+	for _, subnet := range []string{s.Config.Docker.IPv4Subnet, s.Config.Docker.IPv6Subnet} {
+		if subnet == "" {
+			continue
+		}
+		if options.IPAM == nil {
+			options.IPAM = &network.IPAM{}
+		}
+		options.IPAM.Config = append(options.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+	}
+
+	s.Debugln("Creating network", networkName, "...")
+	resp, err := s.client.NetworkCreate(context.TODO(), networkName, options)
+	if err != nil {
+		return err
+	}
+
+	s.networks = append(s.networks, resp.ID)
+	s.networkMode = networkName
+	return nil
+}
+
+// removeNetwork removes the per-build network. The daemon sometimes still
+// sees the endpoints of the just removed containers, so that's retried.
+func (s *executor) removeNetwork(id string) error {
+	interval := networkRemoveRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := s.client.NetworkRemove(context.TODO(), id)
+		s.Debugln("Removed network", id, "with", err)
+		if err == nil || !strings.Contains(err.Error(), "active endpoints") || attempt > networkRemoveRetries {
+			return err
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (s *executor) disconnectNetwork(ctx context.Context, id string) error {
+	netList, err := s.client.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		s.Debugln("Can't get network list. ListNetworks exited with", err)
+		return err
+	}
+
+	for _, network := range netList {
+		// the containers are keyed by their IDs, but some callers
+		// refer to the container by its name
+		for containerID, pluggedContainer := range network.Containers {
+			if id == containerID || id == pluggedContainer.Name {
+				err = s.client.NetworkDisconnect(ctx, network.ID, id, true)
+				if err != nil {
+					s.Warningln("Can't disconnect possibly zombie container", pluggedContainer.Name, "from network", network.Name, "->", err)
+				} else {
+					s.Warningln("Possibly zombie container", pluggedContainer.Name, "is disconnected from network", network.Name)
+				}
+				break
+			}
+		}
+	}
+	return err
+}
+
+// splitImagePattern separates the registry host from the rest of an image
+// name or pattern, making the implicit Docker Hub registry and its library
+// namespace explicit
+func splitImagePattern(pattern string) (string, string) {
+	host, name := docker_helpers.SplitDockerImageName(pattern)
+	if host == docker_helpers.DefaultDockerRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return host, name
+}
+
+// matchImagePattern matches the registry host and the repository path of
+// the image separately, so the pattern can't be satisfied by an image
+// hosted on another registry which just repeats the expected host in its path.
+// Only a wildcard first segment, like in */*:*, matches any host.
+func matchImagePattern(pattern, image string) bool {
+	if _, err := reference.Parse(image); err != nil {
+		ok, _ := filepath.Match(pattern, image)
+		return ok
+	}
+
+	imageHost, imageName := splitImagePattern(image)
+	patternHost, patternName := splitImagePattern(pattern)
+	if matchImageParts(patternHost, patternName, imageHost, imageName) {
+		return true
+	}
+
+	// a wildcard first segment without a host, like in */*:*, stands for
+	// any registry host and the namespaces, not only for those of docker.io
+	parts := strings.SplitN(pattern, "/", 2)
+	if len(parts) < 2 || !strings.ContainsAny(parts[0], "*?[") || strings.ContainsAny(parts[0], ".:") {
+		return false
+	}
+	if ok, _ := filepath.Match(parts[0], imageHost); !ok {
+		return false
+	}
+	nameParts := strings.Split(imageName, "/")
+	for i := range nameParts {
+		if ok, _ := filepath.Match(parts[1], strings.Join(nameParts[i:], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchImageParts(patternHost, patternName, imageHost, imageName string) bool {
+	if ok, _ := filepath.Match(patternHost, imageHost); !ok {
+		return false
+	}
+	ok, _ := filepath.Match(patternName, imageName)
+	return ok
+}
+
+// checkAllowedImage returns the pattern of the denied images matching the
+// image, or whether the image is allowed, without reporting anything
+func checkAllowedImage(image string, allowedImages, deniedImages, internalImages []string) (deniedImage string, allowed bool) {
+	// the denied images are rejected even when matching the allowed ones
+	for _, deniedImage := range deniedImages {
+		if matchImagePattern(deniedImage, image) {
+			return deniedImage, false
+		}
+	}
+
+	for _, allowedImage := range allowedImages {
+		if matchImagePattern(allowedImage, image) {
+			return "", true
+		}
+	}
+
+	for _, internalImage := range internalImages {
+		if internalImage == image {
+			return "", true
+		}
+	}
+
+	// by default allow to override the image name
+	return "", len(allowedImages) == 0
+}
+
+func (s *executor) verifyAllowedImage(image, optionName string, allowedImages, deniedImages, internalImages []string) error {
+	deniedImage, allowed := checkAllowedImage(image, allowedImages, deniedImages, internalImages)
+	if deniedImage != "" {
+		s.Println()
+		s.Errorln("The", image, "is present on list of denied", optionName, "("+deniedImage+")")
+		s.Println()
+		s.Println("Please check runner's configuration: http://doc.gitlab.com/ci/docker/using_docker_images.html#overwrite-image-and-services")
+		return errors.New("denied image")
+	} else if allowed {
+		return nil
+	}
+
+	s.Println()
+	s.Errorln("The", image, "is not present on list of allowed", optionName)
+	for _, allowedImage := range allowedImages {
+		s.Println("-", allowedImage)
+	}
+	s.Println()
+	s.Println("Please check runner's configuration: http://doc.gitlab.com/ci/docker/using_docker_images.html#overwrite-image-and-services")
+	return errors.New("invalid image")
+}
+
+func (s *executor) getImageName() (string, error) {
+	if s.options.Image != "" {
+		image := s.Build.GetAllVariables().ExpandValue(s.options.Image)
+		err := s.verifyAllowedImage(s.options.Image, "images", s.Config.Docker.AllowedImages, s.Config.Docker.DeniedImages, []string{s.Config.Docker.Image})
+		if err != nil && s.Config.Docker.FallbackToDefaultImageWhenDisallowed && s.Config.Docker.Image != "" {
+			s.Warningln("The", image, "image is not allowed, falling back to the default", s.Config.Docker.Image, "image.",
+				"This will be an error when fallback_to_default_image_when_disallowed is disabled!")
+			return s.Config.Docker.Image, nil
+		} else if err != nil {
+			return "", err
+		}
+		return image, nil
+	}
+
+	if s.Config.Docker.Image == "" {
+		return "", errors.New("No Docker image specified to run the build in")
+	}
+
+	return s.Config.Docker.Image, nil
+}
+
+func (s *executor) connectDocker() (err error) {
+	client, err := docker_helpers.New(s.Config.Docker.DockerCredentials, DockerAPIVersion)
+	if err != nil {
+		return err
+	}
+	s.client = client
+
+	s.info, err = client.Info(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	s.version, err = client.ServerVersion(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	err = s.verifyAPIVersion()
+	if err != nil {
+		return err
+	}
+
+	err = s.verifyRuntime()
+	if err != nil {
+		return err
+	}
+
+	return
+}
+
+// verifyAPIVersion fails early when the daemon is too old, otherwise
+// the build would fail later with much less obvious errors
+func (s *executor) verifyAPIVersion() error {
+	if s.version.APIVersion == "" || !versions.LessThan(s.version.APIVersion, DockerAPIVersion) {
+		return nil
+	}
+
+	return fmt.Errorf("Docker %s (API %s) is not supported, the runner requires at least API %s, please upgrade the Docker daemon",
+		s.version.Version, s.version.APIVersion, DockerAPIVersion)
+}
+
+func (s *executor) verifyRuntime() error {
+	runtimeName := s.Config.Docker.Runtime
+	if runtimeName == "" {
+		return nil
+	}
+
+	if _, ok := s.info.Runtimes[runtimeName]; ok {
+		return nil
+	}
+
+	var availableRuntimes []string
+	for name := range s.info.Runtimes {
+		availableRuntimes = append(availableRuntimes, name)
+	}
+	sort.Strings(availableRuntimes)
+
+	return fmt.Errorf("runtime %q is not registered in the Docker daemon, available runtimes: %s",
+		runtimeName, strings.Join(availableRuntimes, ", "))
+}
+
+// pullBuildImageInBackground starts resolving the build image concurrently
+// with the services creation. The returned function waits for it to finish
+// and makes the image available to getDockerImage.
+func (s *executor) pullBuildImageInBackground() func() error {
+	imageName, err := s.getImageName()
+	if err != nil {
+		return func() error { return err }
+	}
+
+	type pullResult struct {
+		image *types.ImageInspect
+		err   error
+	}
+
+	result := make(chan pullResult, 1)
+	go func() {
+		// the resolved images are updated only from the main goroutine
+		image, err := s.resolveDockerImage(imageName)
+		result <- pullResult{image: image, err: err}
+	}()
+
+	return func() error {
+		pulled := <-result
+		if pulled.err != nil {
+			return pulled.err
+		}
+
+		s.addResolvedImage(imageName, pulled.image)
+		return nil
+	}
+}
+
+// imagePull is an image resolved in background, its result
+// can be read once done is closed
+type imagePull struct {
+	done  chan struct{}
+	image *types.ImageInspect
+	err   error
+}
+
+// getPrePulledImages returns the build image and the service images,
+// which are pulled in background with pre_pull_images
+func (s *executor) getPrePulledImages() []string {
+	var imageNames []string
+	if imageName, err := s.getImageName(); err == nil {
+		imageNames = append(imageNames, imageName)
+	}
+
+	// the services are verified and reported when they are created,
+	// the disallowed ones are only left out here
+	for _, service := range s.listServices() {
+		_, allowed := checkAllowedImage(service.Name, s.Config.Docker.AllowedServices, s.Config.Docker.DeniedServices, s.Config.Docker.Services)
+		if !allowed {
+			continue
+		}
+
+		_, _, imageName, _ := s.splitServiceAndVersion(service.Name)
+		imageNames = append(imageNames, imageName)
+	}
+	return imageNames
+}
+
+// pullImagesInBackground starts resolving all images concurrently, getDockerImage
+// then waits for the pull of the image instead of starting another one. The
+// returned function waits for the remaining pulls and returns the first error.
+func (s *executor) pullImagesInBackground(imageNames []string) func() error {
+	if s.pendingImages == nil {
+		s.pendingImages = make(map[string]*imagePull)
+	}
+
+	for _, imageName := range imageNames {
+		if s.resolvedImages[imageName] != nil || s.pendingImages[imageName] != nil {
+			continue
+		}
+
+		pull := &imagePull{done: make(chan struct{})}
+		s.pendingImages[imageName] = pull
+		go func(imageName string) {
+			// the resolved images are updated only from the main goroutine
+			pull.image, pull.err = s.resolveDockerImage(imageName)
+			close(pull.done)
+		}(imageName)
+	}
+
+	return func() (err error) {
+		for _, imageName := range imageNames {
+			pull := s.pendingImages[imageName]
+			if pull == nil {
+				continue
+			}
+
+			_, pullErr := s.finishImagePull(imageName, pull)
+			if err == nil {
+				err = pullErr
+			}
+		}
+		return
+	}
+}
+
+func (s *executor) finishImagePull(imageName string, pull *imagePull) (*types.ImageInspect, error) {
+	<-pull.done
+	delete(s.pendingImages, imageName)
+	if pull.err != nil {
+		return nil, pull.err
+	}
+
+	s.addResolvedImage(imageName, pull.image)
+	return pull.image, nil
+}
+
+func (s *executor) createDependencies() (err error) {
+	err = s.bindDevices()
+	if err != nil {
+		return err
+	}
+
+	if s.Config.Docker.PrePullImages {
+		s.Debugln("Pulling build and service images in background...")
+		waitForImages := s.pullImagesInBackground(s.getPrePulledImages())
+		defer func() {
+			// the pull errors are reported before the build starts
+			pullErr := waitForImages()
+			if err == nil {
+				err = pullErr
+			}
+		}()
+	} else if s.Config.Docker.PullBuildImageWithServices {
+		s.Debugln("Pulling build image in background...")
+		waitForBuildImage := s.pullBuildImageInBackground()
+		defer func() {
+			// always wait, so the pull doesn't outlive a failed preparation
+			pullErr := waitForBuildImage()
+			if err == nil {
+				err = pullErr
+			}
+		}()
+	}
+
+	s.Debugln("Creating build volume...")
+	err = s.createBuildVolume()
+	if err != nil {
+		return err
+	}
+
+	err = s.createNetwork()
+	if err != nil {
+		return err
+	}
+
+	s.Debugln("Creating services...")
+	err = s.createServices()
+	if err != nil {
+		return err
+	}
+
+	s.Debugln("Creating user-defined volumes...")
+	err = s.createUserVolumes()
+	if err != nil {
+		return err
+	}
+
+	return
+}
+
+func (s *executor) Prepare(globalConfig *common.Config, config *common.RunnerConfig, build *common.Build) error {
+	err := s.prepareBuildsDir(config)
+	if err != nil {
+		return err
+	}
+
+	err = s.AbstractExecutor.Prepare(globalConfig, config, build)
+	if err != nil {
+		return err
+	}
+
+	s.maskBuildTrace()
+
+	if config.Docker == nil {
+		return errors.New("Missing docker configuration")
+	}
+
+	if s.BuildShell.PassFile && !(s.supportsScriptFiles && config.Docker.ScriptsAsFile) {
+		return errors.New("Docker doesn't support shells that require script file")
+	}
+
+	err = s.validateConfig()
+	if err != nil {
+		return err
+	}
+
+	err = build.Options.Decode(&s.options)
+	if err != nil {
+		return err
+	}
+
+	if s.options.PullPolicy != "" {
+		err = s.verifyAllowedPullPolicy(s.options.PullPolicy)
+		if err != nil {
+			return err
+		}
+		s.pullPolicy = s.options.PullPolicy
+	}
+
+	imageName, err := s.getImageName()
+	if err != nil {
+		return err
+	}
+
+	s.Println("Using Docker executor with image", imageName, "...")
+
+	err = s.connectDocker()
+	if err != nil {
+		return err
+	}
+
+	// the scripts run in the containers, which can differ from the runner
+	s.Shell().OS = s.info.OSType
+
+	err = s.createDependencies()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func validatePidsLimit(optionName string, limit int64) error {
+	if limit < -1 {
+		return fmt.Errorf("%s needs to be a positive number or -1 for unlimited, got %d", optionName, limit)
+	}
+	return nil
+}
+
+func parseMemoryLimit(optionName, limit string) (int64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+
+	bytes, err := units.RAMInBytes(limit)
+	if err != nil {
+		return 0, fmt.Errorf("%s needs to be a number of bytes with an optional unit (eg. 512m), got %q", optionName, limit)
+	}
+	return bytes, nil
+}
+
+// getOomKillDisable disables the OOM killer only for the containers with a
+// memory limit, the others could exhaust the memory of the host
+func (s *executor) getOomKillDisable(memory int64) *bool {
+	disable := s.Config.Docker.OomKillDisable && memory > 0
+	return &disable
+}
+
+// validateOomOptions checks oom_kill_disable is used only with memory limits,
+// the containers could otherwise exhaust the memory of the host
+func validateOomOptions(config *common.DockerConfig) error {
+	if config.OomKillDisable && config.Memory == "" && config.ServicesMemory == "" {
+		return errors.New("oom_kill_disable requires memory or services_memory to be set")
+	}
+	if config.OomScoreAdj < -1000 || config.OomScoreAdj > 1000 {
+		return fmt.Errorf("oom_score_adj needs to be between -1000 and 1000, got %d", config.OomScoreAdj)
+	}
+	return nil
+}
+
+func validateIsolation(isolation string) error {
+	switch isolation {
+	case "", "default", "process", "hyperv":
+		return nil
+	default:
+		return fmt.Errorf("isolation needs to be one of default, process or hyperv, got %q", isolation)
+	}
+}
+
+func validateDNSOptions(options []string) error {
+	for _, option := range options {
+		if strings.TrimSpace(option) == "" {
+			return errors.New("dns_opt can't contain empty options")
+		}
+	}
+	return nil
+}
+
+// requiredLogOpts are the log_opts without which the log drivers can't deliver the logs
+var requiredLogOpts = map[string][]string{
+	"gelf":       {"gelf-address"},
+	"splunk":     {"splunk-token", "splunk-url"},
+	"awslogs":    {"awslogs-group"},
+	"logentries": {"logentries-token"},
+}
+
+func validateLogConfig(config *common.DockerConfig) error {
+	if config.LogDriver == "" && len(config.LogOpts) > 0 {
+		return errors.New("log_opts can be used only with log_driver")
+	}
+
+	for _, option := range requiredLogOpts[config.LogDriver] {
+		if config.LogOpts[option] == "" {
+			return fmt.Errorf("log_driver %s requires the %s option in log_opts", config.LogDriver, option)
+		}
+	}
+	return nil
+}
+
+func validateHelperImage(config *common.DockerConfig) error {
+	if config.HelperImageTag != "" && hasImageTagOrDigest(config.HelperImage) {
+		return fmt.Errorf("helper_image_tag can't be used when helper_image %q already has a tag or digest", config.HelperImage)
+	}
+	return nil
+}
+
+func validateNetwork(config *common.DockerConfig) error {
+	if config.NetworkPerBuild && config.NetworkMode != "" {
+		return errors.New("network_per_build can't be used together with network_mode")
+	}
+	if (config.EnableIPv6 || config.IPv4Subnet != "" || config.IPv6Subnet != "") && !config.NetworkPerBuild {
+		return errors.New("enable_ipv6, ipv4_subnet and ipv6_subnet require network_per_build")
+	}
+
+	if config.IPv4Subnet != "" {
+		ip, _, err := net.ParseCIDR(config.IPv4Subnet)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("ipv4_subnet needs to be an IPv4 CIDR (eg. 172.28.0.0/16), got %q", config.IPv4Subnet)
+		}
+	}
+
+	if config.IPv6Subnet == "" {
+		return nil
+	}
+	if !config.EnableIPv6 {
+		return errors.New("ipv6_subnet requires enable_ipv6")
+	}
+
+	ip, _, err := net.ParseCIDR(config.IPv6Subnet)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("ipv6_subnet needs to be an IPv6 CIDR (eg. fd00:1234::/64), got %q", config.IPv6Subnet)
+	}
+	return nil
+}
+
+func validateContainerLabels(labels map[string]string) error {
+	for key := range labels {
+		if strings.HasPrefix(key, reservedLabelPrefix) {
+			return fmt.Errorf("container_labels can't define %q, the %s* labels are reserved for the runner", key, reservedLabelPrefix)
+		}
+	}
+	return nil
+}
+
+func validateMacAddress(macAddress string) error {
+	if macAddress != "" && !macAddressRegex.MatchString(macAddress) {
+		return fmt.Errorf("mac_address needs to be six colon separated hexadecimal bytes (eg. 92:d0:c6:0a:29:33), got %q", macAddress)
+	}
+	return nil
+}
+
+// validateUser only checks the format, the user is resolved inside of the container
+func validateUser(user string) error {
+	if user != "" && !containerUserRegex.MatchString(user) {
+		return fmt.Errorf("user needs to be a user name or UID, optionally followed by :group or :GID, got %q", user)
+	}
+	return nil
+}
+
+// signalNames are the signals accepted by stop_signal, with or without the SIG prefix
+var signalNames = []string{"HUP", "INT", "QUIT", "ILL", "TRAP", "ABRT", "BUS", "FPE", "KILL",
+	"USR1", "SEGV", "USR2", "PIPE", "ALRM", "TERM", "STKFLT", "CHLD", "CONT", "STOP", "TSTP",
+	"TTIN", "TTOU", "URG", "XCPU", "XFSZ", "VTALRM", "PROF", "WINCH", "IO", "PWR", "SYS"}
+
+var realtimeSignalRegex = regexp.MustCompile(`^RT(MIN|MAX)([+-]([1-9]|1[0-5]))?$`)
+
+func validateStopSignal(signal string) error {
+	if signal == "" {
+		return nil
+	}
+
+	if number, err := strconv.Atoi(signal); err == nil {
+		if number < 1 || number > 64 {
+			return fmt.Errorf("stop_signal number needs to be between 1 and 64, got %d", number)
+		}
+		return nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	for _, signalName := range signalNames {
+		if name == signalName {
 			return nil
 		}
 	}
+	if realtimeSignalRegex.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("stop_signal %q is not a known signal name or number", signal)
+}
+
+func validateWorkingDir(workingDir string) error {
+	if workingDir != "" && !path.IsAbs(workingDir) {
+		return fmt.Errorf("working_dir needs to be an absolute path, got %q", workingDir)
+	}
+	return nil
+}
+
+func (s *executor) validateConfig() error {
+	err := validatePidsLimit("pids_limit", s.Config.Docker.PidsLimit)
+	if err != nil {
+		return err
+	}
+
+	err = validatePidsLimit("services_pids_limit", s.Config.Docker.ServicesPidsLimit)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseMemoryLimit("memory", s.Config.Docker.Memory)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseMemoryLimit("services_memory", s.Config.Docker.ServicesMemory)
+	if err != nil {
+		return err
+	}
+
+	err = validateOomOptions(s.Config.Docker)
+	if err != nil {
+		return err
+	}
+
+	err = validateUser(s.Config.Docker.User)
+	if err != nil {
+		return err
+	}
+
+	err = validateMacAddress(s.Config.Docker.MacAddress)
+	if err != nil {
+		return err
+	}
+
+	err = validateWorkingDir(s.Config.Docker.WorkingDir)
+	if err != nil {
+		return err
+	}
+
+	err = validateStopSignal(s.Config.Docker.StopSignal)
+	if err != nil {
+		return err
+	}
+
+	err = validateLogConfig(s.Config.Docker)
+	if err != nil {
+		return err
+	}
+
+	if s.Config.Docker.DisableStdin && !s.Config.Docker.ScriptsAsFile {
+		return errors.New("disable_stdin requires scripts_as_file, the build script is otherwise written to the standard input")
+	}
+
+	err = validateContainerLabels(s.Config.Docker.ContainerLabels)
+	if err != nil {
+		return err
+	}
+
+	err = validateIsolation(s.Config.Docker.Isolation)
+	if err != nil {
+		return err
+	}
+
+	err = validateSecurityOpt("services_security_opt", s.Config.Docker.ServicesSecurityOpt)
+	if err != nil {
+		return err
+	}
+
+	err = validateDNSOptions(s.Config.Docker.DNSOptions)
+	if err != nil {
+		return err
+	}
+
+	err = validateHelperImage(s.Config.Docker)
+	if err != nil {
+		return err
+	}
+
+	err = validateNetwork(s.Config.Docker)
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range s.Config.Docker.Volumes {
+		_, _, _, err = parseVolume(volume)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.Config.Docker.ShutdownPolicy.Get()
+	if err != nil {
+		return err
+	}
+
+	for _, pullPolicy := range s.Config.Docker.AllowedPullPolicies {
+		_, err = pullPolicy.Get()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *executor) prepareBuildsDir(config *common.RunnerConfig) error {
+	rootDir := config.BuildsDir
+	if rootDir == "" {
+		rootDir = s.DefaultBuildsDir
+	}
+	if s.isHostMountedVolume(rootDir, config.Docker.Volumes...) {
+		s.SharedBuildsDir = true
+	}
+	return nil
+}
+
+// cleanupStaleCaches removes the cache containers created more than expiry
+// ago. Caches which volumes are still mounted by other containers are kept.
+func (s *executor) cleanupStaleCaches(expiry time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), staleCachesCleanupTimeout)
+	defer cancel()
+
+	args := filters.NewArgs()
+	args.Add("label", dockerLabelPrefix+".type")
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return err
+	}
+
+	usedVolumes := make(map[string]bool)
+	for _, c := range containers {
+		if c.Labels[dockerLabelPrefix+".type"] == "cache" {
+			continue
+		}
+		for _, mount := range c.Mounts {
+			usedVolumes[mount.Name] = true
+		}
+	}
+
+	isUsed := func(c types.Container) bool {
+		for _, mount := range c.Mounts {
+			if usedVolumes[mount.Name] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range containers {
+		if c.Labels[dockerLabelPrefix+".type"] != "cache" {
+			continue
+		}
+
+		created := time.Unix(c.Created, 0)
+		if time.Since(created) < expiry || isUsed(c) {
+			continue
+		}
+
+		s.Debugln("Removing stale cache container", c.ID, "created at", created, "...")
+		err = s.client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{RemoveVolumes: true, Force: true})
+		if err != nil {
+			s.Debugln("Failed to remove stale cache container", c.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *executor) Cleanup() {
+	if s.detached {
+		// the containers are left for later reaping
+		if s.client != nil {
+			s.client.Close()
+		}
+		s.AbstractExecutor.Cleanup()
+		return
+	}
+
+	if s.client != nil && s.Config.Docker != nil && s.Config.Docker.KeepFailedContainers > 0 {
+		err := s.removeExpiredFailedContainers(time.Duration(s.Config.Docker.KeepFailedContainers) * time.Second)
+		if err != nil {
+			s.Debugln("Failed to remove expired failed containers:", err)
+		}
+	}
+
+	// the containers of a failed build are renamed and the services stopped
+	// here, the kept services are then left out of the removed containers
+	keptFailedContainers := s.keepFailedContainers()
+
+	ids := append([]string{}, s.failures...)
+	if !keptFailedContainers {
+		for _, service := range s.services {
+			ids = append(ids, service.ID)
+		}
+	}
+	ids = append(ids, s.caches...)
+	for _, build := range s.builds {
+		ids = append(ids, build.ID)
+	}
+
+	started := time.Now()
+	for _, err := range s.removeContainers(ids) {
+		s.Warningln("Failed to remove container:", err)
+	}
+
+	for _, volumeName := range s.volumes {
+		err := s.client.VolumeRemove(context.TODO(), volumeName, true)
+		s.Debugln("Removed volume", volumeName, "with", err)
+	}
+
+	// the networks can be removed only after all their containers are gone
+	for _, networkID := range s.networks {
+		err := s.removeNetwork(networkID)
+		if err != nil {
+			s.Warningln("Failed to remove network", networkID+":", err,
+				"- the network is left behind and needs to be removed with `docker network rm`")
+		}
+	}
+
+	if s.serviceFilesDir != "" {
+		os.RemoveAll(s.serviceFilesDir)
+	}
+
+	if s.client != nil && s.Config.Docker != nil && s.Config.Docker.CacheExpiry > 0 {
+		err := s.cleanupStaleCaches(time.Duration(s.Config.Docker.CacheExpiry) * time.Second)
+		if err != nil {
+			s.Debugln("Failed to cleanup stale cache containers:", err)
+		}
+	}
+
+	s.emitEvent(LifecycleEvent{Type: EventCleanupFinished, Duration: time.Since(started).Seconds()})
+
+	if s.client != nil {
+		s.client.Close()
+	}
+
+	s.AbstractExecutor.Cleanup()
+}
+
+// recordBuildFailure remembers why the build failed, so its containers
+// can be kept for debugging with keep_failed_containers
+func (s *executor) recordBuildFailure(containerName string, err error) {
+	exitCode, failed := getContainerExitCode(err)
+	if failed && s.buildFailure == "" {
+		s.buildFailure = fmt.Sprintf("%s exited with code %d", strings.TrimPrefix(containerName, "/"), exitCode)
+	}
+}
+
+// keepFailedContainers keeps the build and service containers of the failed
+// build for debugging. The labels can't be changed after the containers are
+// created, so the failure time is added to their names instead, which also
+// keeps the next build from replacing them. The services are stopped.
+// It returns whether the containers were kept.
+func (s *executor) keepFailedContainers() bool {
+	if s.buildFailure == "" || s.client == nil || s.Config.Docker == nil || s.Config.Docker.KeepFailedContainers <= 0 {
+		return false
+	}
+
+	gracePeriod := s.getShutdownGracePeriod()
+	for _, service := range s.services {
+		s.Debugln("Stopping service container", service.ID, "...")
+		err := s.client.ContainerStop(context.TODO(), service.ID, &gracePeriod)
+		if err != nil {
+			s.Debugln("Failed to stop service container", service.ID, "with", err)
+		}
+	}
+
+	keepTime := time.Duration(s.Config.Docker.KeepFailedContainers) * time.Second
+	suffix := failedContainerSuffix + strconv.FormatInt(time.Now().Unix(), 10)
+
+	s.Println()
+	s.Warningln("The build failed ("+s.buildFailure+"), its containers are kept for", keepTime, "for debugging:")
+	for _, container := range append(append([]*types.Container{}, s.buildContainers...), s.services...) {
+		name := strings.TrimPrefix(container.Names[0], "/") + suffix
+		err := s.client.ContainerRename(context.TODO(), container.ID, name)
+		if err != nil {
+			s.Warningln("Failed to rename container", container.ID+":", err)
+			continue
+		}
+		s.Println("-", name)
+	}
+	return true
+}
 
-	if len(allowedImages) != 0 {
-		s.Println()
-		s.Errorln("The", image, "is not present on list of allowed", optionName)
-		for _, allowedImage := range allowedImages {
-			s.Println("-", allowedImage)
-		}
-		s.Println()
-	} else {
-		// by default allow to override the image name
-		return nil
+// removeExpiredFailedContainers removes the containers kept with
+// keep_failed_containers, once they were kept for the configured time
+func (s *executor) removeExpiredFailedContainers(keepTime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), staleCachesCleanupTimeout)
+	defer cancel()
+
+	args := filters.NewArgs()
+	args.Add("label", dockerLabelPrefix+".type")
+	args.Add("name", failedContainerSuffix)
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return err
 	}
 
-	s.Println("Please check runner's configuration: http://doc.gitlab.com/ci/docker/using_docker_images.html#overwrite-image-and-services")
-	return errors.New("invalid image")
-}
+	for _, c := range containers {
+		failedAt, ok := getContainerFailureTime(c.Names)
+		if !ok || time.Since(failedAt) < keepTime {
+			continue
+		}
 
-func (s *executor) getImageName() (string, error) {
-	if s.options.Image != "" {
-		image := s.Build.GetAllVariables().ExpandValue(s.options.Image)
-		err := s.verifyAllowedImage(s.options.Image, "images", s.Config.Docker.AllowedImages, []string{s.Config.Docker.Image})
+		s.Debugln("Removing failed container", c.ID, "kept since", failedAt, "...")
+		err = s.client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{RemoveVolumes: true, Force: true})
 		if err != nil {
-			return "", err
+			s.Debugln("Failed to remove failed container", c.ID, err)
 		}
-		return image, nil
 	}
+	return nil
+}
 
-	if s.Config.Docker.Image == "" {
-		return "", errors.New("No Docker image specified to run the build in")
-	}
+// getContainerFailureTime returns the failure time added to the names of
+// the containers kept with keep_failed_containers
+func getContainerFailureTime(names []string) (time.Time, bool) {
+	for _, name := range names {
+		index := strings.LastIndex(name, failedContainerSuffix)
+		if index < 0 {
+			continue
+		}
 
-	return s.Config.Docker.Image, nil
+		seconds, err := strconv.ParseInt(name[index+len(failedContainerSuffix):], 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0), true
+		}
+	}
+	return time.Time{}, false
 }
 
-func (s *executor) connectDocker() (err error) {
-	client, err := docker_helpers.New(s.Config.Docker.DockerCredentials, DockerAPIVersion)
+func (s *executor) runServiceHealthCheckContainer(service *types.Container, timeout time.Duration) error {
+	waitImage, err := s.getPrebuiltImage()
 	if err != nil {
 		return err
 	}
-	s.client = client
 
-	s.info, err = client.Info(context.TODO())
-	if err != nil {
-		return err
+	containerName := service.Names[0] + "-wait-for-service"
+
+	config := &container.Config{
+		Cmd:    []string{"gitlab-runner-service"},
+		Image:  waitImage.ID,
+		Labels: s.getLabels("wait", "wait="+service.ID),
+	}
+	hostConfig := &container.HostConfig{
+		RestartPolicy: neverRestartPolicy,
+		Links:         []string{service.Names[0] + ":" + service.Names[0]},
+		NetworkMode:   s.getNetworkMode(),
+		LogConfig:     s.getLogConfig(),
 	}
+	// Any request can hang (e.g. when the daemon stops responding),
+	// so the whole probe is bounded with a context
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	return
+	s.Debugln("Waiting for service container", containerName, "to be up and running...")
+	err = s.startServiceHealthCheckContainer(ctx, config, hostConfig, containerName)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &serviceTimeoutError{containerName: containerName}
+	}
+	return err
 }
 
-func (s *executor) createDependencies() (err error) {
-	err = s.bindDevices()
+func (s *executor) startServiceHealthCheckContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, containerName string) error {
+	resp, err := s.client.ContainerCreate(ctx, config, hostConfig, nil, containerName)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		// removed even when the probe timed out
+		removeCtx, cancel := context.WithTimeout(context.Background(), serviceHealthCheckRemoveTimeout)
+		defer cancel()
+		s.removeContainer(removeCtx, resp.ID)
+	}()
 
-	s.Debugln("Creating build volume...")
-	err = s.createBuildVolume()
+	err = s.client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
 	if err != nil {
 		return err
 	}
 
-	s.Debugln("Creating services...")
-	err = s.createServices()
-	if err != nil {
-		return err
+	// these are warnings and they don't make the build fail
+	return s.waitForContainer(ctx, resp.ID)
+}
+
+type serviceTimeoutError struct {
+	containerName string
+}
+
+func (e *serviceTimeoutError) Error() string {
+	return fmt.Sprintf("service %v did timeout", e.containerName)
+}
+
+type servicePortsError struct {
+	containerName string
+	ports         []string
+}
+
+func (e *servicePortsError) Error() string {
+	return fmt.Sprintf("service %v did timeout, ports never opened: %v", e.containerName, strings.Join(e.ports, ", "))
+}
+
+// setBuildVariable adds the variable, set by the executor, to the variables
+// of the scripts generated for the following build stages
+func (s *executor) setBuildVariable(key, value string) {
+	variable := common.BuildVariable{Key: key, Value: value, Public: true, Internal: true}
+	for i := range s.Build.Variables {
+		if s.Build.Variables[i].Key == key {
+			s.Build.Variables[i] = variable
+			return
+		}
 	}
+	s.Build.Variables = append(s.Build.Variables, variable)
+}
 
-	s.Debugln("Creating user-defined volumes...")
-	err = s.createUserVolumes()
-	if err != nil {
-		return err
+// exposeBuildContainerAddress sets CI_BUILD_CONTAINER_IP to the address of the
+// running build container, on the user-defined network if it's connected to one.
+// The scripts are generated before their stage starts, so only the stages
+// following the start of the container can use it.
+func (s *executor) exposeBuildContainerAddress(inspect types.ContainerJSON) {
+	address := s.getServiceAddress(inspect)
+	if address == "" {
+		return
 	}
 
-	return
+	s.Debugln("Build container is reachable at", address)
+	s.setBuildVariable("CI_BUILD_CONTAINER_IP", address)
 }
 
-func (s *executor) Prepare(globalConfig *common.Config, config *common.RunnerConfig, build *common.Build) error {
-	err := s.prepareBuildsDir(config)
-	if err != nil {
-		return err
+// getServiceAddress returns the IP address of the service on the network
+// used by the build
+func (s *executor) getServiceAddress(inspect types.ContainerJSON) string {
+	if inspect.NetworkSettings == nil {
+		return ""
 	}
 
-	err = s.AbstractExecutor.Prepare(globalConfig, config, build)
-	if err != nil {
-		return err
+	if network := inspect.NetworkSettings.Networks[string(s.getNetworkMode())]; network != nil && network.IPAddress != "" {
+		return network.IPAddress
 	}
 
-	if s.BuildShell.PassFile {
-		return errors.New("Docker doesn't support shells that require script file")
+	if inspect.NetworkSettings.IPAddress != "" {
+		return inspect.NetworkSettings.IPAddress
 	}
 
-	if config.Docker == nil {
-		return errors.New("Missing docker configuration")
+	for _, network := range inspect.NetworkSettings.Networks {
+		if network != nil && network.IPAddress != "" {
+			return network.IPAddress
+		}
 	}
+	return ""
+}
 
-	err = build.Options.Decode(&s.options)
+// waitForServicePorts dials all exposed TCP ports of the service directly
+// from the runner, which doesn't need the prebuilt image nor container links
+func (s *executor) waitForServicePorts(service *types.Container, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	inspect, err := s.waitForServiceRestart(service, deadline)
 	if err != nil {
 		return err
 	}
 
-	imageName, err := s.getImageName()
-	if err != nil {
-		return err
+	address := s.getServiceAddress(inspect)
+	if address == "" {
+		return fmt.Errorf("service %v doesn't have an IP address", service.Names[0])
 	}
 
-	s.Println("Using Docker executor with image", imageName, "...")
+	var pending []string
+	if inspect.Config != nil {
+		for port := range inspect.Config.ExposedPorts {
+			if port.Proto() == "tcp" {
+				pending = append(pending, port.Port())
+			}
+		}
+	}
+	sort.Strings(pending)
 
-	err = s.connectDocker()
-	if err != nil {
-		return err
+	if len(pending) == 0 {
+		s.Debugln("Service", service.Names[0], "doesn't expose any TCP port")
+		return nil
 	}
 
-	err = s.createDependencies()
-	if err != nil {
-		return err
+	for {
+		var closed []string
+		for _, port := range pending {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, port), serviceDialTimeout)
+			if err != nil {
+				closed = append(closed, port)
+				continue
+			}
+			conn.Close()
+		}
+
+		pending = closed
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return &servicePortsError{containerName: service.Names[0], ports: pending}
+		}
+		time.Sleep(s.getServiceRetryInterval())
+
+		// the restarted service can get a new address
+		if s.canServiceRestart(service) {
+			inspect, err = s.waitForServiceRestart(service, deadline)
+			if err != nil {
+				return err
+			}
+			if restartedAddress := s.getServiceAddress(inspect); restartedAddress != "" {
+				address = restartedAddress
+			}
+		}
 	}
-	return nil
 }
 
-func (s *executor) prepareBuildsDir(config *common.RunnerConfig) error {
-	rootDir := config.BuildsDir
-	if rootDir == "" {
-		rootDir = s.DefaultBuildsDir
+func (s *executor) canServiceRestart(service *types.Container) bool {
+	restartPolicy, err := parseRestartPolicy(s.serviceDefinitions[service.ID].Restart)
+	return err == nil && restartPolicy.Name != neverRestartPolicy.Name
+}
+
+// waitForServiceRestart inspects the service, waiting until the deadline
+// when the service is being restarted by Docker
+func (s *executor) waitForServiceRestart(service *types.Container, deadline time.Time) (types.ContainerJSON, error) {
+	for {
+		inspect, err := s.client.ContainerInspect(context.TODO(), service.ID)
+		if err != nil {
+			return inspect, err
+		}
+
+		if inspect.ContainerJSONBase == nil || inspect.State == nil || !inspect.State.Restarting || time.Now().After(deadline) {
+			return inspect, nil
+		}
+
+		s.Debugln("Service", service.Names[0], "is restarting...")
+		time.Sleep(s.getServiceRetryInterval())
 	}
-	if s.isHostMountedVolume(rootDir, config.Docker.Volumes...) {
-		s.SharedBuildsDir = true
+}
+
+// runRestartableServiceHealthCheck repeats the probe when the service was
+// restarted while it was probed, as long as the timeout allows it
+func (s *executor) runRestartableServiceHealthCheck(service *types.Container, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := s.waitForServiceRestart(service, deadline)
+		if err != nil {
+			return err
+		}
+
+		restartCount := 0
+		if inspect.ContainerJSONBase != nil {
+			restartCount = inspect.RestartCount
+		}
+
+		err = s.runServiceHealthCheckContainer(service, deadline.Sub(time.Now()))
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+
+		inspect, inspectErr := s.client.ContainerInspect(context.TODO(), service.ID)
+		if inspectErr != nil || inspect.ContainerJSONBase == nil || inspect.State == nil {
+			return err
+		}
+		if inspect.RestartCount == restartCount && !inspect.State.Restarting {
+			return err
+		}
+
+		s.Debugln("Service", service.Names[0], "was restarted, probing it again...")
 	}
-	return nil
 }
 
-func (s *executor) Cleanup() {
-	var wg sync.WaitGroup
+type serviceHealthError struct {
+	containerName string
+	status        string
+	log           []string
+}
 
-	remove := func(id string) {
-		wg.Add(1)
-		go func() {
-			s.removeContainer(id)
-			wg.Done()
-		}()
+func (e *serviceHealthError) Error() string {
+	return fmt.Sprintf("service %v did timeout, health status: %v", e.containerName, e.status)
+}
+
+func hasHealthCheck(inspect types.ContainerJSON) bool {
+	if inspect.Config == nil || inspect.Config.Healthcheck == nil {
+		return false
 	}
 
-	for _, failureID := range s.failures {
-		remove(failureID)
+	test := inspect.Config.Healthcheck.Test
+	return len(test) > 0 && test[0] != "NONE"
+}
+
+// waitForServiceHealth polls the status of the HEALTHCHECK defined by the
+// service image. It returns false when the image doesn't define any.
+func (s *executor) waitForServiceHealth(service *types.Container, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := s.client.ContainerInspect(context.TODO(), service.ID)
+		if err != nil {
+			return false, err
+		}
+
+		if !hasHealthCheck(inspect) {
+			s.Debugln("Service", service.Names[0], "doesn't define a health check")
+			return false, nil
+		}
+
+		if inspect.ContainerJSONBase == nil || inspect.State == nil {
+			return true, fmt.Errorf("service %v doesn't report its state", service.Names[0])
+		}
+
+		if !inspect.State.Running {
+			if inspect.State.Restarting && time.Now().Before(deadline) {
+				s.Debugln("Service", service.Names[0], "is restarting...")
+				time.Sleep(s.getServiceRetryInterval())
+				continue
+			}
+			return true, &common.BuildError{
+				Inner: &containerExitError{ExitCode: inspect.State.ExitCode},
+			}
+		}
+
+		health := inspect.State.Health
+		if health != nil && health.Status == types.Healthy {
+			return true, nil
+		}
+
+		if time.Now().After(deadline) {
+			healthErr := &serviceHealthError{containerName: service.Names[0], status: types.Starting}
+			if health != nil {
+				healthErr.status = health.Status
+				healthErr.log = getHealthCheckLog(health, serviceHealthCheckLogLines)
+			}
+			return true, healthErr
+		}
+		time.Sleep(s.getServiceRetryInterval())
 	}
+}
 
-	for _, service := range s.services {
-		remove(service.ID)
+// getHealthCheckLog returns the output of the last health check probes
+func getHealthCheckLog(health *types.Health, lines int) []string {
+	var log []string
+	for _, result := range health.Log {
+		if output := strings.TrimSpace(result.Output); output != "" {
+			log = append(log, output)
+		}
 	}
 
-	for _, cacheID := range s.caches {
-		remove(cacheID)
+	if len(log) > lines {
+		log = log[len(log)-lines:]
 	}
+	return log
+}
 
-	for _, build := range s.builds {
-		remove(build.ID)
+// getServiceHealthCheckDiagnosis translates the result of the health-check
+// probe into a human readable reason, following the exit code contract of
+// the gitlab-runner-service probe.
+func (s *executor) getServiceHealthCheckDiagnosis(service *types.Container, err error) string {
+	inspect, inspectErr := s.client.ContainerInspect(context.TODO(), service.ID)
+	if inspectErr == nil && inspect.ContainerJSONBase != nil && inspect.State != nil && !inspect.State.Running {
+		return fmt.Sprintf("Service container exited with code %d.", inspect.State.ExitCode)
 	}
 
-	wg.Wait()
+	if _, ok := err.(*serviceTimeoutError); ok {
+		return "Service port never opened."
+	}
 
-	if s.client != nil {
-		s.client.Close()
+	if _, ok := err.(*servicePortsError); ok {
+		return "Service ports never opened."
 	}
 
-	s.AbstractExecutor.Cleanup()
-}
+	if healthErr, ok := err.(*serviceHealthError); ok {
+		diagnosis := "Service never became healthy."
+		if len(healthErr.log) > 0 {
+			diagnosis += " Last health check output:\n" + strings.Join(healthErr.log, "\n")
+		}
+		return diagnosis
+	}
 
-func (s *executor) runServiceHealthCheckContainer(service *types.Container, timeout time.Duration) error {
-	waitImage, err := s.getPrebuiltImage()
-	if err != nil {
-		return err
+	exitCode, ok := getContainerExitCode(err)
+	if !ok {
+		return ""
 	}
 
-	containerName := service.Names[0] + "-wait-for-service"
+	switch exitCode {
+	case serviceHealthCheckNoPortExitCode:
+		return "Service doesn't expose any TCP port that could be checked."
+	default:
+		return fmt.Sprintf("Health-check probe failed unexpectedly with exit code %d.", exitCode)
+	}
+}
 
-	config := &container.Config{
-		Cmd:    []string{"gitlab-runner-service"},
-		Image:  waitImage.ID,
-		Labels: s.getLabels("wait", "wait="+service.ID),
+func (s *executor) getServiceLogsOptions() types.ContainerLogsOptions {
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: !s.Config.Docker.DisableServiceLogsTimestamps,
 	}
-	hostConfig := &container.HostConfig{
-		RestartPolicy: neverRestartPolicy,
-		Links:         []string{service.Names[0] + ":" + service.Names[0]},
-		NetworkMode:   container.NetworkMode(s.Config.Docker.NetworkMode),
-		LogConfig: container.LogConfig{
-			Type: "json-file",
-		},
+
+	// Show the whole service log when debugging the build
+	if s.Build != nil && s.Build.IsDebugTraceEnabled() {
+		return options
 	}
-	s.Debugln("Waiting for service container", containerName, "to be up and running...")
-	resp, err := s.client.ContainerCreate(context.TODO(), config, hostConfig, nil, containerName)
-	if err != nil {
-		return err
+
+	if tail := s.Config.Docker.GetServiceLogsTail(); tail > 0 {
+		options.Tail = strconv.Itoa(tail)
 	}
-	defer s.removeContainer(resp.ID)
-	err = s.client.ContainerStart(context.TODO(), resp.ID, types.ContainerStartOptions{})
+	return options
+}
+
+// writeServiceLogs appends the last lines of the service container logs to the buffer
+func (s *executor) writeServiceLogs(buffer *bytes.Buffer, service *types.Container) {
+	var containerBuffer bytes.Buffer
+
+	hijacked, err := s.client.ContainerLogs(context.TODO(), service.ID, s.getServiceLogsOptions())
 	if err != nil {
-		return err
+		buffer.WriteString(strings.TrimSpace(err.Error()) + "\n")
+		return
 	}
+	defer hijacked.Close()
 
-	waitResult := make(chan error, 1)
-	go func() {
-		waitResult <- s.waitForContainer(resp.ID)
-	}()
+	stdcopy.StdCopy(&containerBuffer, &containerBuffer, hijacked)
+	if containerLog := containerBuffer.String(); containerLog != "" {
+		buffer.WriteString("\n")
+		buffer.WriteString(strings.TrimSpace(containerLog))
+		buffer.WriteString("\n")
+	}
+}
 
-	// these are warnings and they don't make the build fail
-	select {
-	case err := <-waitResult:
-		return err
-	case <-time.After(timeout):
-		return fmt.Errorf("service %v did timeout", containerName)
+// dumpServicesLogs prints the logs of all services into the build trace,
+// which helps to find out why the build failed
+func (s *executor) dumpServicesLogs() {
+	for _, service := range s.services {
+		var buffer bytes.Buffer
+		buffer.WriteString("\n")
+		buffer.WriteString(helpers.ANSI_YELLOW + "*** Logs of service " + service.Names[0] + ":" + helpers.ANSI_RESET + "\n")
+		s.writeServiceLogs(&buffer, service)
+		io.Copy(s.BuildTrace, &buffer)
 	}
 }
 
 func (s *executor) waitForServiceContainer(service *types.Container, timeout time.Duration) error {
-	err := s.runServiceHealthCheckContainer(service, timeout)
+	var err error
+	healthChecked := false
+	if s.Config.Docker.WaitForServicesHealthCheck {
+		healthChecked, err = s.waitForServiceHealth(service, timeout)
+	}
+
+	// fall back to the port checks when the image doesn't define a health check
+	if !healthChecked {
+		if s.Config.Docker.WaitForServicesByTCP {
+			err = s.waitForServicePorts(service, timeout)
+		} else if s.canServiceRestart(service) {
+			err = s.runRestartableServiceHealthCheck(service, timeout)
+		} else {
+			err = s.runServiceHealthCheckContainer(service, timeout)
+		}
+	}
 	if err == nil {
 		return nil
 	}
@@ -1139,27 +4251,11 @@ func (s *executor) waitForServiceContainer(service *types.Container, timeout tim
 	buffer.WriteString(helpers.ANSI_YELLOW + "*** WARNING:" + helpers.ANSI_RESET + " Service " + service.Names[0] + " probably didn't start properly.\n")
 	buffer.WriteString("\n")
 	buffer.WriteString(strings.TrimSpace(err.Error()) + "\n")
-
-	var containerBuffer bytes.Buffer
-
-	options := types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Timestamps: true,
+	if diagnosis := s.getServiceHealthCheckDiagnosis(service, err); diagnosis != "" {
+		buffer.WriteString(diagnosis + "\n")
 	}
 
-	hijacked, err := s.client.ContainerLogs(context.TODO(), service.ID, options)
-	if err == nil {
-		defer hijacked.Close()
-		stdcopy.StdCopy(&containerBuffer, &containerBuffer, hijacked)
-		if containerLog := containerBuffer.String(); containerLog != "" {
-			buffer.WriteString("\n")
-			buffer.WriteString(strings.TrimSpace(containerLog))
-			buffer.WriteString("\n")
-		}
-	} else {
-		buffer.WriteString(strings.TrimSpace(err.Error()) + "\n")
-	}
+	s.writeServiceLogs(&buffer, service)
 
 	buffer.WriteString("\n")
 	buffer.WriteString(helpers.ANSI_YELLOW + "*********" + helpers.ANSI_RESET + "\n")
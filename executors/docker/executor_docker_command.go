@@ -3,6 +3,14 @@ package docker
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
@@ -13,6 +21,7 @@ type commandExecutor struct {
 	executor
 	predefinedContainer *types.ContainerJSON
 	buildContainer      *types.ContainerJSON
+	scriptsDir          string // host directory with the build scripts, when scripts_as_file is used
 }
 
 func (s *commandExecutor) Prepare(globalConfig *common.Config, config *common.RunnerConfig, build *common.Build) error {
@@ -23,7 +32,15 @@ func (s *commandExecutor) Prepare(globalConfig *common.Config, config *common.Ru
 
 	s.Debugln("Starting Docker command...")
 
-	if len(s.BuildShell.DockerCommand) == 0 {
+	buildCommand := s.BuildShell.DockerCommand
+	if s.Config.Docker.ScriptsAsFile {
+		buildCommand, err = s.prepareScriptFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(buildCommand) == 0 {
 		return errors.New("Script is not compatible with Docker")
 	}
 
@@ -44,7 +61,7 @@ func (s *commandExecutor) Prepare(globalConfig *common.Config, config *common.Ru
 	}
 
 	// Start build container which will run actual build
-	s.buildContainer, err = s.createContainer("build", imageName, s.BuildShell.DockerCommand)
+	s.buildContainer, err = s.createContainer("build", imageName, buildCommand)
 	if err != nil {
 		return err
 	}
@@ -62,7 +79,158 @@ func (s *commandExecutor) Run(cmd common.ExecutorCommand) error {
 
 	s.Debugln("Executing on", runOn.Name, "the", cmd.Script)
 
-	return s.watchContainer(runOn.ID, bytes.NewBufferString(cmd.Script), cmd.Abort)
+	var input io.Reader = bytes.NewBufferString(cmd.Script)
+	if !cmd.Predefined && s.scriptsDir != "" {
+		err := s.writeScriptFile(cmd.Script)
+		if err != nil {
+			return err
+		}
+		input = &bytes.Buffer{}
+		if s.isBuildStdinDisabled() {
+			input = nil
+		}
+	}
+
+	if cmd.Predefined {
+		err := s.watchContainer(runOn.ID, input, cmd.Abort)
+		s.recordBuildFailure(runOn.Name, err)
+		return err
+	}
+
+	err := s.runBuildScript(runOn.ID, input, cmd.Abort)
+	s.recordBuildFailure(runOn.Name, err)
+	exitCode, failed := getContainerExitCode(err)
+	if failed && s.Config.Docker.ServiceLogsOnFailure {
+		s.dumpServicesLogs()
+	}
+
+	if s.Build.CurrentStage == common.BuildStageUserScript {
+		event := LifecycleEvent{Type: EventBuildFinished, ContainerID: runOn.ID, ContainerType: "build", Error: getEventError(err)}
+		if err == nil || failed {
+			event.ExitCode = &exitCode
+		}
+		s.emitEvent(event)
+	}
+	return err
+}
+
+func (s *commandExecutor) runBuildScript(id string, input io.Reader, abort chan interface{}) error {
+	if s.Config.Docker.FastExitThreshold <= 0 {
+		return s.watchContainer(id, input, abort)
+	}
+
+	output := &outputCounter{Writer: s.BuildTrace}
+	started := time.Now()
+
+	err := s.watchContainerOutput(id, input, output, abort)
+	if err != nil {
+		return err
+	}
+
+	return s.checkFastExit(time.Since(started), output.Size())
+}
+
+// checkFastExit detects build containers which finished successfully almost
+// immediately without any output, which usually means that the image
+// entrypoint ignored the build script
+func (s *commandExecutor) checkFastExit(duration time.Duration, outputSize int64) error {
+	threshold := time.Duration(s.Config.Docker.FastExitThreshold) * time.Second
+	if duration >= threshold || outputSize > fastExitMaximumOutputSize {
+		return nil
+	}
+
+	message := fmt.Sprintf("Build container finished within %v with almost no output. "+
+		"The image entrypoint may not have run the build script.", duration)
+	if s.Config.Docker.FailOnFastExit {
+		return &common.BuildError{Inner: errors.New(message)}
+	}
+
+	s.Warningln(message)
+	return nil
+}
+
+func (s *commandExecutor) getScriptFileName() string {
+	if s.BuildShell.Extension != "" {
+		return "script." + s.BuildShell.Extension
+	}
+	return "script"
+}
+
+// prepareScriptFile creates the host directory mounted read-only into the
+// build container and returns the command running the script from it
+func (s *commandExecutor) prepareScriptFile() ([]string, error) {
+	scriptsDir, err := ioutil.TempDir(s.Config.Docker.ScriptsDir, "gitlab-runner-scripts")
+	if err != nil {
+		return nil, err
+	}
+	s.scriptsDir = scriptsDir
+
+	// TempDir is accessible only by the runner user, so the embedded secrets
+	// are not exposed on the host. The mounted directory and the scripts in it
+	// are readable by everyone, so any user of the build container can run them.
+	mountedDir := s.getMountedScriptsDir()
+	err = os.Mkdir(mountedDir, 0755)
+	if err == nil {
+		// not limited by the umask of the runner
+		err = os.Chmod(mountedDir, 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.buildBinds = append(s.buildBinds, filepath.ToSlash(mountedDir)+":"+scriptsContainerDir+":ro")
+	scriptFile := path.Join(scriptsContainerDir, s.getScriptFileName())
+
+	if s.BuildShell.PassFile {
+		return append(s.BuildShell.GetCommandWithArguments(), scriptFile), nil
+	}
+	if len(s.BuildShell.DockerCommand) == 0 {
+		return nil, nil
+	}
+
+	// the shell reads the script from its standard input, the path
+	// doesn't need escaping, as it's built only from constant parts
+	command := append([]string{}, s.BuildShell.DockerCommand...)
+	last := len(command) - 1
+	command[last] = "exec < " + scriptFile + "\n" + command[last]
+	return command, nil
+}
+
+// getMountedScriptsDir returns the host directory mounted into the build
+// container, it's inside scriptsDir so it can't be reached by other users
+func (s *commandExecutor) getMountedScriptsDir() string {
+	return filepath.Join(s.scriptsDir, "scripts")
+}
+
+func (s *commandExecutor) writeScriptFile(script string) error {
+	scriptFile := filepath.Join(s.getMountedScriptsDir(), s.getScriptFileName())
+	err := ioutil.WriteFile(scriptFile, []byte(script), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(scriptFile, 0644)
+}
+
+func (s *commandExecutor) Cleanup() {
+	s.executor.Cleanup()
+
+	if s.scriptsDir != "" {
+		os.RemoveAll(s.scriptsDir)
+	}
+}
+
+type outputCounter struct {
+	io.Writer
+	size int64
+}
+
+func (o *outputCounter) Write(p []byte) (n int, err error) {
+	n, err = o.Writer.Write(p)
+	atomic.AddInt64(&o.size, int64(n))
+	return
+}
+
+func (o *outputCounter) Size() int64 {
+	return atomic.LoadInt64(&o.size)
 }
 
 func init() {
@@ -76,7 +244,7 @@ func init() {
 			RunnerCommand: "/usr/bin/gitlab-runner-helper",
 		},
 		ShowHostname:     true,
-		SupportedOptions: []string{"image", "services"},
+		SupportedOptions: []string{"image", "services", "pull_policy", "entrypoint"},
 	}
 
 	creator := func() common.Executor {
@@ -85,6 +253,7 @@ func init() {
 				AbstractExecutor: executors.AbstractExecutor{
 					ExecutorOptions: options,
 				},
+				supportsScriptFiles: true,
 			},
 		}
 	}
@@ -95,8 +264,10 @@ func init() {
 		features.Services = true
 	}
 
-	common.RegisterExecutor("docker", executors.DefaultExecutorProvider{
-		Creator:         creator,
-		FeaturesUpdater: featuresUpdater,
+	common.RegisterExecutor("docker", executorProvider{
+		DefaultExecutorProvider: executors.DefaultExecutorProvider{
+			Creator:         creator,
+			FeaturesUpdater: featuresUpdater,
+		},
 	})
 }
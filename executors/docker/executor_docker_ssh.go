@@ -50,6 +50,7 @@ func (s *sshExecutor) Prepare(globalConfig *common.Config, config *common.Runner
 	if err != nil {
 		return err
 	}
+	s.exposeBuildContainerAddress(containerData)
 
 	// Create SSH command
 	s.sshCommand = ssh.Client{
@@ -74,12 +75,31 @@ func (s *sshExecutor) Run(cmd common.ExecutorCommand) error {
 		Stdin:       cmd.Script,
 		Abort:       cmd.Abort,
 	})
+	if s.Build.CurrentStage == common.BuildStageUserScript {
+		s.emitBuildFinished(err)
+	}
 	if _, ok := err.(*ssh.ExitError); ok {
 		err = &common.BuildError{Inner: err}
 	}
 	return err
 }
 
+func (s *sshExecutor) emitBuildFinished(err error) {
+	event := LifecycleEvent{Type: EventBuildFinished, ContainerID: s.buildContainerID, ContainerType: "build", Error: getEventError(err)}
+	exitCode := 0
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		if status, ok := exitErr.Inner.(interface {
+			ExitStatus() int
+		}); ok {
+			exitCode = status.ExitStatus()
+			event.ExitCode = &exitCode
+		}
+	} else if err == nil {
+		event.ExitCode = &exitCode
+	}
+	s.emitEvent(event)
+}
+
 func (s *sshExecutor) Cleanup() {
 	s.sshCommand.Cleanup()
 	s.executor.Cleanup()
@@ -95,7 +115,7 @@ func init() {
 			RunnerCommand: "gitlab-runner",
 		},
 		ShowHostname:     true,
-		SupportedOptions: []string{"image", "services"},
+		SupportedOptions: []string{"image", "services", "pull_policy", "entrypoint"},
 	}
 
 	creator := func() common.Executor {
@@ -1,18 +1,31 @@
 package docker
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -141,7 +154,7 @@ func testServiceFromNamedImage(t *testing.T, description, imageName, serviceName
 	e.Build.ProjectID = 0
 	e.Build.Runner.Token = "abcdef1234567890"
 
-	c.On("ImagePullBlocking", context.TODO(), imageName, options).
+	c.On("ImagePullBlocking", context.TODO(), imageName, options, mock.Anything).
 		Return(nil).
 		Once()
 
@@ -174,7 +187,7 @@ func testServiceFromNamedImage(t *testing.T, description, imageName, serviceName
 		Once()
 
 	linksMap := make(map[string]*types.Container)
-	err := e.createFromServiceDescription(description, linksMap)
+	err := e.createFromServiceDescription(dockerService{Name: description}, linksMap)
 	assert.NoError(t, err)
 }
 
@@ -194,15 +207,15 @@ func TestDockerForNamedImage(t *testing.T) {
 	e := executor{client: &c}
 	options := buildImagePullOptions(e, "test")
 
-	c.On("ImagePullBlocking", context.TODO(), "test:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "test:latest", options, mock.Anything).
 		Return(os.ErrNotExist).
 		Once()
 
-	c.On("ImagePullBlocking", context.TODO(), "tagged:tag", options).
+	c.On("ImagePullBlocking", context.TODO(), "tagged:tag", options, mock.Anything).
 		Return(os.ErrNotExist).
 		Once()
 
-	c.On("ImagePullBlocking", context.TODO(), validSHA, options).
+	c.On("ImagePullBlocking", context.TODO(), validSHA, options, mock.Anything).
 		Return(os.ErrNotExist).
 		Once()
 
@@ -226,7 +239,7 @@ func TestDockerForExistingImage(t *testing.T) {
 	e := executor{client: &c}
 	options := buildImagePullOptions(e, "existing")
 
-	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options, mock.Anything).
 		Return(nil).
 		Once()
 
@@ -329,7 +342,7 @@ func TestDockerPolicyModeIfNotPresentForNotExistingImage(t *testing.T) {
 		Once()
 
 	options := buildImagePullOptions(e, "not-existing")
-	c.On("ImagePullBlocking", context.TODO(), "not-existing:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "not-existing:latest", options, mock.Anything).
 		Return(nil).
 		Once()
 
@@ -341,11 +354,7 @@ func TestDockerPolicyModeIfNotPresentForNotExistingImage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, image)
 
-	c.On("ImageInspectWithRaw", context.TODO(), "not-existing").
-		Return(types.ImageInspect{}, nil, nil).
-		Once()
-
-	// It shouldn't execute the pull for second time
+	// It shouldn't execute the pull nor the inspect for second time
 	image, err = e.getDockerImage("not-existing")
 	assert.NoError(t, err)
 	assert.NotNil(t, image)
@@ -363,7 +372,7 @@ func TestDockerPolicyModeAlwaysForExistingImage(t *testing.T) {
 		Once()
 
 	options := buildImagePullOptions(e, "existing:latest")
-	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options, mock.Anything).
 		Return(nil).
 		Once()
 
@@ -388,7 +397,7 @@ func TestDockerPolicyModeAlwaysForLocalOnlyImage(t *testing.T) {
 		Once()
 
 	options := buildImagePullOptions(e, "existing:lastest")
-	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "existing:latest", options, mock.Anything).
 		Return(fmt.Errorf("not found")).
 		Once()
 
@@ -409,7 +418,7 @@ func TestDockerGetExistingDockerImageIfPullFails(t *testing.T) {
 		Once()
 
 	options := buildImagePullOptions(e, "to-pull")
-	c.On("ImagePullBlocking", context.TODO(), "to-pull:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "to-pull:latest", options, mock.Anything).
 		Return(os.ErrNotExist).
 		Once()
 
@@ -421,7 +430,7 @@ func TestDockerGetExistingDockerImageIfPullFails(t *testing.T) {
 		Return(types.ImageInspect{}, nil, os.ErrNotExist).
 		Once()
 
-	c.On("ImagePullBlocking", context.TODO(), "not-existing:latest", options).
+	c.On("ImagePullBlocking", context.TODO(), "not-existing:latest", options, mock.Anything).
 		Return(os.ErrNotExist).
 		Once()
 
@@ -710,7 +719,7 @@ func addPullsRemoteImageExpectations(c *docker_helpers.MockClient, imageName str
 		Return(types.ImageInspect{ID: "not-this-image"}, nil, nil).
 		Once()
 
-	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("types.ImagePullOptions")).
+	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
 		Return(nil).
 		Once()
 
@@ -724,7 +733,7 @@ func addDeniesPullExpectations(c *docker_helpers.MockClient, imageName string) {
 		Return(types.ImageInspect{ID: "image"}, nil, nil).
 		Once()
 
-	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("types.ImagePullOptions")).
+	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
 		Return(fmt.Errorf("deny pulling")).
 		Once()
 }
@@ -754,6 +763,2885 @@ func TestPullPolicyWhenIfNotPresentIsSet(t *testing.T) {
 	testGetDockerImage(t, e, gitlabImage, addFindsLocalImageExpectations)
 }
 
+func TestVerifyAPIVersion(t *testing.T) {
+	e := executor{}
+	assert.NoError(t, e.verifyAPIVersion(), "unknown version is not checked")
+
+	e.version = types.Version{Version: "1.13.1", APIVersion: "1.26"}
+	assert.NoError(t, e.verifyAPIVersion())
+
+	e.version = types.Version{Version: "1.6.2", APIVersion: DockerAPIVersion}
+	assert.NoError(t, e.verifyAPIVersion())
+
+	e.version = types.Version{Version: "1.5.0", APIVersion: "1.17"}
+	err := e.verifyAPIVersion()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1.5.0")
+	assert.Contains(t, err.Error(), "API 1.17")
+	assert.Contains(t, err.Error(), "at least API "+DockerAPIVersion)
+}
+
+func TestGetPlatform(t *testing.T) {
+	tests := []struct {
+		osType       string
+		architecture string
+		platform     string
+	}{
+		{"linux", "x86_64", "x86_64"},
+		{"linux", "aarch64", "arm"},
+		{"linux", "armv7l", "arm"},
+		{"windows", "x86_64", "windows-x86_64"},
+		{"windows", "amd64", "windows-x86_64"},
+		{"windows", "arm64", "windows-arm64"},
+	}
+
+	for _, test := range tests {
+		e := executor{}
+		e.info = types.Info{OSType: test.osType, Architecture: test.architecture}
+		assert.Equal(t, test.platform, e.getPlatform(), "%s/%s", test.osType, test.architecture)
+	}
+
+	e := executor{}
+	expected := e.getArchitecture()
+	if runtime.GOOS != "linux" {
+		expected = runtime.GOOS + "-" + expected
+	}
+	assert.Equal(t, expected, e.getPlatform(), "falls back to the runner's platform")
+}
+
+func TestGetPrebuiltImageFromHelperImage(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.info = types.Info{OSType: "linux", Architecture: "x86_64"}
+	e.Config.Docker = &common.DockerConfig{
+		HelperImage: "registry.example.com/gitlab-runner-helper",
+	}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	imageName := "registry.example.com/gitlab-runner-helper:x86_64-" + common.REVISION
+
+	c.On("ImageInspectWithRaw", context.TODO(), imageName).
+		Return(types.ImageInspect{}, nil, os.ErrNotExist).
+		Once()
+
+	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("ImagePullOptions"), mock.Anything).
+		Return(nil).
+		Once()
+
+	c.On("ImageInspectWithRaw", context.TODO(), imageName).
+		Return(types.ImageInspect{ID: "helper-image"}, nil, nil).
+		Once()
+
+	image, err := e.getPrebuiltImage()
+	assert.NoError(t, err)
+	require.NotNil(t, image)
+	assert.Equal(t, "helper-image", image.ID)
+
+	image, err = e.getPrebuiltImage()
+	assert.NoError(t, err, "the pulled helper image is resolved once")
+	require.NotNil(t, image)
+}
+
+func TestGetPrebuiltImageFromHelperImageFailure(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.info = types.Info{OSType: "linux", Architecture: "x86_64"}
+	e.Config.Docker = &common.DockerConfig{
+		HelperImage: "registry.example.com/gitlab-runner-helper",
+	}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	imageName := "registry.example.com/gitlab-runner-helper:x86_64-" + common.REVISION
+
+	c.On("ImageInspectWithRaw", context.TODO(), imageName).
+		Return(types.ImageInspect{}, nil, os.ErrNotExist).
+		Once()
+
+	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("ImagePullOptions"), mock.Anything).
+		Return(errors.New("connection refused")).
+		Once()
+
+	_, err := e.getPrebuiltImage()
+	assert.Error(t, err, "the embedded helper image isn't used when helper_image is configured")
+}
+
+func TestGetPrebuiltImageReference(t *testing.T) {
+	tests := []struct {
+		helperImage    string
+		helperImageTag string
+		reference      string
+		pinned         bool
+	}{
+		{"", "", prebuiltImageName + ":x86_64-" + common.REVISION, false},
+		{"", "x86_64-v1.0", prebuiltImageName + ":x86_64-v1.0", true},
+		{"registry.example.com/helper", "", "registry.example.com/helper:x86_64-" + common.REVISION, false},
+		{"registry.example.com:5000/helper", "v1.0", "registry.example.com:5000/helper:v1.0", true},
+		{"registry.example.com:5000/helper:v1.0", "", "registry.example.com:5000/helper:v1.0", true},
+		{"registry.example.com/helper@sha256:0123456789012345678901234567890123456789012345678901234567890123", "",
+			"registry.example.com/helper@sha256:0123456789012345678901234567890123456789012345678901234567890123", true},
+	}
+
+	for _, test := range tests {
+		e := executor{}
+		e.Config.Docker = &common.DockerConfig{
+			HelperImage:    test.helperImage,
+			HelperImageTag: test.helperImageTag,
+		}
+
+		reference, pinned := e.getPrebuiltImageReference("x86_64")
+		assert.Equal(t, test.reference, reference, "%q and %q", test.helperImage, test.helperImageTag)
+		assert.Equal(t, test.pinned, pinned, "%q and %q", test.helperImage, test.helperImageTag)
+	}
+}
+
+func TestGetPrebuiltImageWithPinnedTag(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.info = types.Info{OSType: "linux", Architecture: "x86_64"}
+	e.Config.Docker = &common.DockerConfig{
+		HelperImageTag: "x86_64-v1.0",
+	}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	imageName := prebuiltImageName + ":x86_64-v1.0"
+
+	c.On("ImageInspectWithRaw", context.TODO(), imageName).
+		Return(types.ImageInspect{}, nil, os.ErrNotExist).
+		Once()
+
+	c.On("ImagePullBlocking", context.TODO(), imageName, mock.AnythingOfType("ImagePullOptions"), mock.Anything).
+		Return(nil).
+		Once()
+
+	c.On("ImageInspectWithRaw", context.TODO(), imageName).
+		Return(types.ImageInspect{ID: "helper-image", Architecture: "arm"}, nil, nil).
+		Once()
+
+	image, err := e.getPrebuiltImage()
+	assert.NoError(t, err, "the pinned image is pulled instead of importing the embedded one")
+	require.NotNil(t, image)
+	assert.Equal(t, "helper-image", image.ID)
+}
+
+func TestValidateDNSOptions(t *testing.T) {
+	assert.NoError(t, validateDNSOptions(nil))
+	assert.NoError(t, validateDNSOptions([]string{"ndots:2", "timeout:1", "rotate"}))
+	assert.Error(t, validateDNSOptions([]string{"ndots:2", ""}))
+	assert.Error(t, validateDNSOptions([]string{" "}))
+}
+
+func TestValidateHelperImage(t *testing.T) {
+	assert.NoError(t, validateHelperImage(&common.DockerConfig{}))
+	assert.NoError(t, validateHelperImage(&common.DockerConfig{HelperImage: "registry.example.com:5000/helper", HelperImageTag: "v1.0"}))
+	assert.NoError(t, validateHelperImage(&common.DockerConfig{HelperImage: "registry.example.com:5000/helper:v1.0"}))
+	assert.Error(t, validateHelperImage(&common.DockerConfig{HelperImage: "registry.example.com:5000/helper:v1.0", HelperImageTag: "v1.0"}))
+}
+
+func TestVerifyRuntime(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	e.info.Runtimes = map[string]types.Runtime{
+		"runc":        {Path: "docker-runc"},
+		"sysbox-runc": {Path: "/usr/bin/sysbox-runc"},
+	}
+
+	assert.NoError(t, e.verifyRuntime(), "empty runtime uses the daemon default")
+
+	e.Config.Docker.Runtime = "sysbox-runc"
+	assert.NoError(t, e.verifyRuntime())
+
+	e.Config.Docker.Runtime = "kata-runtime"
+	err := e.verifyRuntime()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "kata-runtime")
+	assert.Contains(t, err.Error(), "runc, sysbox-runc")
+}
+
+func TestWaitForContainerRespectsContext(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	c.On("ContainerInspect", ctx, "running").
+		Return(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{Running: true},
+			},
+		}, nil).
+		Once()
+
+	err := e.waitForContainer(ctx, "running")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestGetServiceLogsOptions(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	options := e.getServiceLogsOptions()
+	assert.True(t, options.Timestamps)
+	assert.Equal(t, "100", options.Tail)
+
+	e.Config.Docker.ServiceLogsTail = 10
+	e.Config.Docker.DisableServiceLogsTimestamps = true
+	options = e.getServiceLogsOptions()
+	assert.False(t, options.Timestamps)
+	assert.Equal(t, "10", options.Tail)
+
+	e.Config.Docker.ServiceLogsTail = -1
+	options = e.getServiceLogsOptions()
+	assert.Empty(t, options.Tail)
+
+	e.Config.Docker.ServiceLogsTail = 10
+	e.Build.Variables = common.BuildVariables{
+		{Key: "CI_DEBUG_TRACE", Value: "true"},
+	}
+	options = e.getServiceLogsOptions()
+	assert.Empty(t, options.Tail, "debug trace shows the whole log")
+}
+
+func TestGetServiceImageResolvesImageOnce(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+
+	c.On("ImageInspectWithRaw", context.TODO(), "postgres:latest").
+		Return(types.ImageInspect{ID: "postgres-image"}, nil, nil).
+		Once()
+
+	image, err := e.getServiceImage("postgres:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres-image", image.ID)
+
+	image, err = e.getServiceImage("postgres:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres-image", image.ID)
+}
+
+func TestValidatePidsLimit(t *testing.T) {
+	tests := []struct {
+		limit int64
+		valid bool
+	}{
+		{0, true},
+		{-1, true},
+		{100, true},
+		{-2, false},
+	}
+
+	for _, test := range tests {
+		err := validatePidsLimit("pids_limit", test.limit)
+		if test.valid {
+			assert.NoError(t, err, "pids_limit = %d", test.limit)
+		} else {
+			assert.Error(t, err, "pids_limit = %d", test.limit)
+		}
+	}
+}
+
+func TestDockerServicesOptionsDecoding(t *testing.T) {
+	buildOptions := common.BuildOptions{
+		"image": "alpine",
+		"services": []interface{}{
+			"postgres:9.6",
+			map[string]interface{}{
+				"name":               "sidecar:latest",
+				"no_readiness_check": true,
+			},
+		},
+	}
+
+	var options dockerOptions
+	err := buildOptions.Decode(&options)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(options.Services))
+	assert.Equal(t, dockerService{Name: "postgres:9.6"}, options.Services[0])
+	assert.Equal(t, dockerService{Name: "sidecar:latest", NoReadinessCheck: true}, options.Services[1])
+}
+
+func TestWaitForServicesSkipsServicesWithoutReadinessCheck(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{}
+	e.services = []*types.Container{fakeContainer("sidecar-id", "sidecar")}
+	e.serviceDefinitions = map[string]dockerService{
+		"sidecar-id": {Name: "sidecar", NoReadinessCheck: true},
+	}
+
+	e.waitForServices()
+}
+
+func TestGetServiceHealthCheckDiagnosis(t *testing.T) {
+	service := fakeContainer("service-id", "service")
+	running := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			State: &types.ContainerState{Running: true},
+		},
+	}
+	exited := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			State: &types.ContainerState{Running: false, ExitCode: 3},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		inspect   types.ContainerJSON
+		err       error
+		diagnosis string
+	}{
+		{"exited", exited, &serviceTimeoutError{}, "Service container exited with code 3."},
+		{"timeout", running, &serviceTimeoutError{}, "Service port never opened."},
+		{"no-port", running, &common.BuildError{Inner: &containerExitError{ExitCode: 1}}, "Service doesn't expose any TCP port that could be checked."},
+		{"unexpected", running, &common.BuildError{Inner: &containerExitError{ExitCode: 5}}, "Health-check probe failed unexpectedly with exit code 5."},
+		{"other", running, errors.New("other"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c docker_helpers.MockClient
+			defer c.AssertExpectations(t)
+
+			c.On("ContainerInspect", context.TODO(), "service-id").
+				Return(test.inspect, nil).
+				Once()
+
+			e := executor{client: &c}
+			assert.Equal(t, test.diagnosis, e.getServiceHealthCheckDiagnosis(service, test.err))
+		})
+	}
+}
+
+func TestVerifyImageDigest(t *testing.T) {
+	digest := "sha256:b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+	otherDigest := "sha256:7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"
+
+	tests := []struct {
+		imageName   string
+		repoDigests []string
+		valid       bool
+	}{
+		{"alpine", []string{"alpine@" + otherDigest}, true},
+		{"alpine:3.5", []string{"alpine@" + otherDigest}, true},
+		{"alpine@" + digest, []string{"alpine@" + digest}, true},
+		{"registry.domain.tld:5005/image@" + digest, []string{"registry.domain.tld:5005/image@" + digest}, true},
+		{"alpine@" + digest, []string{"alpine@" + otherDigest}, false},
+		{"alpine@" + digest, []string{}, false},
+	}
+
+	for _, test := range tests {
+		image := &types.ImageInspect{ID: "image-id", RepoDigests: test.repoDigests}
+		err := verifyImageDigest(test.imageName, image)
+		if test.valid {
+			assert.NoError(t, err, test.imageName)
+		} else {
+			assert.IsType(t, &common.BuildError{}, err, test.imageName)
+		}
+	}
+}
+
+func TestDockerPullTimeout(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{PullTimeout: 1}
+
+	c.On("ImagePullBlocking", mock.Anything, "stalled:latest", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(func(ctx context.Context, ref string, options types.ImagePullOptions, progress docker_helpers.PullProgressFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		Once()
+
+	image, err := e.pullDockerImage("stalled", nil)
+	require.Error(t, err)
+	assert.Nil(t, image)
+	assert.Contains(t, err.Error(), "timed out")
+	_, isBuildError := err.(*common.BuildError)
+	assert.False(t, isBuildError, "timeout should be retried as a system failure")
+}
+
+func TestCheckFastExit(t *testing.T) {
+	e := commandExecutor{}
+	e.Config.Docker = &common.DockerConfig{FastExitThreshold: 2}
+
+	assert.NoError(t, e.checkFastExit(3*time.Second, 0), "slow build")
+	assert.NoError(t, e.checkFastExit(time.Second, 1024), "build with output")
+	assert.NoError(t, e.checkFastExit(time.Second, 0), "only warns by default")
+
+	e.Config.Docker.FailOnFastExit = true
+	err := e.checkFastExit(time.Second, 0)
+	assert.IsType(t, &common.BuildError{}, err)
+}
+
+func TestGetLabelsContainBuildDeadline(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Timeout = 3600
+	e.Config.Docker = &common.DockerConfig{}
+
+	before := time.Now().UTC()
+	labels := e.getLabels("build")
+
+	assert.Equal(t, "3600", labels["com.gitlab.gitlab-runner.build.timeout"])
+
+	deadline, err := time.Parse(time.RFC3339, labels["com.gitlab.gitlab-runner.build.deadline"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(time.Hour), deadline, 2*time.Second)
+
+	assert.Equal(t, labels["com.gitlab.gitlab-runner.build.deadline"], e.getLabels("service")["com.gitlab.gitlab-runner.build.deadline"],
+		"all containers of the build share the deadline")
+}
+
+func TestGetLabelsWithContainerLabels(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		ContainerLabels: map[string]string{
+			"team":        "backend",
+			"cost-center": "42",
+		},
+	}
+
+	labels := e.getLabels("build", "service=mysql")
+	assert.Equal(t, "backend", labels["team"])
+	assert.Equal(t, "42", labels["cost-center"])
+	assert.Equal(t, "build", labels["com.gitlab.gitlab-runner.type"])
+	assert.Equal(t, "mysql", labels["com.gitlab.gitlab-runner.service"])
+}
+
+func TestValidateContainerLabels(t *testing.T) {
+	assert.NoError(t, validateContainerLabels(nil))
+	assert.NoError(t, validateContainerLabels(map[string]string{"team": "backend", "com.example.team": "backend"}))
+	assert.Error(t, validateContainerLabels(map[string]string{"com.gitlab.gitlab-runner.type": "build"}))
+	assert.Error(t, validateContainerLabels(map[string]string{"com.gitlab.owner": "me"}))
+}
+
+func TestAddCacheVolumeSkipsHostMountedPaths(t *testing.T) {
+	c := &docker_helpers.MockClient{}
+	defer c.AssertExpectations(t)
+
+	e := &executor{client: c}
+	e.Config.Docker = &common.DockerConfig{
+		Volumes: []string{"/cache", "/srv/cache:/cache"},
+	}
+
+	err := e.addCacheVolume("/cache/bundle", false)
+	assert.NoError(t, err)
+	assert.Empty(t, e.binds)
+	assert.Empty(t, e.volumesFrom)
+}
+
+func TestGetRegistryMirrorReference(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{RegistryMirror: "https://mirror.example.com:5000/"}
+
+	assert.Equal(t, "mirror.example.com:5000/library/ruby:2.1", e.getRegistryMirrorReference("ruby:2.1"))
+	assert.Equal(t, "mirror.example.com:5000/gitlab/gitlab-runner:latest", e.getRegistryMirrorReference("gitlab/gitlab-runner:latest"))
+	assert.Equal(t, "mirror.example.com:5000/library/alpine:3.5", e.getRegistryMirrorReference("docker.io/alpine:3.5"))
+	assert.Empty(t, e.getRegistryMirrorReference("registry.example.com/group/image:latest"))
+	assert.Empty(t, e.getRegistryMirrorReference("ruby@sha256:"+strings.Repeat("a", 64)))
+
+	e.Config.Docker.RegistryMirror = ""
+	assert.Empty(t, e.getRegistryMirrorReference("ruby:2.1"))
+}
+
+func TestDockerPullFromRegistryMirror(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{RegistryMirror: "mirror.example.com"}
+
+	c.On("ImagePullBlocking", context.TODO(), "mirror.example.com/library/ruby:2.1", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(nil).
+		Once()
+	c.On("ImageTag", context.TODO(), "mirror.example.com/library/ruby:2.1", "ruby:2.1").
+		Return(nil).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "ruby:2.1").
+		Return(types.ImageInspect{ID: "image-id"}, nil, nil).
+		Once()
+
+	image, err := e.pullDockerImage("ruby:2.1", nil)
+	assert.NoError(t, err)
+	require.NotNil(t, image)
+	assert.Equal(t, "image-id", image.ID)
+}
+
+func TestDockerPullFromRegistryMirrorFallback(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{RegistryMirror: "mirror.example.com"}
+
+	c.On("ImagePullBlocking", context.TODO(), "mirror.example.com/library/ruby:2.1", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(errors.New("connection refused")).
+		Twice()
+
+	_, err := e.pullDockerImage("ruby:2.1", nil)
+	assert.Error(t, err, "no fallback by default")
+
+	e.Config.Docker.RegistryMirrorFallback = true
+	c.On("ImagePullBlocking", context.TODO(), "ruby:2.1", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(nil).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "ruby:2.1").
+		Return(types.ImageInspect{ID: "image-id"}, nil, nil).
+		Once()
+
+	image, err := e.pullDockerImage("ruby:2.1", nil)
+	assert.NoError(t, err)
+	require.NotNil(t, image)
+}
+
+func TestDockerPullFromRegistryMirrorWithoutUpstreamAuth(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{RegistryMirror: "mirror.example.com", RegistryMirrorFallback: true}
+
+	upstreamAuth := &types.AuthConfig{Username: "user", Password: "password", ServerAddress: "https://index.docker.io/v1/"}
+	encodedUpstreamAuth, err := docker_helpers.EncodeAuthConfig(upstreamAuth)
+	require.NoError(t, err)
+
+	c.On("ImagePullBlocking", context.TODO(), "mirror.example.com/library/ruby:2.1", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(func(ctx context.Context, ref string, options types.ImagePullOptions, progress docker_helpers.PullProgressFunc) error {
+			assert.Empty(t, options.RegistryAuth, "the Docker Hub credentials are not sent to the mirror")
+			return errors.New("connection refused")
+		}).
+		Once()
+	c.On("ImagePullBlocking", context.TODO(), "ruby:2.1", mock.AnythingOfType("types.ImagePullOptions"), mock.Anything).
+		Return(func(ctx context.Context, ref string, options types.ImagePullOptions, progress docker_helpers.PullProgressFunc) error {
+			assert.Equal(t, encodedUpstreamAuth, options.RegistryAuth, "the fallback uses the Docker Hub credentials")
+			return nil
+		}).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "ruby:2.1").
+		Return(types.ImageInspect{ID: "image-id"}, nil, nil).
+		Once()
+
+	_, err = e.pullDockerImage("ruby:2.1", upstreamAuth)
+	assert.NoError(t, err)
+}
+
+func TestValidateImage(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	image := &types.ImageInspect{ID: "sha256:image-id"}
+
+	assert.NoError(t, e.validateImage("alpine", image), "no validation command configured")
+
+	e.Config.Docker.ImageValidationCommand = []string{"sh", "-c", `test "$1" = alpine -a "$2" = "$IMAGE_ID"`, "--"}
+	assert.NoError(t, e.validateImage("alpine", image))
+
+	err := e.validateImage("ruby", image)
+	assert.IsType(t, &common.BuildError{}, err, "rejected images fail the build")
+	assert.Contains(t, err.Error(), "rejected by the image validation policy")
+
+	e.Config.Docker.ImageValidationCommand = []string{"/non-existing/image-validator"}
+	err = e.validateImage("alpine", image)
+	assert.Error(t, err)
+	_, isBuildError := err.(*common.BuildError)
+	assert.False(t, isBuildError, "broken validation command is a system failure")
+}
+
+func TestMatchImagePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		image   string
+		matches bool
+	}{
+		{"ruby:*", "ruby:2.1", true},
+		{"ruby:*", "docker.io/library/ruby:2.1", true},
+		{"docker.io/library/*:*", "ruby:2.1", true},
+		{"index.docker.io/library/*:*", "ruby:2.1", true},
+		{"docker.io/*", "docker.io/ruby", true},
+		{"*/*:*", "coreos/etcd:v3", true},
+		{"*/*:*", "quay.io/coreos/etcd:v3", true},
+		{"*/*:*", "registry.example.com/app:1", true},
+		{"*/*:*", "ruby:2.1", true},
+		{"myregistry.com/*", "myregistry.com/image:latest", true},
+		{"myregistry.com/*", "evil.com/myregistry.com/image", false},
+		{"myregistry.com/*/*", "evil.com/myregistry.com/image", false},
+		{"*/myregistry.com/*", "evil.com/myregistry.com/image", true},
+		{"myregistry.com/*", "myregistry.com:5000/image", false},
+		{"myregistry.com:5000/*", "myregistry.com:5000/image:1.0", true},
+		{"myregistry.com:*/*", "myregistry.com:5000/image", true},
+		{"localhost:5000/*", "localhost:5000/image", true},
+		{"*.example.com/*", "registry.example.com/image", true},
+		{"*.example.com/*", "registry.example.com.evil.com/image", false},
+		{"*.example.com/*", "ruby", false},
+		{"*.example.com/*", "registry.example.com/team/image", false},
+		{"registry:5000/*", "registry:5000/image:1.0", true},
+		{"registry:5000/*", "registry:5001/image", false},
+		{"registry:5000/*", "evil.com/registry:5000/image", false},
+		{"ruby@sha256:*", "ruby@sha256:0123456789012345678901234567890123456789012345678901234567890123", true},
+		{"ruby:*", "ruby@sha256:0123456789012345678901234567890123456789012345678901234567890123", false},
+		{"myregistry.com/ruby*", "myregistry.com/ruby:2.1@sha256:0123456789012345678901234567890123456789012345678901234567890123", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.matches, matchImagePattern(test.pattern, test.image),
+			"pattern %q against image %q", test.pattern, test.image)
+	}
+}
+
+func TestVerifyAllowedImageWithDeniedImages(t *testing.T) {
+	e := executor{}
+
+	allowed := []string{"docker.io/*/*:*"}
+	denied := []string{"docker.io/library/*:latest"}
+
+	assert.NoError(t, e.verifyAllowedImage("docker.io/library/ruby:2.1", "images", allowed, denied, nil))
+	assert.Error(t, e.verifyAllowedImage("docker.io/library/ruby:latest", "images", allowed, denied, nil),
+		"denied images are rejected even when allowed")
+	assert.Error(t, e.verifyAllowedImage("quay.io/coreos/etcd:v3", "images", allowed, denied, nil))
+
+	assert.NoError(t, e.verifyAllowedImage("quay.io/coreos/etcd:v3", "images", nil, denied, nil),
+		"empty allow list allows everything which isn't denied")
+	assert.Error(t, e.verifyAllowedImage("docker.io/library/ruby:latest", "images", nil, denied, nil))
+}
+
+func TestGetImageNameFallbackToDefaultImage(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		Image:         "alpine",
+		AllowedImages: []string{"ruby:*"},
+	}
+	e.options.Image = "debian"
+
+	_, err := e.getImageName()
+	assert.Error(t, err, "disallowed images fail the build by default")
+
+	e.Config.Docker.FallbackToDefaultImageWhenDisallowed = true
+	image, err := e.getImageName()
+	assert.NoError(t, err)
+	assert.Equal(t, "alpine", image)
+
+	e.options.Image = "ruby:2.1"
+	image, err = e.getImageName()
+	assert.NoError(t, err)
+	assert.Equal(t, "ruby:2.1", image)
+}
+
+func TestPullBuildImageInBackground(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		Image:      "alpine",
+		PullPolicy: common.PullPolicyIfNotPresent,
+	}
+
+	c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+		Return(types.ImageInspect{ID: "image-id"}, nil, nil).
+		Once()
+
+	wait := e.pullBuildImageInBackground()
+	require.NoError(t, wait())
+
+	image, err := e.getDockerImage("alpine")
+	assert.NoError(t, err)
+	require.NotNil(t, image)
+	assert.Equal(t, "image-id", image.ID, "the pre-pulled image is used without inspecting it again")
+}
+
+func TestPullBuildImageInBackgroundError(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		Image:      "alpine",
+		PullPolicy: common.PullPolicyNever,
+	}
+
+	c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+		Return(types.ImageInspect{}, nil, os.ErrNotExist).
+		Once()
+
+	wait := e.pullBuildImageInBackground()
+	assert.Equal(t, os.ErrNotExist, wait())
+	assert.Empty(t, e.resolvedImages)
+}
+
+func TestPullImagesInBackground(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		Image:      "alpine",
+		Services:   []string{"mysql", "redis:3"},
+		PullPolicy: common.PullPolicyNever,
+	}
+
+	imageNames := e.getPrePulledImages()
+	assert.Equal(t, []string{"alpine", "mysql:latest", "redis:3"}, imageNames)
+
+	c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+		Return(types.ImageInspect{ID: "alpine-id"}, nil, nil).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "mysql:latest").
+		Return(types.ImageInspect{ID: "mysql-id"}, nil, nil).
+		Once()
+	c.On("ImageInspectWithRaw", context.TODO(), "redis:3").
+		Return(types.ImageInspect{}, nil, os.ErrNotExist).
+		Once()
+
+	wait := e.pullImagesInBackground(append(imageNames, "alpine"))
+
+	image, err := e.getDockerImage("mysql:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "mysql-id", image.ID, "the pending pull is used instead of inspecting the image again")
+
+	assert.Equal(t, os.ErrNotExist, wait(), "the pull errors are reported")
+	assert.Empty(t, e.pendingImages)
+
+	image, err = e.getDockerImage("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, "alpine-id", image.ID)
+}
+
+func TestGetPrePulledImagesWithDisallowedService(t *testing.T) {
+	trace := &bytes.Buffer{}
+
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.BuildLogger = common.NewBuildLogger(&common.Trace{Writer: trace}, logrus.WithFields(logrus.Fields{}))
+	e.Config.Docker = &common.DockerConfig{
+		Image:           "alpine",
+		Services:        []string{"mysql"},
+		AllowedServices: []string{"postgres:*"},
+	}
+
+	options := common.BuildOptions{
+		"services": []interface{}{"postgres:9.6", "redis:3"},
+	}
+	require.NoError(t, options.Decode(&e.options))
+
+	imageNames := e.getPrePulledImages()
+	assert.Equal(t, []string{"alpine", "mysql:latest", "postgres:9.6"}, imageNames, "the disallowed services are not pulled")
+	assert.Empty(t, trace.String(), "the disallowed services are reported only when they are created")
+
+	_, err := e.getServices()
+	assert.Error(t, err)
+	assert.Equal(t, 1, strings.Count(trace.String(), "redis:3 is not present on list of allowed services"))
+}
+
+func TestCleanupStaleCaches(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	containers := []types.Container{
+		{
+			ID:      "stale-cache",
+			Created: old,
+			Labels:  map[string]string{dockerLabelPrefix + ".type": "cache"},
+			Mounts:  []types.MountPoint{{Name: "stale-volume"}},
+		},
+		{
+			ID:      "recent-cache",
+			Created: time.Now().Unix(),
+			Labels:  map[string]string{dockerLabelPrefix + ".type": "cache"},
+			Mounts:  []types.MountPoint{{Name: "recent-volume"}},
+		},
+		{
+			ID:      "used-cache",
+			Created: old,
+			Labels:  map[string]string{dockerLabelPrefix + ".type": "cache"},
+			Mounts:  []types.MountPoint{{Name: "used-volume"}},
+		},
+		{
+			ID:      "running-build",
+			Created: old,
+			Labels:  map[string]string{dockerLabelPrefix + ".type": "build"},
+			Mounts:  []types.MountPoint{{Name: "used-volume"}},
+		},
+	}
+
+	c.On("ContainerList", mock.Anything, mock.AnythingOfType("types.ContainerListOptions")).
+		Return(containers, nil).
+		Once()
+	c.On("ContainerRemove", mock.Anything, "stale-cache", types.ContainerRemoveOptions{RemoveVolumes: true, Force: true}).
+		Return(nil).
+		Once()
+
+	err := e.cleanupStaleCaches(time.Hour)
+	assert.NoError(t, err)
+}
+
+func TestCleanupKeepsFailedContainers(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{KeepFailedContainers: 3600}
+	e.buildContainers = []*types.Container{fakeContainer("build-id", "runner-build")}
+	e.services = []*types.Container{fakeContainer("service-id", "runner-mysql")}
+	e.caches = []string{"cache-id"}
+	e.recordBuildFailure("/runner-build", &common.BuildError{Inner: &containerExitError{ExitCode: 2}})
+	assert.Equal(t, "runner-build exited with code 2", e.buildFailure)
+
+	expired := types.Container{ID: "expired-id", Names: []string{"/runner-build-failed-1500000000"}}
+	recent := types.Container{ID: "recent-id", Names: []string{"/runner-build-failed-" + strconv.FormatInt(time.Now().Unix(), 10)}}
+	c.On("ContainerList", mock.Anything, mock.AnythingOfType("types.ContainerListOptions")).
+		Return([]types.Container{expired, recent}, nil).
+		Once()
+	c.On("ContainerRemove", mock.Anything, "expired-id", types.ContainerRemoveOptions{RemoveVolumes: true, Force: true}).
+		Return(nil).
+		Once()
+
+	gracePeriod := defaultShutdownGracePeriod
+	c.On("ContainerStop", context.TODO(), "service-id", &gracePeriod).
+		Return(nil).
+		Once()
+	c.On("ContainerRename", context.TODO(), "build-id", mock.AnythingOfType("string")).
+		Return(func(ctx context.Context, id, name string) error {
+			assert.True(t, strings.HasPrefix(name, "runner-build-failed-"), name)
+			return nil
+		}).
+		Once()
+	c.On("ContainerRename", context.TODO(), "service-id", mock.AnythingOfType("string")).
+		Return(nil).
+		Once()
+	c.On("NetworkList", context.TODO(), types.NetworkListOptions{}).
+		Return([]types.NetworkResource{}, nil).
+		Once()
+	c.On("ContainerRemove", mock.Anything, "cache-id", mock.Anything).
+		Return(nil).
+		Once()
+	c.On("Close").
+		Return(nil).
+		Once()
+
+	e.Cleanup()
+}
+
+func TestGetContainerFailureTime(t *testing.T) {
+	failedAt, ok := getContainerFailureTime([]string{"/runner-build-failed-1500000000"})
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1500000000, 0), failedAt)
+
+	_, ok = getContainerFailureTime([]string{"/runner-build"})
+	assert.False(t, ok)
+	_, ok = getContainerFailureTime([]string{"/runner-build-failed-"})
+	assert.False(t, ok)
+}
+
+func TestCreateBuildVolumeResolvesSymlinkedCacheDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "docker-symlinked-cache-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	tempDir, err = filepath.EvalSymlinks(tempDir)
+	require.NoError(t, err)
+
+	targetDir := filepath.Join(tempDir, "target")
+	require.NoError(t, os.Mkdir(targetDir, 0700))
+	linkDir := filepath.Join(tempDir, "builds")
+	require.NoError(t, os.Symlink(targetDir, linkDir))
+
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.AllowGitFetch = true
+	e.Build.BuildDir = "/builds/group/project"
+	e.Config.Docker = &common.DockerConfig{CacheDir: linkDir}
+
+	err = e.createBuildVolume()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(e.binds))
+	assert.True(t, strings.HasPrefix(e.binds[0], targetDir+"/"+e.Build.ProjectUniqueName()+"/"), e.binds[0])
+	assert.True(t, strings.HasSuffix(e.binds[0], ":/builds/group"), e.binds[0])
+}
+
+func TestDockerServiceValidate(t *testing.T) {
+	tests := []struct {
+		service dockerService
+		valid   bool
+	}{
+		{dockerService{Name: "mysql"}, true},
+		{dockerService{Name: "mysql", Hostname: "db.example.com"}, true},
+		{dockerService{Name: "mysql", Hostname: "db-1"}, true},
+		{dockerService{Name: "mysql", Hostname: "-db"}, false},
+		{dockerService{Name: "mysql", Hostname: "DB"}, false},
+		{dockerService{Name: "mysql", Hostname: "db_1"}, false},
+		{dockerService{Name: "mysql", Hostname: strings.Repeat("a", 64)}, false},
+		{dockerService{Name: "mysql", NameSuffix: "replica.1"}, true},
+		{dockerService{Name: "mysql", NameSuffix: "replica/1"}, false},
+		{dockerService{Name: "mysql", MacAddress: "92:d0:c6:0a:29:33"}, true},
+		{dockerService{Name: "mysql", MacAddress: "92-d0-c6-0a-29-33"}, false},
+		{dockerService{Name: "mysql", IPAddress: "172.28.0.10"}, true},
+		{dockerService{Name: "mysql", IPAddress: "fd00:1234::10"}, true},
+		{dockerService{Name: "mysql", IPAddress: "172.28.0.256"}, false},
+		{dockerService{Name: "mysql", SecurityOpt: []string{"no-new-privileges", "seccomp=unconfined", "label:disable"}}, true},
+		{dockerService{Name: "mysql", SecurityOpt: []string{"=unconfined"}}, false},
+		{dockerService{Name: "mysql", SecurityOpt: []string{"seccomp="}}, false},
+		{dockerService{Name: "mysql", Volumes: []string{"/cache", "data"}}, true},
+		{dockerService{Name: "mysql", Volumes: []string{"/cache:/data"}}, false},
+		{dockerService{Name: "mysql", Volumes: []string{""}}, false},
+		{dockerService{Name: "mysql", Restart: "on-failure:2"}, true},
+		{dockerService{Name: "mysql", Restart: "always"}, false},
+		{dockerService{Name: "mysql", ConfigFiles: map[string]string{"/etc/mysql/conf.d/my.cnf": "$MY_CNF"}}, true},
+		{dockerService{Name: "mysql", ConfigFiles: map[string]string{"my.cnf": "$MY_CNF"}}, false},
+		{dockerService{Name: "mysql", ConfigFiles: map[string]string{"/": "$MY_CNF"}}, false},
+		{dockerService{Name: "mysql", ConfigFiles: map[string]string{"/etc/my.cnf:rw": "$MY_CNF"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.service.validate()
+		if test.valid {
+			assert.NoError(t, err, "%+v", test.service)
+		} else {
+			assert.Error(t, err, "%+v", test.service)
+		}
+	}
+}
+
+func TestVerifyServiceIPAddresses(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{
+		NetworkPerBuild: true,
+		IPv4Subnet:      "172.28.0.0/16",
+		IPv6Subnet:      "fd00:1234::/64",
+	}
+
+	assert.NoError(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "mysql"},
+		{Name: "redis", IPAddress: "172.28.0.10"},
+		{Name: "postgres", IPAddress: "fd00:1234::10"},
+	}))
+
+	assert.Error(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "redis", IPAddress: "172.29.0.10"},
+	}), "addresses outside of the subnet are rejected")
+
+	assert.Error(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "redis", IPAddress: "172.28.0.10"},
+		{Name: "mysql", IPAddress: "172.28.0.10"},
+	}), "addresses used twice are rejected")
+
+	assert.Error(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "redis", IPAddress: "fd00:1234::10"},
+		{Name: "mysql", IPAddress: "fd00:1234:0::10"},
+	}), "differently written addresses used twice are rejected")
+
+	e.Config.Docker.IPv6Subnet = ""
+	assert.Error(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "postgres", IPAddress: "fd00:1234::10"},
+	}), "addresses need the subnet to be configured")
+
+	e.Config.Docker = &common.DockerConfig{}
+	assert.Error(t, e.verifyServiceIPAddresses([]dockerService{
+		{Name: "redis", IPAddress: "172.28.0.10"},
+	}), "addresses need the per-build network")
+}
+
+func TestGetServiceNetworkingConfig(t *testing.T) {
+	e := executor{}
+	assert.Nil(t, e.getServiceNetworkingConfig(dockerService{Name: "redis", IPAddress: "172.28.0.10"}, []string{"redis"}),
+		"the default network uses links")
+
+	e.networkMode = "build-network"
+	config := e.getServiceNetworkingConfig(dockerService{Name: "redis"}, []string{"redis"})
+	require.NotNil(t, config)
+	require.NotNil(t, config.EndpointsConfig["build-network"])
+	assert.Equal(t, []string{"redis"}, config.EndpointsConfig["build-network"].Aliases)
+	assert.Nil(t, config.EndpointsConfig["build-network"].IPAMConfig)
+
+	config = e.getServiceNetworkingConfig(dockerService{Name: "redis", IPAddress: "172.28.0.10"}, []string{"redis"})
+	require.NotNil(t, config)
+	require.NotNil(t, config.EndpointsConfig["build-network"])
+	assert.Equal(t, &network.EndpointIPAMConfig{IPv4Address: "172.28.0.10"}, config.EndpointsConfig["build-network"].IPAMConfig)
+
+	config = e.getServiceNetworkingConfig(dockerService{Name: "redis", IPAddress: "fd00:1234::10"}, []string{"redis"})
+	require.NotNil(t, config)
+	require.NotNil(t, config.EndpointsConfig["build-network"])
+	assert.Equal(t, &network.EndpointIPAMConfig{IPv6Address: "fd00:1234::10"}, config.EndpointsConfig["build-network"].IPAMConfig)
+}
+
+func TestIsServicePrivileged(t *testing.T) {
+	enabled, disabled := true, false
+
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{Privileged: true}
+	assert.True(t, e.isServicePrivileged(dockerService{Name: "docker:dind"}), "the runner setting is used by default")
+	assert.True(t, e.isServicePrivileged(dockerService{Name: "docker:dind", Privileged: &enabled}))
+	assert.False(t, e.isServicePrivileged(dockerService{Name: "mysql", Privileged: &disabled}))
+
+	e.Config.Docker.Privileged = false
+	assert.False(t, e.isServicePrivileged(dockerService{Name: "mysql"}))
+	assert.False(t, e.isServicePrivileged(dockerService{Name: "docker:dind", Privileged: &enabled}),
+		"the service can't be more privileged than the runner allows")
+}
+
+func TestGetServicesWithPrivilegedService(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+
+	options := common.BuildOptions{
+		"services": []interface{}{
+			map[string]interface{}{"name": "docker:dind", "privileged": true},
+			map[string]interface{}{"name": "mysql", "privileged": false},
+		},
+	}
+	require.NoError(t, options.Decode(&e.options))
+
+	_, err := e.getServices()
+	assert.Error(t, err, "privileged services need the runner privileged mode")
+
+	e.Config.Docker.Privileged = true
+	services, err := e.getServices()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(services))
+	assert.True(t, e.isServicePrivileged(services[0]))
+	assert.False(t, e.isServicePrivileged(services[1]))
+}
+
+func TestVerifyServiceCapabilities(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{
+		ServicesCapAdd:        []string{"NET_RAW"},
+		AllowedServicesCapAdd: []string{"NET_ADMIN"},
+	}
+
+	assert.NoError(t, e.verifyServiceCapabilities(dockerService{Name: "vpn"}))
+	assert.NoError(t, e.verifyServiceCapabilities(dockerService{Name: "vpn", CapAdd: []string{"NET_ADMIN"}}))
+	assert.NoError(t, e.verifyServiceCapabilities(dockerService{Name: "vpn", CapAdd: []string{"cap_net_admin", "NET_RAW"}}))
+	assert.NoError(t, e.verifyServiceCapabilities(dockerService{Name: "vpn", CapDrop: []string{"ALL"}}),
+		"the capabilities can always be dropped")
+	assert.Error(t, e.verifyServiceCapabilities(dockerService{Name: "vpn", CapAdd: []string{"SYS_ADMIN"}}))
+	assert.Error(t, e.verifyServiceCapabilities(dockerService{Name: "vpn", CapAdd: []string{"ALL"}}))
+}
+
+func TestServiceSecurityOpt(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{
+		ServicesSecurityOpt:        []string{"apparmor=docker-default"},
+		AllowedServicesSecurityOpt: []string{"seccomp=unconfined"},
+	}
+
+	assert.Equal(t, []string{"apparmor=docker-default"}, e.getServiceSecurityOpt(dockerService{Name: "mysql"}))
+	assert.Equal(t, []string{"seccomp=unconfined"}, e.getServiceSecurityOpt(dockerService{Name: "mysql", SecurityOpt: []string{"seccomp=unconfined"}}),
+		"the options of the service replace the configured ones")
+	assert.Equal(t, []string{}, e.getServiceSecurityOpt(dockerService{Name: "mysql", SecurityOpt: []string{}}))
+
+	assert.NoError(t, e.verifyServiceSecurityOpt(dockerService{Name: "mysql"}))
+	assert.NoError(t, e.verifyServiceSecurityOpt(dockerService{Name: "mysql", SecurityOpt: []string{"seccomp=unconfined", "apparmor=docker-default"}}))
+	assert.Error(t, e.verifyServiceSecurityOpt(dockerService{Name: "mysql", SecurityOpt: []string{"apparmor=unconfined"}}))
+}
+
+func TestSetServiceVolumes(t *testing.T) {
+	e := executor{
+		binds:       []string{"/cache/project:/builds/group"},
+		volumesFrom: []string{"cache-id", "ro-cache-id:ro"},
+		volumePaths: map[string]string{"cache-id": "/cache", "ro-cache-id:ro": "/data"},
+		mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: "volume", Target: "/named"}},
+	}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		Volumes: []string{"/var/run/docker.sock:/var/run/docker.sock", "/host:/shared:ro", "/user-cache"},
+	}
+
+	hostConfig := &container.HostConfig{}
+	err := e.setServiceVolumes(hostConfig, dockerService{Name: "mysql"})
+	require.NoError(t, err)
+	assert.Equal(t, e.binds, hostConfig.Binds, "the build volume is shared by default")
+	assert.Equal(t, e.volumesFrom, hostConfig.VolumesFrom)
+	assert.Equal(t, e.mounts, hostConfig.Mounts)
+
+	hostConfig = &container.HostConfig{}
+	err = e.setServiceVolumes(hostConfig, dockerService{Name: "mysql", Volumes: []string{}})
+	require.NoError(t, err)
+	assert.Empty(t, hostConfig.Binds, "the service opts out of all volumes")
+	assert.Empty(t, hostConfig.VolumesFrom)
+	assert.Empty(t, hostConfig.Mounts)
+
+	hostConfig = &container.HostConfig{}
+	err = e.setServiceVolumes(hostConfig, dockerService{Name: "mysql", Volumes: []string{"/data", "/shared/", "/named"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/host:/shared:ro"}, hostConfig.Binds)
+	assert.Equal(t, []string{"ro-cache-id:ro"}, hostConfig.VolumesFrom)
+	assert.Equal(t, e.mounts, hostConfig.Mounts)
+
+	hostConfig = &container.HostConfig{}
+	err = e.setServiceVolumes(hostConfig, dockerService{Name: "mysql", Volumes: []string{"/user-cache"}})
+	assert.Error(t, err, "the cache volumes of the configuration are not created yet")
+
+	hostConfig = &container.HostConfig{}
+	err = e.setServiceVolumes(hostConfig, dockerService{Name: "mysql", Volumes: []string{"/etc"}})
+	assert.Error(t, err)
+}
+
+func TestCreateServiceWithHostnameAndNameSuffix(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.Config.Docker.DNSOptions = []string{"ndots:2"}
+	e.Config.Docker.ServicesCapAdd = []string{"NET_ADMIN"}
+	e.Config.Docker.ServicesCapDrop = []string{"SETUID"}
+	e.Config.Docker.ServicesSecurityOpt = []string{"apparmor=docker-default"}
+
+	containerName := e.Build.ProjectUniqueName() + "-mysql-replica"
+
+	c.On("ImageInspectWithRaw", context.TODO(), "mysql:latest").
+		Return(types.ImageInspect{ID: "mysql-image"}, nil, nil).
+		Once()
+	c.On("ContainerRemove", context.TODO(), containerName, mock.Anything).
+		Return(os.ErrNotExist).
+		Once()
+	c.On("NetworkList", context.TODO(), mock.Anything).
+		Return([]types.NetworkResource{}, nil).
+		Once()
+	c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, containerName).
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			assert.Equal(t, "db.example.com", config.Hostname)
+			assert.Equal(t, []string{"ndots:2"}, hostConfig.DNSOptions)
+			assert.Equal(t, strslice.StrSlice{"NET_ADMIN", "SYS_TIME"}, hostConfig.CapAdd)
+			assert.Equal(t, strslice.StrSlice{"SETUID", "MKNOD"}, hostConfig.CapDrop)
+			assert.Equal(t, []string{"apparmor=docker-default"}, hostConfig.SecurityOpt)
+			return container.ContainerCreateCreatedBody{ID: "replica"}
+		}, nil).
+		Once()
+	c.On("ContainerStart", context.TODO(), "replica", mock.Anything).
+		Return(nil).
+		Once()
+
+	linksMap := map[string]*types.Container{"mysql": fakeContainer("primary")}
+	definition := dockerService{Name: "mysql", Hostname: "db.example.com", NameSuffix: "replica",
+		CapAdd: []string{"SYS_TIME"}, CapDrop: []string{"MKNOD"}}
+	err := e.createFromServiceDescription(definition, linksMap)
+	require.NoError(t, err)
+
+	assert.Equal(t, "primary", linksMap["mysql"].ID)
+	assert.Equal(t, "replica", linksMap["mysql-replica"].ID)
+	assert.Equal(t, "replica", linksMap["db.example.com"].ID)
+}
+
+func TestCreateServiceWithConfigFiles(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	scriptsDir, err := ioutil.TempDir("", "docker-executor-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(scriptsDir)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Variables = common.BuildVariables{{Key: "NGINX_CONF", Value: "server {}"}}
+	e.Config.Docker = &common.DockerConfig{ScriptsDir: scriptsDir}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.binds = []string{"/cache:/cache"}
+
+	var binds []string
+	c.On("ImageInspectWithRaw", context.TODO(), "nginx:latest").
+		Return(types.ImageInspect{ID: "nginx-image"}, nil, nil).
+		Once()
+	c.On("ContainerRemove", context.TODO(), mock.Anything, mock.Anything).
+		Return(os.ErrNotExist).
+		Once()
+	c.On("NetworkList", context.TODO(), mock.Anything).
+		Return([]types.NetworkResource{}, nil).
+		Once()
+	c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, mock.Anything).
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			binds = hostConfig.Binds
+			return container.ContainerCreateCreatedBody{ID: "nginx"}
+		}, nil).
+		Once()
+	c.On("ContainerStart", context.TODO(), "nginx", mock.Anything).
+		Return(nil).
+		Once()
+
+	definition := dockerService{Name: "nginx", ConfigFiles: map[string]string{
+		"/etc/nginx/nginx.conf": "$NGINX_CONF",
+		"/etc/ssl/certs/ca.crt": "certificate",
+		"/etc/nginx/ssl/ca.crt": "other certificate",
+	}}
+	_, err = e.createService(definition, "nginx", "latest", "nginx:latest", []string{"nginx"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/cache:/cache"}, e.binds, "the binds of the build are not changed")
+	require.Equal(t, 4, len(binds))
+	assert.Equal(t, "/cache:/cache", binds[0])
+
+	expected := map[string]string{
+		"/etc/nginx/nginx.conf": "server {}",
+		"/etc/ssl/certs/ca.crt": "certificate",
+		"/etc/nginx/ssl/ca.crt": "other certificate",
+	}
+	for _, bind := range binds[1:] {
+		parts := strings.Split(bind, ":")
+		require.Equal(t, 3, len(parts), bind)
+		assert.Equal(t, "ro", parts[2])
+		assert.True(t, strings.HasPrefix(parts[0], filepath.ToSlash(e.serviceFilesDir)+"/"), bind)
+
+		content, err := ioutil.ReadFile(parts[0])
+		require.NoError(t, err)
+		assert.Equal(t, expected[parts[1]], string(content), parts[1])
+
+		info, err := os.Stat(parts[0])
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "the files are readable by the non-root users of the service")
+	}
+
+	c.On("Close").
+		Return(nil).
+		Once()
+
+	e.Cleanup()
+	_, err = os.Stat(e.serviceFilesDir)
+	assert.True(t, os.IsNotExist(err), "the config files are removed in Cleanup")
+}
+
+func TestCreateServiceWithConfigFilesOnRemoteDaemon(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+	e.Config.Docker.Host = "tcp://docker.example.com:2376"
+
+	hostConfig := &container.HostConfig{}
+	definition := dockerService{Name: "nginx", ConfigFiles: map[string]string{"/etc/nginx/nginx.conf": "server {}"}}
+	err := e.addServiceConfigFiles(hostConfig, definition, "nginx")
+	assert.IsType(t, &common.BuildError{}, err)
+	assert.Empty(t, e.serviceFilesDir, "nothing is written for a remote daemon")
+	assert.Empty(t, hostConfig.Binds)
+}
+
+func TestIsLocalDockerDaemon(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+
+	for host, local := range map[string]bool{
+		"unix:///var/run/docker.sock":    true,
+		"npipe:////./pipe/docker_engine": true,
+		"tcp://127.0.0.1:2375":           true,
+		"tcp://localhost:2376":           true,
+		"tcp://docker.example.com:2376":  false,
+		"tcp://192.168.99.100:2376":      false,
+	} {
+		e.Config.Docker.Host = host
+		assert.Equal(t, local, e.isLocalDockerDaemon(), host)
+	}
+}
+
+func TestAddCacheVolumeWithNamedVolumes(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{NamedCacheVolumes: true, VolumeDriver: "local"}
+	e.info.ServerVersion = "17.03.0-ce"
+
+	c.On("VolumeCreate", context.TODO(), mock.AnythingOfType("volume.VolumesCreateBody")).
+		Return(func(ctx context.Context, options volume.VolumesCreateBody) types.Volume {
+			assert.True(t, strings.HasPrefix(options.Name, e.Build.ProjectUniqueName()+"-cache-"))
+			assert.Equal(t, "local", options.Driver)
+			assert.Equal(t, "cache", options.Labels[dockerLabelPrefix+".type"])
+			return types.Volume{Name: options.Name}
+		}, nil).
+		Once()
+
+	err := e.addCacheVolume("/cache", false)
+	require.NoError(t, err)
+	assert.Empty(t, e.volumesFrom)
+	require.Equal(t, 1, len(e.mounts))
+	assert.Equal(t, mount.TypeVolume, e.mounts[0].Type)
+	assert.Equal(t, "/cache", e.mounts[0].Target)
+}
+
+func TestSupportsNamedVolumeMounts(t *testing.T) {
+	tests := map[string]bool{
+		"1.12.6":     false,
+		"1.13.0":     true,
+		"17.03.0-ce": true,
+		"":           false,
+	}
+
+	for version, supported := range tests {
+		e := executor{}
+		e.info.ServerVersion = version
+		assert.Equal(t, supported, e.supportsNamedVolumeMounts(), version)
+	}
+}
+
+func TestWarnAboutDeprecatedLinks(t *testing.T) {
+	trace := &bytes.Buffer{}
+
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	e.BuildLogger = common.NewBuildLogger(&common.Trace{Writer: trace}, logrus.WithFields(logrus.Fields{}))
+
+	e.version.APIVersion = "1.20"
+	e.links = []string{"mysql:mysql"}
+	e.warnAboutDeprecatedLinks()
+	assert.Empty(t, trace.String(), "links are not deprecated yet")
+
+	e.version.APIVersion = "1.26"
+	e.Config.Docker.DisableLinksDeprecationWarning = true
+	e.warnAboutDeprecatedLinks()
+	assert.Empty(t, trace.String(), "warning is disabled")
+
+	e.Config.Docker.DisableLinksDeprecationWarning = false
+	e.warnAboutDeprecatedLinks()
+	assert.Contains(t, trace.String(), "legacy feature")
+}
+
+func TestParseVolume(t *testing.T) {
+	tests := []struct {
+		volume        string
+		hostPath      string
+		containerPath string
+		options       []string
+		err           string
+	}{
+		{volume: "/cache", containerPath: "/cache"},
+		{volume: "/cache:ro", containerPath: "/cache", options: []string{"ro"}},
+		{volume: "/host:/container", hostPath: "/host", containerPath: "/container"},
+		{volume: "/host:relative", hostPath: "/host", containerPath: "relative"},
+		{volume: "/host:/container:ro,z", hostPath: "/host", containerPath: "/container", options: []string{"ro", "z"}},
+		{volume: "/host:/container:nocopy", hostPath: "/host", containerPath: "/container", options: []string{"nocopy"}},
+		{volume: "/host:/container:rx", err: `unknown option "rx"`},
+		{volume: "/cache:z", err: "not supported for cache volumes"},
+		{volume: "/a:/b:ro:z", err: "invalid volume specification"},
+	}
+
+	for _, test := range tests {
+		hostPath, containerPath, options, err := parseVolume(test.volume)
+		if test.err != "" {
+			if assert.Error(t, err, test.volume) {
+				assert.Contains(t, err.Error(), test.err, test.volume)
+			}
+			continue
+		}
+
+		assert.NoError(t, err, test.volume)
+		assert.Equal(t, test.hostPath, hostPath, test.volume)
+		assert.Equal(t, test.containerPath, containerPath, test.volume)
+		assert.Equal(t, test.options, options, test.volume)
+	}
+}
+
+func TestAddVolumeWithOptions(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{CacheDir: "/srv/cache"}
+
+	require.NoError(t, e.addVolume("/etc/ssl/certs:/etc/ssl/certs:ro,z"))
+	require.NoError(t, e.addVolume("/cache:ro"))
+
+	require.Equal(t, 2, len(e.binds))
+	assert.Equal(t, "/etc/ssl/certs:/etc/ssl/certs:ro,z", e.binds[0])
+	assert.True(t, strings.HasSuffix(e.binds[1], ":/cache:ro"), e.binds[1])
+}
+
+func TestAddVolumeDeduplicatesBinds(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{
+		CacheDir: "/srv/cache",
+		Volumes:  []string{"/data:/data"},
+	}
+
+	require.NoError(t, e.addVolume("/data:/data"))
+	require.NoError(t, e.addVolume("/data:/data/"), "the same mount with a trailing slash")
+	require.NoError(t, e.addVolume("/other:/data/nested"), "nested mounts are allowed")
+	require.NoError(t, e.addVolume("/data/cache"), "the cache path is already mounted from the host")
+	assert.Equal(t, []string{"/data:/data", "/other:/data/nested"}, e.binds)
+
+	err := e.addVolume("/srv/data:/data")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `volumes "/data:/data" and "/srv/data:/data" are both mounted at /data`)
+
+	err = e.addVolume("/data:/data:ro")
+	assert.Error(t, err, "the same path with other options")
+
+	require.NoError(t, e.addVolume("/cache"))
+	require.NoError(t, e.addVolume("/cache"))
+	require.Equal(t, 3, len(e.binds))
+	assert.True(t, strings.HasSuffix(e.binds[2], ":/cache"), e.binds[2])
+}
+
+func TestAddVolumeWithRelativeHostPath(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{VolumesBaseDir: "/srv/runner"}
+
+	require.NoError(t, e.addVolume("./certs:/etc/ssl/certs:ro"))
+	require.NoError(t, e.addVolume("../shared/data:/data"))
+	require.NoError(t, e.addVolume("/etc/hosts:/etc/hosts"))
+	require.NoError(t, e.addVolume("named-volume:/named"))
+	assert.Equal(t, []string{
+		"/srv/runner/certs:/etc/ssl/certs:ro",
+		"/srv/shared/data:/data",
+		"/etc/hosts:/etc/hosts",
+		"named-volume:/named",
+	}, e.binds)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	e.Config.Docker.VolumesBaseDir = ""
+	hostPath, err := e.getAbsoluteHostPath("tmp/data")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(wd, "tmp/data"), hostPath)
+}
+
+func TestPrepareScriptFile(t *testing.T) {
+	scriptsDir, err := ioutil.TempDir("", "scripts")
+	require.NoError(t, err)
+	defer os.RemoveAll(scriptsDir)
+
+	e := &commandExecutor{}
+	e.Config.Docker = &common.DockerConfig{ScriptsDir: scriptsDir}
+	e.BuildShell = &common.ShellConfiguration{
+		DockerCommand: []string{"sh", "-c", "detect"},
+	}
+
+	command, err := e.prepareScriptFile()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sh", "-c", "exec < /gitlab-runner-scripts/script\ndetect"}, command)
+	require.Equal(t, 1, len(e.buildBinds))
+	assert.Equal(t, e.scriptsDir+"/scripts:/gitlab-runner-scripts:ro", e.buildBinds[0])
+
+	require.NoError(t, e.writeScriptFile("echo test"))
+	data, err := ioutil.ReadFile(filepath.Join(e.scriptsDir, "scripts", "script"))
+	require.NoError(t, err)
+	assert.Equal(t, "echo test", string(data))
+
+	e.Cleanup()
+	_, err = os.Stat(e.scriptsDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrepareScriptFileWithNonRootUser(t *testing.T) {
+	scriptsDir, err := ioutil.TempDir("", "scripts")
+	require.NoError(t, err)
+	defer os.RemoveAll(scriptsDir)
+
+	e := &commandExecutor{}
+	e.Config.Docker = &common.DockerConfig{ScriptsDir: scriptsDir, User: "1000:1000"}
+	e.BuildShell = &common.ShellConfiguration{
+		DockerCommand: []string{"sh", "-c", "detect"},
+	}
+
+	_, err = e.prepareScriptFile()
+	require.NoError(t, err)
+	require.NoError(t, e.writeScriptFile("echo test"))
+
+	info, err := os.Stat(e.scriptsDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "the scripts can't be reached by the other users of the host")
+
+	info, err = os.Stat(filepath.Join(e.scriptsDir, "scripts"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), "the mounted directory can be listed by the user of the container")
+
+	info, err = os.Stat(filepath.Join(e.scriptsDir, "scripts", "script"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "the script can be read by the user of the container")
+
+	e.Cleanup()
+	_, err = os.Stat(e.scriptsDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrepareScriptFileForPassFileShell(t *testing.T) {
+	e := &commandExecutor{}
+	e.Config.Docker = &common.DockerConfig{}
+	e.BuildShell = &common.ShellConfiguration{
+		Command:   "powershell",
+		Arguments: []string{"-File"},
+		Extension: "ps1",
+		PassFile:  true,
+	}
+
+	command, err := e.prepareScriptFile()
+	require.NoError(t, err)
+	defer os.RemoveAll(e.scriptsDir)
+	assert.Equal(t, []string{"powershell", "-File", "/gitlab-runner-scripts/script.ps1"}, command)
+}
+
+func TestCreateBuildVolumeDisabled(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.BuildDir = "/builds/group/project"
+	e.BuildShell = &common.ShellConfiguration{}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.Config.Docker.DisableBuildVolume = true
+
+	err := e.createBuildVolume()
+	require.NoError(t, err)
+	assert.Empty(t, e.caches)
+	assert.Empty(t, e.volumesFrom)
+	assert.Equal(t, "/builds/group", e.buildVolumeDir)
+
+	c.On("ImageInspectWithRaw", context.TODO(), "helper-image").
+		Return(types.ImageInspect{ID: "helper-image"}, nil, nil).
+		Once()
+	c.On("ContainerRemove", context.TODO(), mock.Anything, mock.Anything).
+		Return(os.ErrNotExist).
+		Once()
+	c.On("NetworkList", context.TODO(), mock.Anything).
+		Return([]types.NetworkResource{}, nil).
+		Once()
+	c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, mock.Anything).
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			assert.Equal(t, map[string]struct{}{"/builds/group": {}}, config.Volumes)
+			return container.ContainerCreateCreatedBody{ID: "predefined"}
+		}, nil).
+		Once()
+	c.On("ContainerInspect", context.TODO(), "predefined").
+		Return(types.ContainerJSON{}, nil).
+		Once()
+
+	_, err = e.createContainer("predefined", "helper-image", []string{"gitlab-runner-build"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"predefined"}, e.volumesFrom)
+}
+
+func TestCreateCacheVolumeWithVolumeDriver(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.Config.Docker.VolumeDriver = "rexray"
+	e.Config.Docker.VolumeDriverOpts = map[string]string{"size": "10"}
+
+	c.On("ImageInspectWithRaw", context.TODO(), mock.Anything).
+		Return(types.ImageInspect{ID: "helper-image"}, nil, nil).
+		Once()
+	c.On("VolumeCreate", context.TODO(), mock.AnythingOfType("volume.VolumesCreateBody")).
+		Return(func(ctx context.Context, options volume.VolumesCreateBody) types.Volume {
+			assert.Empty(t, options.Name)
+			assert.Equal(t, "rexray", options.Driver)
+			assert.Equal(t, map[string]string{"size": "10"}, options.DriverOpts)
+			return types.Volume{Name: "generated"}
+		}, nil).
+		Once()
+	c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, "").
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			assert.Empty(t, config.Volumes)
+			assert.Equal(t, "rexray", hostConfig.VolumeDriver)
+			assert.Equal(t, []string{"generated:/builds/group"}, hostConfig.Binds)
+			return container.ContainerCreateCreatedBody{ID: "cache"}
+		}, nil).
+		Once()
+	c.On("ContainerStart", context.TODO(), "cache", mock.Anything).
+		Return(nil).
+		Once()
+	c.On("ContainerInspect", context.TODO(), "cache").
+		Return(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{}}}, nil).
+		Once()
+
+	id, err := e.createCacheVolume("", "/builds/group")
+	require.NoError(t, err)
+	assert.Equal(t, "cache", id)
+	assert.Equal(t, []string{"generated"}, e.volumes)
+
+	c.On("VolumeRemove", context.TODO(), "generated", true).
+		Return(nil).
+		Once()
+	c.On("Close").
+		Return(nil).
+		Once()
+
+	e.Cleanup()
+}
+
+func TestCreateCacheVolumeWithCacheImage(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.setPolicyMode(common.PullPolicyIfNotPresent)
+	e.Config.Docker.CacheImage = "registry.example.com/minimal"
+
+	c.On("ImageInspectWithRaw", context.TODO(), "registry.example.com/minimal").
+		Return(types.ImageInspect{ID: "minimal-image"}, nil, nil).
+		Once()
+	c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, "").
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			assert.Equal(t, "minimal-image", config.Image)
+			assert.Equal(t, []string{"gitlab-runner-cache", "/cache"}, []string(config.Cmd))
+			return container.ContainerCreateCreatedBody{ID: "cache"}
+		}, nil).
+		Once()
+	c.On("ContainerStart", context.TODO(), "cache", mock.Anything).
+		Return(errors.New(`exec: "gitlab-runner-cache": executable file not found in $PATH`)).
+		Once()
+
+	_, err := e.createCacheVolume("", "/cache")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `cache_image "registry.example.com/minimal" needs to provide the gitlab-runner-cache command`)
+	assert.Equal(t, []string{"cache"}, e.failures)
+}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string  { return "no such container" }
+func (notFoundError) NotFound() bool { return true }
+
+func TestInspectCreatedContainerRetries(t *testing.T) {
+	defer func(interval time.Duration) {
+		containerInspectRetryInterval = interval
+	}(containerInspectRetryInterval)
+	containerInspectRetryInterval = time.Millisecond
+
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{ContainerInspectRetries: 2}
+
+	c.On("ContainerInspect", context.TODO(), "transient").
+		Return(types.ContainerJSON{}, errors.New("daemon is busy")).
+		Twice()
+	c.On("ContainerInspect", context.TODO(), "transient").
+		Return(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "transient"}}, nil).
+		Once()
+
+	inspect, err := e.inspectCreatedContainer("transient")
+	require.NoError(t, err)
+	assert.Equal(t, "transient", inspect.ID)
+
+	c.On("ContainerInspect", context.TODO(), "failing").
+		Return(types.ContainerJSON{}, errors.New("daemon is busy")).
+		Times(3)
+
+	_, err = e.inspectCreatedContainer("failing")
+	assert.Error(t, err)
+
+	c.On("ContainerInspect", context.TODO(), "removed").
+		Return(types.ContainerJSON{}, notFoundError{}).
+		Once()
+
+	_, err = e.inspectCreatedContainer("removed")
+	assert.Error(t, err)
+}
+
+func TestGetExtraHostsWithHostGateway(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.version.APIVersion = "1.40"
+
+	bridge := types.NetworkResource{
+		IPAM: network.IPAM{
+			Config: []network.IPAMConfig{{Subnet: "fd00::/64", Gateway: "fd00::1"}, {Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"}},
+		},
+	}
+	c.On("NetworkInspect", context.TODO(), "bridge").
+		Return(bridge, nil).
+		Once()
+
+	hosts, err := e.getExtraHosts([]string{"host.docker.internal:host-gateway", "other:10.0.0.1", "callback:host-gateway"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.docker.internal:172.17.0.1", "other:10.0.0.1", "callback:172.17.0.1"}, hosts,
+		"the gateway is resolved once")
+
+	e.version.APIVersion = "1.41"
+	hosts, err = e.getExtraHosts([]string{"host.docker.internal:host-gateway"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.docker.internal:host-gateway"}, hosts, "the daemon translates host-gateway itself")
+
+	e = executor{client: &c}
+	e.version.APIVersion = "1.40"
+	c.On("NetworkInspect", context.TODO(), "bridge").
+		Return(types.NetworkResource{}, nil).
+		Once()
+	_, err = e.getExtraHosts([]string{"host.docker.internal:host-gateway"})
+	assert.Error(t, err)
+}
+
+func TestGetServiceExtraHosts(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{
+		ExtraHosts: []string{"build-host:127.0.0.1"},
+	}
+	assert.Equal(t, []string{"build-host:127.0.0.1"}, e.getServiceExtraHosts())
+
+	e.Config.Docker.ServicesExtraHosts = []string{"service-host:10.0.0.1"}
+	assert.Equal(t, []string{"service-host:10.0.0.1"}, e.getServiceExtraHosts())
+}
+
+func TestShutdownContainers(t *testing.T) {
+	tests := []struct {
+		policy common.DockerShutdownPolicy
+		method string
+	}{
+		{"", "ContainerKill"},
+		{common.ShutdownPolicyKill, "ContainerKill"},
+		{common.ShutdownPolicyStop, "ContainerStop"},
+	}
+
+	for _, test := range tests {
+		var c docker_helpers.MockClient
+
+		e := executor{client: &c}
+		e.Build = &common.Build{
+			Runner: &common.RunnerConfig{},
+		}
+		e.Build.ID = 1234
+		e.Config.Docker = &common.DockerConfig{ShutdownPolicy: test.policy}
+
+		c.On("ContainerList", context.TODO(), mock.AnythingOfType("types.ContainerListOptions")).
+			Return(func(ctx context.Context, options types.ContainerListOptions) []types.Container {
+				assert.True(t, options.Filters.ExactMatch("label", dockerLabelPrefix+".build.id=1234"))
+				return []types.Container{{ID: "build"}, {ID: "service"}}
+			}, nil).
+			Once()
+		if test.method == "ContainerStop" {
+			gracePeriod := defaultShutdownGracePeriod
+			c.On("ContainerStop", context.TODO(), "build", &gracePeriod).Return(nil).Once()
+			c.On("ContainerStop", context.TODO(), "service", &gracePeriod).Return(nil).Once()
+		} else {
+			c.On("ContainerKill", context.TODO(), "build", "SIGKILL").Return(nil).Once()
+			c.On("ContainerKill", context.TODO(), "service", "SIGKILL").Return(nil).Once()
+		}
+
+		e.shutdownContainers()
+		assert.False(t, e.detached)
+		c.AssertExpectations(t)
+	}
+}
+
+func TestShutdownContainersDetach(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{ShutdownPolicy: common.ShutdownPolicyDetach}
+	e.builds = []*types.Container{fakeContainer("build")}
+
+	e.shutdownContainers()
+	assert.True(t, e.detached)
+
+	c.On("Close").Return(nil).Once()
+	e.Cleanup()
+}
+
+func TestIsMutableImageReference(t *testing.T) {
+	image := &types.ImageInspect{ID: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}
+
+	assert.True(t, isMutableImageReference("alpine", image))
+	assert.True(t, isMutableImageReference("alpine:latest", image))
+	assert.True(t, isMutableImageReference("registry.example.com/group/image:master", image))
+	assert.False(t, isMutableImageReference("alpine@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", image))
+	assert.False(t, isMutableImageReference(image.ID, image))
+}
+
+func TestCheckImageReference(t *testing.T) {
+	trace := &bytes.Buffer{}
+	image := &types.ImageInspect{ID: "alpine-id", RepoDigests: []string{"alpine@sha256:1234"}}
+
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+	e.BuildLogger = common.NewBuildLogger(&common.Trace{Writer: trace}, logrus.WithFields(logrus.Fields{}))
+
+	assert.NoError(t, e.checkImageReference("alpine:latest", image))
+	assert.Empty(t, trace.String())
+
+	e.Config.Docker.WarnMutableImageTags = true
+	assert.NoError(t, e.checkImageReference("alpine:latest", image))
+	assert.Contains(t, trace.String(), "alpine@sha256:1234")
+
+	e.Config.Docker.RequireImageDigest = true
+	err := e.checkImageReference("alpine:latest", image)
+	assert.IsType(t, &common.BuildError{}, err)
+}
+
+func TestGetServiceVariables(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Variables = common.BuildVariables{
+		{Key: "PUBLIC", Value: "public", Public: true},
+		{Key: "SECRET", Value: "secret"},
+	}
+
+	variables := e.getServiceVariables(dockerService{Name: "mysql"})
+	assert.Contains(t, variables, "PUBLIC=public")
+	assert.Contains(t, variables, "CI=true")
+	assert.NotContains(t, variables, "SECRET=secret")
+
+	variables = e.getServiceVariables(dockerService{
+		Name:      "mysql",
+		Variables: map[string]string{"MYSQL_DATABASE": "test", "MYSQL_PASSWORD": "$SECRET"},
+	})
+	assert.Contains(t, variables, "CI=true")
+	assert.Contains(t, variables, "MYSQL_DATABASE=test")
+	assert.Contains(t, variables, "MYSQL_PASSWORD=secret")
+	assert.Contains(t, variables, "PUBLIC=public", "the public variables are exposed as without variables")
+	assert.NotContains(t, variables, "SECRET=secret")
+
+	variables = e.getServiceVariables(dockerService{
+		Name:      "mysql",
+		Variables: map[string]string{"PUBLIC": "overridden"},
+	})
+	assert.Equal(t, "PUBLIC=overridden", variables[len(variables)-1], "the declared variables override the public ones")
+}
+
+func TestServiceHealthCheckContainerWithUnresponsiveDaemon(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+	e.info = types.Info{OSType: "linux", Architecture: "x86_64"}
+	helperImage, _ := e.getPrebuiltImageReference(e.getPlatform())
+	e.addResolvedImage(helperImage, &types.ImageInspect{ID: "helper-image"})
+
+	c.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "/mysql-wait-for-service").
+		Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline, "the creation is bounded")
+			return container.ContainerCreateCreatedBody{ID: "wait-id"}
+		}, nil).
+		Once()
+	c.On("ContainerStart", mock.Anything, "wait-id", mock.Anything).
+		Return(func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			// the daemon doesn't respond
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		Once()
+	c.On("NetworkList", mock.Anything, mock.Anything).
+		Return([]types.NetworkResource{}, nil).
+		Once()
+	c.On("ContainerRemove", mock.Anything, "wait-id", mock.Anything).
+		Return(func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			assert.NoError(t, ctx.Err(), "the removal has its own context")
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline, "the removal is bounded")
+			return nil
+		}).
+		Once()
+
+	service := &types.Container{ID: "mysql-id", Names: []string{"/mysql"}}
+	err := e.runServiceHealthCheckContainer(service, 50*time.Millisecond)
+	assert.IsType(t, &serviceTimeoutError{}, err)
+}
+
+func TestWaitForServicePorts(t *testing.T) {
+	defer func(interval time.Duration) {
+		serviceDialInterval = interval
+	}(serviceDialInterval)
+	serviceDialInterval = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, openPort, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, closedPort, err := net.SplitHostPort(closedListener.Addr().String())
+	require.NoError(t, err)
+	closedListener.Close()
+
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{}
+
+	inspect := func(ports ...string) types.ContainerJSON {
+		exposedPorts := nat.PortSet{}
+		for _, port := range ports {
+			exposedPorts[nat.Port(port+"/tcp")] = struct{}{}
+		}
+		return types.ContainerJSON{
+			Config: &container.Config{ExposedPorts: exposedPorts},
+			NetworkSettings: &types.NetworkSettings{
+				DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: "127.0.0.1"},
+			},
+		}
+	}
+
+	c.On("ContainerInspect", context.TODO(), "open").
+		Return(inspect(openPort), nil).
+		Once()
+	err = e.waitForServicePorts(fakeContainer("open", "open-service"), time.Second)
+	assert.NoError(t, err)
+
+	c.On("ContainerInspect", context.TODO(), "closed").
+		Return(inspect(openPort, closedPort), nil).
+		Once()
+	err = e.waitForServicePorts(fakeContainer("closed", "closed-service"), 50*time.Millisecond)
+	require.Error(t, err)
+	if portsErr, ok := err.(*servicePortsError); assert.True(t, ok) {
+		assert.Equal(t, []string{closedPort}, portsErr.ports)
+	}
+}
+
+func TestWaitForServiceHealth(t *testing.T) {
+	defer func(interval time.Duration) {
+		serviceDialInterval = interval
+	}(serviceDialInterval)
+	serviceDialInterval = time.Millisecond
+
+	inspect := func(healthcheck []string, health *types.Health) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{Running: true, Health: health},
+			},
+			Config: &container.Config{Healthcheck: &container.HealthConfig{Test: healthcheck}},
+		}
+	}
+
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{}
+
+	c.On("ContainerInspect", context.TODO(), "no-healthcheck").
+		Return(inspect([]string{"NONE"}, nil), nil).
+		Once()
+	checked, err := e.waitForServiceHealth(fakeContainer("no-healthcheck", "service"), time.Second)
+	assert.False(t, checked)
+	assert.NoError(t, err)
+
+	check := []string{"CMD-SHELL", "pg_isready"}
+	c.On("ContainerInspect", context.TODO(), "healthy").
+		Return(inspect(check, &types.Health{Status: types.Starting}), nil).
+		Once()
+	c.On("ContainerInspect", context.TODO(), "healthy").
+		Return(inspect(check, &types.Health{Status: types.Healthy}), nil).
+		Once()
+	checked, err = e.waitForServiceHealth(fakeContainer("healthy", "service"), time.Second)
+	assert.True(t, checked)
+	assert.NoError(t, err)
+
+	health := &types.Health{
+		Status: types.Unhealthy,
+		Log: []*types.HealthcheckResult{
+			{Output: "first"}, {Output: "second"}, {Output: "third"}, {Output: "fourth\n"},
+		},
+	}
+	c.On("ContainerInspect", context.TODO(), "unhealthy").
+		Return(inspect(check, health), nil)
+	checked, err = e.waitForServiceHealth(fakeContainer("unhealthy", "service"), 0)
+	assert.True(t, checked)
+	if healthErr, ok := err.(*serviceHealthError); assert.True(t, ok) {
+		assert.Equal(t, types.Unhealthy, healthErr.status)
+		assert.Equal(t, []string{"second", "third", "fourth"}, healthErr.log)
+	}
+
+	restarting := inspect(check, &types.Health{Status: types.Starting})
+	restarting.State.Running = false
+	restarting.State.Restarting = true
+	c.On("ContainerInspect", context.TODO(), "restarted").
+		Return(restarting, nil).
+		Once()
+	c.On("ContainerInspect", context.TODO(), "restarted").
+		Return(inspect(check, &types.Health{Status: types.Healthy}), nil).
+		Once()
+	checked, err = e.waitForServiceHealth(fakeContainer("restarted", "service"), time.Second)
+	assert.True(t, checked)
+	assert.NoError(t, err, "the service can recover by restarting within the timeout")
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected container.RestartPolicy
+		valid    bool
+	}{
+		{"", neverRestartPolicy, true},
+		{"no", neverRestartPolicy, true},
+		{"on-failure", container.RestartPolicy{Name: "on-failure"}, true},
+		{"on-failure:2", container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 2}, true},
+		{"on-failure:0", container.RestartPolicy{}, false},
+		{"on-failure:two", container.RestartPolicy{}, false},
+		{"always", container.RestartPolicy{}, false},
+		{"unless-stopped", container.RestartPolicy{}, false},
+	}
+
+	for _, test := range tests {
+		policy, err := parseRestartPolicy(test.policy)
+		if test.valid {
+			assert.NoError(t, err, test.policy)
+			assert.Equal(t, test.expected, policy, test.policy)
+		} else {
+			assert.Error(t, err, test.policy)
+		}
+	}
+}
+
+func TestGetServiceWaitTimeout(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	assert.Equal(t, common.DefaultWaitForServicesTimeout, e.getServiceWaitTimeout(dockerService{Name: "redis"}))
+	assert.Equal(t, 120, e.getServiceWaitTimeout(dockerService{Name: "postgres", ReadinessTimeout: 120}))
+	assert.Equal(t, 0, e.getServiceWaitTimeout(dockerService{Name: "sidecar", NoReadinessCheck: true, ReadinessTimeout: 120}))
+
+	e.Config.Docker.WaitForServicesTimeout = -1
+	assert.Equal(t, -1, e.getServiceWaitTimeout(dockerService{Name: "redis"}))
+	assert.Equal(t, 120, e.getServiceWaitTimeout(dockerService{Name: "postgres", ReadinessTimeout: 120}))
+}
+
+func TestGetServiceRetryInterval(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	assert.Equal(t, serviceDialInterval, e.getServiceRetryInterval())
+
+	e.Config.Docker.WaitForServicesInterval = 5
+	assert.Equal(t, 5*time.Second, e.getServiceRetryInterval())
+}
+
+func TestWaitForServicesMustStart(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.BuildTrace = &common.Trace{Writer: &bytes.Buffer{}}
+	e.Config.Docker = &common.DockerConfig{WaitForServicesHealthCheck: true}
+	e.services = []*types.Container{fakeContainer("mysql", "runner-mysql")}
+
+	c.On("ContainerInspect", context.TODO(), "mysql").
+		Return(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{Running: false, ExitCode: 1},
+			},
+			Config: &container.Config{Healthcheck: &container.HealthConfig{Test: []string{"CMD", "true"}}},
+		}, nil)
+	c.On("ContainerLogs", context.TODO(), "mysql", mock.Anything).
+		Return(nil, errors.New("no logs"))
+
+	err := e.waitForServices()
+	assert.NoError(t, err)
+
+	e.Config.Docker.ServicesMustStart = true
+	err = e.waitForServices()
+	require.Error(t, err)
+	assert.IsType(t, &common.BuildError{}, err)
+	assert.Contains(t, err.Error(), "runner-mysql")
+}
+
+func TestDumpServicesLogs(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	trace := &bytes.Buffer{}
+	e := executor{client: &c}
+	e.BuildTrace = &common.Trace{Writer: trace}
+	e.Config.Docker = &common.DockerConfig{ServiceLogsTail: 10}
+	e.services = []*types.Container{fakeContainer("mysql", "runner-mysql")}
+
+	c.On("ContainerLogs", context.TODO(), "mysql", mock.AnythingOfType("types.ContainerLogsOptions")).
+		Return(func(ctx context.Context, container string, options types.ContainerLogsOptions) io.ReadCloser {
+			assert.Equal(t, "10", options.Tail)
+			return ioutil.NopCloser(&bytes.Buffer{})
+		}, nil).
+		Once()
+
+	e.dumpServicesLogs()
+	assert.Contains(t, trace.String(), "Logs of service runner-mysql")
+}
+
+func TestValidateUser(t *testing.T) {
+	tests := []struct {
+		user  string
+		valid bool
+	}{
+		{"", true},
+		{"nobody", true},
+		{"1000", true},
+		{"1000:1000", true},
+		{"user:group", true},
+		{"user:", false},
+		{":1000", false},
+		{"1000:1000:1000", false},
+		{"my user", false},
+	}
+
+	for _, test := range tests {
+		err := validateUser(test.user)
+		if test.valid {
+			assert.NoError(t, err, "user = %q", test.user)
+		} else {
+			assert.Error(t, err, "user = %q", test.user)
+		}
+	}
+}
+
+func TestValidateMacAddress(t *testing.T) {
+	assert.NoError(t, validateMacAddress(""))
+	assert.NoError(t, validateMacAddress("92:d0:c6:0a:29:33"))
+	assert.NoError(t, validateMacAddress("92:D0:C6:0A:29:33"))
+	assert.Error(t, validateMacAddress("92:d0:c6:0a:29"))
+	assert.Error(t, validateMacAddress("92:d0:c6:0a:29:3g"))
+	assert.Error(t, validateMacAddress("92d0.c60a.2933"))
+}
+
+func TestParseMemoryLimit(t *testing.T) {
+	limit, err := parseMemoryLimit("memory", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), limit)
+
+	limit, err = parseMemoryLimit("memory", "2g")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), limit)
+
+	_, err = parseMemoryLimit("memory", "a lot")
+	assert.Error(t, err)
+}
+
+func TestGetOomKillDisable(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{OomKillDisable: true}
+
+	assert.True(t, *e.getOomKillDisable(512 * 1024 * 1024))
+	assert.False(t, *e.getOomKillDisable(0), "containers without a memory limit keep the OOM killer")
+
+	e.Config.Docker.OomKillDisable = false
+	assert.False(t, *e.getOomKillDisable(512 * 1024 * 1024))
+}
+
+func TestValidateOomOptions(t *testing.T) {
+	tests := []struct {
+		config common.DockerConfig
+		valid  bool
+	}{
+		{common.DockerConfig{}, true},
+		{common.DockerConfig{OomKillDisable: true}, false},
+		{common.DockerConfig{OomKillDisable: true, Memory: "1g"}, true},
+		{common.DockerConfig{OomKillDisable: true, ServicesMemory: "512m"}, true},
+		{common.DockerConfig{OomKillDisable: true, Memory: "1g", ServicesMemory: "512m"}, true},
+		{common.DockerConfig{OomScoreAdj: -1000}, true},
+		{common.DockerConfig{OomScoreAdj: 1001}, false},
+	}
+
+	for _, test := range tests {
+		err := validateOomOptions(&test.config)
+		if test.valid {
+			assert.NoError(t, err, "%+v", test.config)
+		} else {
+			assert.Error(t, err, "%+v", test.config)
+		}
+	}
+}
+
+func TestValidateIsolation(t *testing.T) {
+	for _, isolation := range []string{"", "default", "process", "hyperv"} {
+		assert.NoError(t, validateIsolation(isolation), "isolation = %q", isolation)
+	}
+	assert.Error(t, validateIsolation("hyper-v"))
+	assert.Error(t, validateIsolation("vm"))
+}
+
+func TestValidateWorkingDir(t *testing.T) {
+	assert.NoError(t, validateWorkingDir(""))
+	assert.NoError(t, validateWorkingDir("/opt/tool"))
+	assert.Error(t, validateWorkingDir("opt/tool"))
+}
+
+func TestIsMountedPath(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.BuildDir = "/builds/group/project"
+	e.Config.Docker = &common.DockerConfig{
+		Volumes: []string{"/cache", "/host/data:/data:ro", "relative"},
+	}
+
+	assert.True(t, e.isMountedPath("/builds/group/project/sub"), "the build volume")
+	assert.True(t, e.isMountedPath("/builds/group"))
+	assert.True(t, e.isMountedPath("/cache/tool"))
+	assert.True(t, e.isMountedPath("/data/"))
+	assert.True(t, e.isMountedPath("/builds/group/project/relative/tool"))
+	assert.False(t, e.isMountedPath("/opt/tool"))
+	assert.False(t, e.isMountedPath("/cache-other"))
+}
+
+func TestGetEntrypoint(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	assert.Nil(t, e.getEntrypoint(), "the entrypoint of the image is used by default")
+
+	e.Config.Docker.Entrypoint = []string{""}
+	assert.Equal(t, []string{""}, e.getEntrypoint())
+
+	options := common.BuildOptions{"entrypoint": []interface{}{"/bin/sh", "-c"}}
+	require.NoError(t, options.Decode(&e.options))
+	assert.Equal(t, []string{"/bin/sh", "-c"}, e.getEntrypoint(), "the job entrypoint overrides the configured one")
+}
+
+func TestExposeBuildContainerAddress(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Config.Docker = &common.DockerConfig{}
+	e.networkMode = "build-network"
+
+	inspect := types.ContainerJSON{
+		NetworkSettings: &types.NetworkSettings{
+			DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: "172.17.0.2"},
+			Networks: map[string]*network.EndpointSettings{
+				"build-network": {IPAddress: "172.28.0.2"},
+			},
+		},
+	}
+
+	e.exposeBuildContainerAddress(inspect)
+	assert.Equal(t, "172.28.0.2", e.Build.GetAllVariables().Get("CI_BUILD_CONTAINER_IP"),
+		"the address on the user-defined network is used")
+
+	e.networkMode = ""
+	e.exposeBuildContainerAddress(inspect)
+	assert.Equal(t, "172.17.0.2", e.Build.GetAllVariables().Get("CI_BUILD_CONTAINER_IP"),
+		"the bridge address is used on the default network")
+	assert.Equal(t, 1, len(e.Build.Variables), "the variable is replaced when the container is restarted")
+
+	e.exposeBuildContainerAddress(types.ContainerJSON{})
+	assert.Equal(t, "172.17.0.2", e.Build.GetAllVariables().Get("CI_BUILD_CONTAINER_IP"))
+}
+
+func TestCreateContainerOptions(t *testing.T) {
+	for _, containerType := range []string{"build", "predefined"} {
+		t.Run(containerType, func(t *testing.T) {
+			var c docker_helpers.MockClient
+			defer c.AssertExpectations(t)
+
+			e := executor{client: &c}
+			e.Build = &common.Build{
+				Runner: &common.RunnerConfig{},
+			}
+			e.BuildShell = &common.ShellConfiguration{}
+			e.setPolicyMode(common.PullPolicyIfNotPresent)
+			e.Config.Docker.User = "1000:1000"
+			e.Config.Docker.MacAddress = "92:d0:c6:0a:29:33"
+			e.Config.Docker.Memory = "512m"
+			e.Config.Docker.OomKillDisable = true
+			e.Config.Docker.OomScoreAdj = -500
+			e.Config.Docker.Isolation = "hyperv"
+			e.Config.Docker.DNSOptions = []string{"ndots:2", "timeout:1"}
+			e.Config.Docker.Entrypoint = []string{""}
+			e.Config.Docker.ScriptsAsFile = true
+			e.Config.Docker.DisableStdin = true
+			e.supportsScriptFiles = true
+
+			expectedUser, expectedMacAddress := "", ""
+			var expectedEntrypoint strslice.StrSlice
+			expectedStdin := true
+			if containerType == "build" {
+				expectedUser, expectedMacAddress = "1000:1000", "92:d0:c6:0a:29:33"
+				expectedEntrypoint = strslice.StrSlice{""}
+				expectedStdin = false
+			}
+
+			c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+				Return(types.ImageInspect{ID: "alpine-image"}, nil, nil).
+				Once()
+			c.On("ContainerRemove", context.TODO(), mock.Anything, mock.Anything).
+				Return(os.ErrNotExist).
+				Once()
+			c.On("NetworkList", context.TODO(), mock.Anything).
+				Return([]types.NetworkResource{}, nil).
+				Once()
+			c.On("ContainerCreate", context.TODO(), mock.AnythingOfType("*container.Config"), mock.Anything, mock.Anything, mock.Anything).
+				Return(func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) container.ContainerCreateCreatedBody {
+					assert.Equal(t, expectedUser, config.User)
+					assert.Equal(t, expectedMacAddress, config.MacAddress)
+					assert.Equal(t, expectedEntrypoint, config.Entrypoint)
+					assert.Equal(t, expectedStdin, config.AttachStdin)
+					assert.Equal(t, expectedStdin, config.OpenStdin)
+					assert.Equal(t, expectedStdin, config.StdinOnce)
+					assert.Equal(t, int64(512*1024*1024), hostConfig.Memory)
+					require.NotNil(t, hostConfig.OomKillDisable)
+					assert.True(t, *hostConfig.OomKillDisable)
+					assert.Equal(t, -500, hostConfig.OomScoreAdj)
+					assert.Equal(t, container.Isolation("hyperv"), hostConfig.Isolation)
+					assert.Equal(t, []string{"ndots:2", "timeout:1"}, hostConfig.DNSOptions)
+					return container.ContainerCreateCreatedBody{ID: containerType}
+				}, nil).
+				Once()
+			c.On("ContainerInspect", context.TODO(), containerType).
+				Return(types.ContainerJSON{}, nil).
+				Once()
+
+			_, err := e.createContainer(containerType, "alpine", []string{"sh"})
+			require.NoError(t, err)
+
+			expectedHostname := ""
+			if containerType == "build" {
+				expectedHostname = e.Build.ProjectUniqueName()
+			}
+			assert.Equal(t, expectedHostname, e.Build.GetAllVariables().Get("CI_BUILD_CONTAINER_HOSTNAME"))
+		})
+	}
+}
+
+func TestWatchContainerOutputWithoutStdin(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	conn, otherEnd := net.Pipe()
+	defer otherEnd.Close()
+
+	options := types.ContainerAttachOptions{Stream: true, Stdout: true, Stderr: true}
+	c.On("ContainerAttach", context.TODO(), "build", options).
+		Return(types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(&bytes.Buffer{})}, nil).
+		Once()
+	c.On("ContainerStart", context.TODO(), "build", mock.Anything).
+		Return(nil).
+		Once()
+	c.On("ContainerInspect", context.TODO(), "build").
+		Return(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{}}}, nil).
+		Once()
+
+	err := e.watchContainerOutput("build", nil, &bytes.Buffer{}, make(chan interface{}))
+	assert.NoError(t, err)
+}
+
+func TestGetLogConfig(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{}
+	assert.Equal(t, container.LogConfig{Type: "json-file", Config: map[string]string{}}, e.getLogConfig())
+
+	e.Config.Docker.LogDriver = "fluentd"
+	e.Config.Docker.LogOpts = map[string]string{"fluentd-address": "fluentd.example.com:24224"}
+	assert.Equal(t, container.LogConfig{
+		Type:   "fluentd",
+		Config: map[string]string{"fluentd-address": "fluentd.example.com:24224"},
+	}, e.getLogConfig())
+}
+
+func TestValidateLogConfig(t *testing.T) {
+	tests := []struct {
+		driver string
+		opts   map[string]string
+		valid  bool
+	}{
+		{"", nil, true},
+		{"", map[string]string{"max-size": "10m"}, false},
+		{"journald", nil, true},
+		{"json-file", map[string]string{"max-size": "10m"}, true},
+		{"gelf", nil, false},
+		{"gelf", map[string]string{"gelf-address": "udp://graylog:12201"}, true},
+		{"splunk", map[string]string{"splunk-token": "token"}, false},
+		{"splunk", map[string]string{"splunk-token": "token", "splunk-url": "https://splunk:8088"}, true},
+	}
+
+	for _, test := range tests {
+		err := validateLogConfig(&common.DockerConfig{LogDriver: test.driver, LogOpts: test.opts})
+		assert.Equal(t, test.valid, err == nil, "%s %v: %v", test.driver, test.opts, err)
+	}
+}
+
+func TestValidateDisableStdin(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{DisableStdin: true}
+	err := e.validateConfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "disable_stdin requires scripts_as_file")
+
+	e.Config.Docker.ScriptsAsFile = true
+	assert.NoError(t, e.validateConfig())
+}
+
+func TestValidateStopSignal(t *testing.T) {
+	for _, signal := range []string{"", "SIGTERM", "TERM", "sigquit", "15", "64", "SIGRTMIN+3", "RTMAX"} {
+		assert.NoError(t, validateStopSignal(signal), signal)
+	}
+	for _, signal := range []string{"SIGFOO", "0", "65", "-1", "RTMIN+16", "TERM "} {
+		assert.Error(t, validateStopSignal(signal), signal)
+	}
+}
+
+func TestKillContainerStopsItGracefully(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{StopSignal: "SIGQUIT", ShutdownGracePeriod: 30}
+
+	gracePeriod := 30 * time.Second
+	c.On("ContainerStop", context.TODO(), "build", &gracePeriod).Return(nil).Once()
+
+	waitCh := make(chan error, 1)
+	waitCh <- nil
+	assert.NoError(t, e.killContainer("build", waitCh), "the stopped container isn't killed")
+
+	c.On("ContainerStop", context.TODO(), "stuck", &gracePeriod).Return(errors.New("timeout")).Once()
+	c.On("NetworkList", context.TODO(), types.NetworkListOptions{}).Return([]types.NetworkResource{}, nil).Once()
+	c.On("ContainerKill", context.TODO(), "stuck", "SIGKILL").Return(nil).Once()
+
+	waitCh = make(chan error, 1)
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		waitCh <- nil
+	}()
+	assert.NoError(t, e.killContainer("stuck", waitCh))
+
+	e.Config.Docker = &common.DockerConfig{}
+	assert.False(t, e.usesGracefulStop(), "the containers are killed right away by default")
+}
+
+func TestDisconnectNetworkByContainerID(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+
+	networks := []types.NetworkResource{
+		{
+			ID:   "network-1",
+			Name: "custom-network",
+			Containers: map[string]types.EndpointResource{
+				"container-id": {Name: "runner-abcdef12-project-0-concurrent-0-build"},
+				"other-id":     {Name: "other-container"},
+			},
+		},
+		{
+			ID:   "network-2",
+			Name: "bridge",
+			Containers: map[string]types.EndpointResource{
+				"container-id": {Name: "runner-abcdef12-project-0-concurrent-0-build"},
+			},
+		},
+		{
+			ID:         "network-3",
+			Name:       "unrelated",
+			Containers: map[string]types.EndpointResource{},
+		},
+	}
+
+	c.On("NetworkList", context.TODO(), types.NetworkListOptions{}).
+		Return(networks, nil).
+		Once()
+
+	c.On("NetworkDisconnect", context.TODO(), "network-1", "container-id", true).
+		Return(nil).
+		Once()
+
+	c.On("NetworkDisconnect", context.TODO(), "network-2", "container-id", true).
+		Return(nil).
+		Once()
+
+	err := e.disconnectNetwork(context.TODO(), "container-id")
+	assert.NoError(t, err)
+}
+
+func TestCreateNetworkPerBuild(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{NetworkPerBuild: true}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Runner.Token = "abcdef1234567890"
+
+	networkName := "runner-abcdef12-project-0-concurrent-0-network"
+
+	c.On("NetworkRemove", context.TODO(), networkName).
+		Return(errors.New("network not found")).
+		Once()
+	c.On("NetworkCreate", context.TODO(), networkName, mock.AnythingOfType("types.NetworkCreate")).
+		Return(types.NetworkCreateResponse{ID: "network-id"}, nil).
+		Once()
+
+	require.NoError(t, e.createNetwork())
+	assert.Equal(t, []string{"network-id"}, e.networks)
+	assert.Equal(t, container.NetworkMode(networkName), e.getNetworkMode())
+}
+
+func TestCreateNetworkWithoutNetworkPerBuild(t *testing.T) {
+	e := executor{}
+	e.Config.Docker = &common.DockerConfig{NetworkMode: "host"}
+
+	require.NoError(t, e.createNetwork())
+	assert.Empty(t, e.networks)
+	assert.Equal(t, container.NetworkMode("host"), e.getNetworkMode())
+}
+
+func TestIsUserDefinedNetwork(t *testing.T) {
+	for _, networkMode := range []string{"", "default", "bridge", "host", "none", "nat", "container:build"} {
+		assert.False(t, isUserDefinedNetwork(networkMode), networkMode)
+	}
+	assert.True(t, isUserDefinedNetwork("ci-network"))
+}
+
+func TestCreateNetworkUsesExternalNetwork(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{NetworkMode: "ci-network"}
+
+	c.On("NetworkInspect", context.TODO(), "ci-network").
+		Return(types.NetworkResource{ID: "network-id", Name: "ci-network"}, nil).
+		Once()
+
+	require.NoError(t, e.createNetwork())
+	assert.Empty(t, e.networks, "the external network isn't removed after the build")
+	assert.Equal(t, "ci-network", e.networkMode)
+	assert.Equal(t, container.NetworkMode("ci-network"), e.getNetworkMode())
+}
+
+func TestCreateNetworkWithMissingExternalNetwork(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{NetworkMode: "ci-network"}
+
+	c.On("NetworkInspect", context.TODO(), "ci-network").
+		Return(types.NetworkResource{}, errors.New("network ci-network not found")).
+		Once()
+
+	err := e.createNetwork()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ci-network")
+}
+
+func TestCleanupRemovesNetworks(t *testing.T) {
+	defer func(interval time.Duration) {
+		networkRemoveRetryInterval = interval
+	}(networkRemoveRetryInterval)
+	networkRemoveRetryInterval = time.Millisecond
+
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.networks = []string{"network-id", "leaked-network-id"}
+
+	activeEndpoints := errors.New("Error response from daemon: network network-id has active endpoints")
+	c.On("NetworkRemove", context.TODO(), "network-id").
+		Return(activeEndpoints).
+		Once()
+	c.On("NetworkRemove", context.TODO(), "network-id").
+		Return(nil).
+		Once()
+
+	c.On("NetworkRemove", context.TODO(), "leaked-network-id").
+		Return(activeEndpoints).
+		Times(networkRemoveRetries + 1)
+
+	c.On("Close").
+		Return(nil).
+		Once()
+
+	e.Cleanup()
+}
+
+func TestValidateNetwork(t *testing.T) {
+	tests := []struct {
+		config common.DockerConfig
+		valid  bool
+	}{
+		{common.DockerConfig{}, true},
+		{common.DockerConfig{NetworkMode: "host"}, true},
+		{common.DockerConfig{NetworkPerBuild: true}, true},
+		{common.DockerConfig{NetworkPerBuild: true, NetworkMode: "host"}, false},
+		{common.DockerConfig{NetworkPerBuild: true, EnableIPv6: true}, true},
+		{common.DockerConfig{NetworkPerBuild: true, EnableIPv6: true, IPv6Subnet: "fd00:1234::/64"}, true},
+		{common.DockerConfig{EnableIPv6: true}, false},
+		{common.DockerConfig{NetworkPerBuild: true, IPv6Subnet: "fd00:1234::/64"}, false},
+		{common.DockerConfig{NetworkPerBuild: true, EnableIPv6: true, IPv6Subnet: "fd00:1234::"}, false},
+		{common.DockerConfig{NetworkPerBuild: true, EnableIPv6: true, IPv6Subnet: "172.28.0.0/16"}, false},
+		{common.DockerConfig{NetworkPerBuild: true, EnableIPv6: true, IPv6Subnet: "::ffff:172.28.0.0/112"}, false},
+		{common.DockerConfig{NetworkPerBuild: true, IPv4Subnet: "172.28.0.0/16"}, true},
+		{common.DockerConfig{NetworkPerBuild: true, IPv4Subnet: "fd00:1234::/64"}, false},
+		{common.DockerConfig{IPv4Subnet: "172.28.0.0/16"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateNetwork(&test.config)
+		if test.valid {
+			assert.NoError(t, err, "%+v", test.config)
+		} else {
+			assert.Error(t, err, "%+v", test.config)
+		}
+	}
+}
+
+func TestCreateNetworkWithIPv6(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{
+		NetworkPerBuild: true,
+		EnableIPv6:      true,
+		IPv6Subnet:      "fd00:1234::/64",
+	}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+
+	c.On("NetworkRemove", context.TODO(), mock.Anything).
+		Return(nil).
+		Once()
+	c.On("NetworkCreate", context.TODO(), mock.Anything, mock.AnythingOfType("types.NetworkCreate")).
+		Return(func(ctx context.Context, name string, options types.NetworkCreate) types.NetworkCreateResponse {
+			assert.True(t, options.EnableIPv6)
+			require.NotNil(t, options.IPAM)
+			assert.Equal(t, []network.IPAMConfig{{Subnet: "fd00:1234::/64"}}, options.IPAM.Config)
+			return types.NetworkCreateResponse{ID: "network-id"}
+		}, nil).
+		Once()
+
+	require.NoError(t, e.createNetwork())
+}
+
+func TestRemoveContainerRetriesConflicts(t *testing.T) {
+	defer func(interval time.Duration) {
+		containerRemoveRetryInterval = interval
+	}(containerRemoveRetryInterval)
+	containerRemoveRetryInterval = time.Millisecond
+
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+
+	c.On("NetworkList", context.TODO(), mock.Anything).
+		Return([]types.NetworkResource{}, nil)
+
+	inProgress := errors.New("Error response from daemon: removal of container build is already in progress")
+	c.On("ContainerRemove", context.TODO(), "build", mock.Anything).
+		Return(inProgress).
+		Twice()
+	c.On("ContainerRemove", context.TODO(), "build", mock.Anything).
+		Return(nil).
+		Once()
+	assert.NoError(t, e.removeContainer(context.TODO(), "build"))
+
+	c.On("ContainerRemove", context.TODO(), "missing", mock.Anything).
+		Return(errors.New("No such container: missing")).
+		Once()
+	assert.Error(t, e.removeContainer(context.TODO(), "missing"), "other errors are not retried")
+
+	busy := errors.New("Driver overlay2 failed to remove root filesystem: device or resource busy")
+	c.On("ContainerRemove", context.TODO(), "busy", mock.Anything).
+		Return(busy).
+		Times(containerRemoveRetries + 1)
+	assert.Equal(t, busy, e.removeContainer(context.TODO(), "busy"))
+}
+
+func TestRemoveContainersWithBoundedConcurrency(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.Config.Docker = &common.DockerConfig{CleanupConcurrency: 2}
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+
+	c.On("NetworkList", context.TODO(), mock.Anything).
+		Return([]types.NetworkResource{}, nil).
+		Times(6)
+	c.On("ContainerRemove", context.TODO(), mock.Anything, mock.Anything).
+		Return(func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+
+			if id == "broken" {
+				return errors.New("removal failed")
+			}
+			return nil
+		}).
+		Times(6)
+
+	errs := e.removeContainers([]string{"failure", "service", "cache", "broken", "build-1", "build-2"})
+	require.Equal(t, 1, len(errs))
+	assert.Contains(t, errs[0].Error(), "broken: removal failed")
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestMaskSecrets(t *testing.T) {
+	e := executor{}
+	e.Build = &common.Build{
+		Runner: &common.RunnerConfig{},
+	}
+	e.Build.Variables = common.BuildVariables{
+		{Key: "PUBLIC", Value: "public-value", Public: true},
+		{Key: "SHORT", Value: "yes"},
+		{Key: "TOKEN", Value: "secret"},
+		{Key: "PASSWORD", Value: "secret-password"},
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	e.BuildTrace = &common.Trace{Writer: buffer}
+	e.maskBuildTrace()
+
+	assert.Equal(t, "public-value, yes, [MASKED] and [MASKED]", e.maskSecrets("public-value, yes, secret and secret-password"))
+
+	e.Println("Logging in with secret-password")
+	fmt.Fprint(e.BuildTrace, "token=secret\n")
+	assert.NotContains(t, buffer.String(), "secret")
+	assert.Contains(t, buffer.String(), "Logging in with [MASKED]")
+	assert.Contains(t, buffer.String(), "token=[MASKED]\n")
+}
+
+func TestVerifyAllowedPullPolicy(t *testing.T) {
+	e := executor{}
+	e.setPolicyMode(common.PullPolicyAlways)
+
+	assert.NoError(t, e.verifyAllowedPullPolicy(common.PullPolicyAlways))
+	assert.Error(t, e.verifyAllowedPullPolicy(common.PullPolicyIfNotPresent),
+		"only the runner's pull policy is allowed by default")
+	assert.Error(t, e.verifyAllowedPullPolicy("sometimes"))
+
+	e.Config.Docker.AllowedPullPolicies = []common.DockerPullPolicy{common.PullPolicyAlways, common.PullPolicyIfNotPresent}
+	assert.NoError(t, e.verifyAllowedPullPolicy(common.PullPolicyIfNotPresent))
+	assert.Error(t, e.verifyAllowedPullPolicy(common.PullPolicyNever))
+}
+
+func TestGetPullPolicyRequestedByJob(t *testing.T) {
+	var c docker_helpers.MockClient
+	defer c.AssertExpectations(t)
+
+	e := executor{client: &c}
+	e.setPolicyMode(common.PullPolicyAlways)
+
+	policy, err := e.getPullPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, common.PullPolicyAlways, policy)
+
+	e.pullPolicy = common.PullPolicyIfNotPresent
+	policy, err = e.getPullPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, common.PullPolicyIfNotPresent, policy)
+
+	c.On("ImageInspectWithRaw", context.TODO(), "alpine").
+		Return(types.ImageInspect{ID: "alpine-image"}, nil, nil).
+		Once()
+
+	image, err := e.getDockerImage("alpine")
+	assert.NoError(t, err)
+	assert.Equal(t, "alpine-image", image.ID, "the local image is used without pulling")
+}
+
 func TestDockerWatchOn_1_12_4(t *testing.T) {
 	if helpers.SkipIntegrationTests(t, "docker", "info") {
 		return
@@ -802,7 +3690,7 @@ func TestDockerWatchOn_1_12_4(t *testing.T) {
 		t.Error("Container script not finished")
 	}
 
-	err = e.removeContainer(container.ID)
+	err = e.removeContainer(context.TODO(), container.ID)
 	assert.NoError(t, err)
 	wg.Wait()
 }
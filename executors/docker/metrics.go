@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/executors"
+)
+
+// imagePullMetrics are shared by all Docker executors of the process
+type imagePullMetrics struct {
+	duration  *prometheus.HistogramVec
+	failures  *prometheus.CounterVec
+	localHits *prometheus.CounterVec
+}
+
+var pullMetrics = newImagePullMetrics()
+
+func newImagePullMetrics() *imagePullMetrics {
+	return &imagePullMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ci_docker_image_pull_duration_seconds",
+			Help:    "The time spent on pulling the build, service and cache images.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600},
+		}, []string{"pull_policy"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_docker_image_pull_failures_total",
+			Help: "The total number of failed image pulls.",
+		}, []string{"pull_policy"}),
+		localHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_docker_image_local_hits_total",
+			Help: "The total number of images used from the local Docker cache without pulling.",
+		}, []string{"pull_policy"}),
+	}
+}
+
+func (m *imagePullMetrics) observePull(pullPolicy common.DockerPullPolicy, started time.Time, err error) {
+	if err != nil {
+		m.failures.WithLabelValues(string(pullPolicy)).Inc()
+		return
+	}
+	m.duration.WithLabelValues(string(pullPolicy)).Observe(time.Since(started).Seconds())
+}
+
+func (m *imagePullMetrics) observeLocalHit(pullPolicy common.DockerPullPolicy) {
+	m.localHits.WithLabelValues(string(pullPolicy)).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (m *imagePullMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.duration.Describe(ch)
+	m.failures.Describe(ch)
+	m.localHits.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *imagePullMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.failures.Collect(ch)
+	m.localHits.Collect(ch)
+}
+
+// executorProvider exposes the image pull metrics next to the executors
+type executorProvider struct {
+	executors.DefaultExecutorProvider
+}
+
+// Describe implements prometheus.Collector.
+func (p executorProvider) Describe(ch chan<- *prometheus.Desc) {
+	pullMetrics.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p executorProvider) Collect(ch chan<- prometheus.Metric) {
+	pullMetrics.Collect(ch)
+}
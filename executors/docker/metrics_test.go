@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestDockerProviderExposesCollectInterface(t *testing.T) {
+	var provider common.ExecutorProvider
+	provider = executorProvider{}
+	collector, ok := provider.(prometheus.Collector)
+	assert.True(t, ok)
+	assert.NotNil(t, collector)
+}
+
+func TestImagePullMetrics(t *testing.T) {
+	metrics := newImagePullMetrics()
+
+	metrics.observePull(common.PullPolicyAlways, time.Now().Add(-time.Minute), nil)
+	metrics.observePull(common.PullPolicyAlways, time.Now(), errors.New("pull failed"))
+	metrics.observeLocalHit(common.PullPolicyIfNotPresent)
+	metrics.observeLocalHit(common.PullPolicyIfNotPresent)
+
+	var metric dto.Metric
+	require.NoError(t, metrics.duration.WithLabelValues("always").(prometheus.Metric).Write(&metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	assert.True(t, metric.GetHistogram().GetSampleSum() >= 60)
+
+	require.NoError(t, metrics.failures.WithLabelValues("always").Write(&metric))
+	assert.Equal(t, float64(1), metric.GetCounter().GetValue())
+
+	require.NoError(t, metrics.localHits.WithLabelValues("if-not-present").Write(&metric))
+	assert.Equal(t, float64(2), metric.GetCounter().GetValue())
+
+	descCh := make(chan *prometheus.Desc, 10)
+	metrics.Describe(descCh)
+	assert.Equal(t, 3, len(descCh))
+}
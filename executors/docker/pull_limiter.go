@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"sync"
+)
+
+// imagePullLimiter limits the concurrent image pulls of all Docker executors
+// of the process. The limit is given by each pull, as it's configured per
+// runner, while the running pulls of all runners are counted together.
+type imagePullLimiter struct {
+	lock     sync.Mutex
+	active   int
+	released chan struct{} // closed and replaced whenever a pull finishes
+}
+
+var pullLimiter = newImagePullLimiter()
+
+func newImagePullLimiter() *imagePullLimiter {
+	return &imagePullLimiter{
+		released: make(chan struct{}),
+	}
+}
+
+// acquire waits until fewer than limit pulls are running, a limit lower than
+// one doesn't wait at all. onWait is called once, before it starts waiting.
+func (l *imagePullLimiter) acquire(limit int, onWait func()) {
+	for waiting := false; ; waiting = true {
+		l.lock.Lock()
+		if limit <= 0 || l.active < limit {
+			l.active++
+			l.lock.Unlock()
+			return
+		}
+		released := l.released
+		l.lock.Unlock()
+
+		if !waiting && onWait != nil {
+			onWait()
+		}
+		<-released
+	}
+}
+
+func (l *imagePullLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+	close(l.released)
+	l.released = make(chan struct{})
+}
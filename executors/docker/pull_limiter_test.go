@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImagePullLimiter(t *testing.T) {
+	limiter := newImagePullLimiter()
+
+	limiter.acquire(2, func() {
+		assert.Fail(t, "the first pull shouldn't wait")
+	})
+	// the pulls of runners without a limit are counted too
+	limiter.acquire(0, nil)
+
+	waiting := make(chan bool, 1)
+	acquired := make(chan bool)
+	go func() {
+		limiter.acquire(2, func() { waiting <- true })
+		close(acquired)
+	}()
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the third pull should wait")
+	}
+
+	select {
+	case <-acquired:
+		assert.Fail(t, "the third pull shouldn't start while two are running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	limiter.release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the third pull should start once a pull is released")
+	}
+	assert.Equal(t, 2, limiter.active)
+}
+
+func TestImagePullLimiterWithConcurrentPulls(t *testing.T) {
+	limiter := newImagePullLimiter()
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			limiter.acquire(3, nil)
+			defer limiter.release()
+
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, maxRunning <= 3, "at most 3 pulls run at once, got %d", maxRunning)
+	assert.Equal(t, 0, limiter.active)
+}
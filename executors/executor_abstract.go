@@ -52,6 +52,9 @@ func (e *AbstractExecutor) generateShellConfiguration() error {
 	info.PreCloneScript = e.Config.PreCloneScript
 	info.PreBuildScript = e.Config.PreBuildScript
 	info.PostBuildScript = e.Config.PostBuildScript
+	info.DisableColors = e.Config.DisableColors
+	info.UserScopeVariables = e.Config.UserScopeVariables
+	info.MachineScopeVariables = e.Config.MachineScopeVariables
 	shellConfiguration, err := common.GetShellConfiguration(*info)
 	if err != nil {
 		return err
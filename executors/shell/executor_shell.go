@@ -81,7 +81,9 @@ func (s *executor) Run(cmd common.ExecutorCommand) error {
 	c.Stdout = s.BuildTrace
 	c.Stderr = s.BuildTrace
 
-	if s.BuildShell.PassFile {
+	if arguments, ok := s.BuildShell.GetEncodedCommand(cmd.Script); ok {
+		c.Args = arguments
+	} else if s.BuildShell.PassFile {
 		scriptDir, err := ioutil.TempDir("", "build_script")
 		if err != nil {
 			return err
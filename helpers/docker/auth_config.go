@@ -19,6 +19,10 @@ import (
 // DefaultDockerRegistry is the name of the index
 const DefaultDockerRegistry = "docker.io"
 
+// defaultDockerIndexServer is the address under which Docker stores the
+// credentials of the default registry
+const defaultDockerIndexServer = "https://index.docker.io/v1/"
+
 // EncodeAuthConfig constructs a token from an AuthConfig, suitable for
 // authorizing against the Docker API with.
 func EncodeAuthConfig(authConfig *types.AuthConfig) (string, error) {
@@ -54,6 +58,33 @@ func SplitDockerImageName(reposName string) (string, string) {
 var HomeDirectory = homedir.Get()
 
 func ReadDockerAuthConfigsFromHomeDir(userName string) (map[string]types.AuthConfig, error) {
+	config, err := readDockerConfigFileFromHomeDir(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.AuthConfigs, nil
+}
+
+// ReadDockerCredentialHelperAuthConfig resolves the credentials for indexName
+// with the credential helper (credHelpers or credsStore) configured in the
+// Docker configuration of the user. It returns nil if no helper is configured.
+func ReadDockerCredentialHelperAuthConfig(userName, indexName string) (*types.AuthConfig, error) {
+	config, err := readDockerConfigFileFromHomeDir(userName)
+	if err != nil {
+		// missing configuration is handled by the static credentials lookup
+		return nil, nil
+	}
+
+	helper := getCredentialHelper(config, indexName)
+	if helper == "" {
+		return nil, nil
+	}
+
+	return getCredentialHelperAuthConfig(helper, indexName)
+}
+
+func readDockerConfigFileFromHomeDir(userName string) (*configfile.ConfigFile, error) {
 	homeDir := HomeDirectory
 
 	if userName != "" {
@@ -82,20 +113,46 @@ func ReadDockerAuthConfigsFromHomeDir(userName string) (map[string]types.AuthCon
 	}
 
 	if r == nil {
-		return make(map[string]types.AuthConfig), nil
+		return &configfile.ConfigFile{
+			AuthConfigs: make(map[string]types.AuthConfig),
+		}, nil
 	}
 
-	return ReadAuthConfigsFromReader(r)
+	return readConfigFileFromReader(r)
 }
 
 func ReadAuthConfigsFromReader(r io.Reader) (map[string]types.AuthConfig, error) {
+	config, err := readConfigFileFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.AuthConfigs, nil
+}
+
+func readConfigFileFromReader(r io.Reader) (*configfile.ConfigFile, error) {
 	config := &configfile.ConfigFile{}
 
 	if err := config.LoadFromReader(r); err != nil {
 		return nil, err
 	}
 
-	return config.AuthConfigs, nil
+	return config, nil
+}
+
+func convertToHostname(url string) string {
+	stripped := url
+	if strings.HasPrefix(url, "http://") {
+		stripped = strings.Replace(url, "http://", "", 1)
+	} else if strings.HasPrefix(url, "https://") {
+		stripped = strings.Replace(url, "https://", "", 1)
+	}
+
+	nameParts := strings.SplitN(stripped, "/", 2)
+	if nameParts[0] == "index."+DefaultDockerRegistry {
+		return DefaultDockerRegistry
+	}
+	return nameParts[0]
 }
 
 // ResolveDockerAuthConfig taken from: https://github.com/docker/docker/blob/master/registry/auth.go
@@ -104,21 +161,6 @@ func ResolveDockerAuthConfig(indexName string, configs map[string]types.AuthConf
 		return nil
 	}
 
-	convertToHostname := func(url string) string {
-		stripped := url
-		if strings.HasPrefix(url, "http://") {
-			stripped = strings.Replace(url, "http://", "", 1)
-		} else if strings.HasPrefix(url, "https://") {
-			stripped = strings.Replace(url, "https://", "", 1)
-		}
-
-		nameParts := strings.SplitN(stripped, "/", 2)
-		if nameParts[0] == "index."+DefaultDockerRegistry {
-			return DefaultDockerRegistry
-		}
-		return nameParts[0]
-	}
-
 	// Maybe they have a legacy config file, we will iterate the keys converting
 	// them to the new format and testing
 	for registry, authConfig := range configs {
@@ -0,0 +1,84 @@
+package docker_helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/cliconfig/configfile"
+)
+
+const credentialHelperPrefix = "docker-credential-"
+
+// credentialHelperTokenUsername is returned by credential helpers as the
+// username when the secret is an identity token
+const credentialHelperTokenUsername = "<token>"
+
+type credentialHelperResponse struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// runCredentialHelper executes `docker-credential-<helper> get` passing the
+// server address on stdin, as described by the docker-credential-helpers protocol
+var runCredentialHelper = func(helper, serverAddress string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s%s: %s: %s", credentialHelperPrefix, helper, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func getCredentialHelper(config *configfile.ConfigFile, indexName string) string {
+	for registry, helper := range config.CredentialHelpers {
+		if convertToHostname(registry) == indexName {
+			return helper
+		}
+	}
+
+	return config.CredentialsStore
+}
+
+func getCredentialHelperAuthConfig(helper, indexName string) (*types.AuthConfig, error) {
+	serverAddress := indexName
+	if indexName == DefaultDockerRegistry {
+		// docker login stores the credentials of Docker Hub under its index URL
+		serverAddress = defaultDockerIndexServer
+	}
+
+	output, err := runCredentialHelper(helper, serverAddress)
+	if err != nil {
+		if strings.Contains(err.Error(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var response credentialHelperResponse
+	err = json.Unmarshal(output, &response)
+	if err != nil {
+		return nil, fmt.Errorf("%s%s: invalid response: %s", credentialHelperPrefix, helper, err)
+	}
+
+	authConfig := &types.AuthConfig{
+		ServerAddress: indexName,
+	}
+	if response.Username == credentialHelperTokenUsername {
+		authConfig.IdentityToken = response.Secret
+	} else {
+		authConfig.Username = response.Username
+		authConfig.Password = response.Secret
+	}
+	return authConfig, nil
+}
@@ -0,0 +1,104 @@
+package docker_helpers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCredentialHelpersConfig = `{
+	"auths": {"ecr.domain.tld": {}, "static.domain.tld": {"auth": "dXNlcjpwYXNzd29yZA=="}},
+	"credHelpers": {"ecr.domain.tld": "ecr-login", "https://token.domain.tld": "token"}
+}`
+
+func mockCredentialHelper(t *testing.T, responses map[string]string) func() {
+	oldRunCredentialHelper := runCredentialHelper
+	runCredentialHelper = func(helper, serverAddress string) ([]byte, error) {
+		response, ok := responses[helper+"/"+serverAddress]
+		if !ok {
+			return nil, errors.New("exit status 1: credentials not found in native keychain")
+		}
+		return []byte(response), nil
+	}
+
+	return func() {
+		runCredentialHelper = oldRunCredentialHelper
+	}
+}
+
+func withDockerConfig(t *testing.T, config string) func() {
+	tempHomeDir, err := ioutil.TempDir("", "docker-credential-helpers-test")
+	require.NoError(t, err)
+
+	os.MkdirAll(path.Join(tempHomeDir, ".docker"), 0700)
+	err = ioutil.WriteFile(path.Join(tempHomeDir, ".docker", "config.json"), []byte(config), 0600)
+	require.NoError(t, err)
+
+	oldHomeDirectory := HomeDirectory
+	HomeDirectory = tempHomeDir
+
+	return func() {
+		HomeDirectory = oldHomeDirectory
+		os.RemoveAll(tempHomeDir)
+	}
+}
+
+func TestReadDockerCredentialHelperAuthConfig(t *testing.T) {
+	defer withDockerConfig(t, testCredentialHelpersConfig)()
+	defer mockCredentialHelper(t, map[string]string{
+		"ecr-login/ecr.domain.tld": `{"ServerURL":"ecr.domain.tld","Username":"AWS","Secret":"password"}`,
+		"token/token.domain.tld":   `{"ServerURL":"token.domain.tld","Username":"<token>","Secret":"identity-token"}`,
+	})()
+
+	ac, err := ReadDockerCredentialHelperAuthConfig("", "ecr.domain.tld")
+	require.NoError(t, err)
+	require.NotNil(t, ac)
+	assert.Equal(t, "ecr.domain.tld", ac.ServerAddress)
+	assert.Equal(t, "AWS", ac.Username)
+	assert.Equal(t, "password", ac.Password)
+
+	ac, err = ReadDockerCredentialHelperAuthConfig("", "token.domain.tld")
+	require.NoError(t, err)
+	require.NotNil(t, ac)
+	assert.Empty(t, ac.Username)
+	assert.Equal(t, "identity-token", ac.IdentityToken)
+
+	ac, err = ReadDockerCredentialHelperAuthConfig("", "static.domain.tld")
+	assert.NoError(t, err)
+	assert.Nil(t, ac, "no helper is configured for static credentials")
+}
+
+func TestReadDockerCredentialHelperAuthConfigForDockerHub(t *testing.T) {
+	defer withDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {}}, "credsStore": "secretservice"}`)()
+	defer mockCredentialHelper(t, map[string]string{
+		"secretservice/https://index.docker.io/v1/": `{"ServerURL":"https://index.docker.io/v1/","Username":"user","Secret":"password"}`,
+	})()
+
+	ac, err := ReadDockerCredentialHelperAuthConfig("", "docker.io")
+	require.NoError(t, err)
+	require.NotNil(t, ac, "the credentials of Docker Hub are read from its index URL")
+	assert.Equal(t, "docker.io", ac.ServerAddress)
+	assert.Equal(t, "user", ac.Username)
+	assert.Equal(t, "password", ac.Password)
+}
+
+func TestReadDockerCredentialHelperAuthConfigWithCredentialsStore(t *testing.T) {
+	defer withDockerConfig(t, `{"auths": {"registry.domain.tld": {}}, "credsStore": "secretservice"}`)()
+	defer mockCredentialHelper(t, map[string]string{
+		"secretservice/registry.domain.tld": `{"ServerURL":"registry.domain.tld","Username":"user","Secret":"password"}`,
+	})()
+
+	ac, err := ReadDockerCredentialHelperAuthConfig("", "registry.domain.tld")
+	require.NoError(t, err)
+	require.NotNil(t, ac)
+	assert.Equal(t, "user", ac.Username)
+
+	ac, err = ReadDockerCredentialHelperAuthConfig("", "other.domain.tld")
+	assert.NoError(t, err)
+	assert.Nil(t, ac, "credentials not found in the store")
+}
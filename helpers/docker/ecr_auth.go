@@ -0,0 +1,98 @@
+package docker_helpers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ecrCredentialHelper is the Amazon ECR Docker Credential Helper, the
+// docker-credential-ecr-login binary which must be installed on the runner
+// host. The runner doesn't talk to AWS itself: the helper resolves the AWS
+// credentials (environment, shared credentials file, instance or task role)
+// and exchanges them for an ECR authorization token.
+const ecrCredentialHelper = "ecr-login"
+
+// ecrTokenLifetime is used when the expiration can't be read from the token
+const ecrTokenLifetime = 12 * time.Hour
+
+// ecrTokenExpiryMargin makes the token to be refreshed before it expires, so
+// a pull started just before the expiration doesn't fail
+const ecrTokenExpiryMargin = 5 * time.Minute
+
+var ecrRegistryRegex = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+type ecrToken struct {
+	authConfig types.AuthConfig
+	expiresAt  time.Time
+}
+
+type ecrTokenCache struct {
+	tokens map[string]ecrToken
+	lock   sync.Mutex
+}
+
+var ecrTokens = &ecrTokenCache{}
+
+// IsECRRegistry checks if indexName points to Amazon ECR registry
+func IsECRRegistry(indexName string) bool {
+	return ecrRegistryRegex.MatchString(indexName)
+}
+
+// GetECRAuthConfig returns the credentials for Amazon ECR registry. The
+// authorization token is cached for its lifetime.
+func GetECRAuthConfig(indexName string) (*types.AuthConfig, error) {
+	if !IsECRRegistry(indexName) {
+		return nil, nil
+	}
+
+	return ecrTokens.get(indexName)
+}
+
+func (c *ecrTokenCache) get(indexName string) (*types.AuthConfig, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if token, ok := c.tokens[indexName]; ok && time.Now().Before(token.expiresAt) {
+		authConfig := token.authConfig
+		return &authConfig, nil
+	}
+
+	authConfig, err := getCredentialHelperAuthConfig(ecrCredentialHelper, indexName)
+	if err != nil {
+		return nil, err
+	}
+	if authConfig == nil {
+		return nil, errors.New("no authorization token was returned for " + indexName)
+	}
+
+	if c.tokens == nil {
+		c.tokens = make(map[string]ecrToken)
+	}
+	c.tokens[indexName] = ecrToken{
+		authConfig: *authConfig,
+		expiresAt:  getECRTokenExpiration(authConfig.Password).Add(-ecrTokenExpiryMargin),
+	}
+	return authConfig, nil
+}
+
+// getECRTokenExpiration reads the expiration stored in the ECR token payload
+func getECRTokenExpiration(password string) time.Time {
+	var payload struct {
+		Expiration int64 `json:"expiration"`
+	}
+
+	data, err := base64.StdEncoding.DecodeString(password)
+	if err == nil {
+		err = json.Unmarshal(data, &payload)
+	}
+	if err != nil || payload.Expiration <= 0 {
+		return time.Now().Add(ecrTokenLifetime)
+	}
+	return time.Unix(payload.Expiration, 0)
+}
@@ -0,0 +1,62 @@
+package docker_helpers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsECRRegistry(t *testing.T) {
+	assert.True(t, IsECRRegistry("123456789012.dkr.ecr.eu-west-1.amazonaws.com"))
+	assert.True(t, IsECRRegistry("123456789012.dkr.ecr-fips.us-east-1.amazonaws.com"))
+	assert.True(t, IsECRRegistry("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn"))
+	assert.False(t, IsECRRegistry("docker.io"))
+	assert.False(t, IsECRRegistry("dkr.ecr.eu-west-1.amazonaws.com.example.com"))
+}
+
+func TestGetECRAuthConfigIsCached(t *testing.T) {
+	const registry = "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+
+	expiration := time.Now().Add(time.Hour).Unix()
+	password := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"payload":"data","expiration":%d}`, expiration)))
+
+	calls := 0
+	oldRunCredentialHelper := runCredentialHelper
+	defer func() {
+		runCredentialHelper = oldRunCredentialHelper
+		ecrTokens = &ecrTokenCache{}
+	}()
+	runCredentialHelper = func(helper, serverAddress string) ([]byte, error) {
+		assert.Equal(t, ecrCredentialHelper, helper)
+		calls++
+		return []byte(fmt.Sprintf(`{"ServerURL":%q,"Username":"AWS","Secret":%q}`, serverAddress, password)), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		ac, err := GetECRAuthConfig(registry)
+		require.NoError(t, err)
+		require.NotNil(t, ac)
+		assert.Equal(t, "AWS", ac.Username)
+		assert.Equal(t, password, ac.Password)
+	}
+	assert.Equal(t, 1, calls, "the token should be fetched once")
+
+	token := ecrTokens.tokens[registry]
+	assert.Equal(t, time.Unix(expiration, 0).Add(-ecrTokenExpiryMargin), token.expiresAt)
+
+	token.expiresAt = time.Now().Add(-time.Second)
+	ecrTokens.tokens[registry] = token
+
+	_, err := GetECRAuthConfig(registry)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls, "the expired token should be refreshed")
+
+	ac, err := GetECRAuthConfig("docker.io")
+	assert.NoError(t, err)
+	assert.Nil(t, ac)
+	assert.Equal(t, 2, calls)
+}
@@ -2,10 +2,12 @@ package docker_helpers
 
 import (
 	"io"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/stretchr/testify/mock"
 
 	"golang.org/x/net/context"
@@ -107,6 +109,29 @@ func (_m *MockClient) ContainerKill(ctx context.Context, containerID string, sig
 	return r0
 }
 
+// ContainerList provides a mock function with given fields: ctx, options
+func (_m *MockClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	ret := _m.Called(ctx, options)
+
+	var r0 []types.Container
+	if rf, ok := ret.Get(0).(func(context.Context, types.ContainerListOptions) []types.Container); ok {
+		r0 = rf(ctx, options)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]types.Container)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, types.ContainerListOptions) error); ok {
+		r1 = rf(ctx, options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ContainerLogs provides a mock function with given fields: ctx, _a1, options
 func (_m *MockClient) ContainerLogs(ctx context.Context, _a1 string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
 	ret := _m.Called(ctx, _a1, options)
@@ -144,6 +169,20 @@ func (_m *MockClient) ContainerRemove(ctx context.Context, containerID string, o
 	return r0
 }
 
+// ContainerRename provides a mock function with given fields: ctx, containerID, newContainerName
+func (_m *MockClient) ContainerRename(ctx context.Context, containerID string, newContainerName string) error {
+	ret := _m.Called(ctx, containerID, newContainerName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, containerID, newContainerName)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // ContainerStart provides a mock function with given fields: ctx, containerID, options
 func (_m *MockClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
 	ret := _m.Called(ctx, containerID, options)
@@ -158,6 +197,20 @@ func (_m *MockClient) ContainerStart(ctx context.Context, containerID string, op
 	return r0
 }
 
+// ContainerStop provides a mock function with given fields: ctx, containerID, timeout
+func (_m *MockClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	ret := _m.Called(ctx, containerID, timeout)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *time.Duration) error); ok {
+		r0 = rf(ctx, containerID, timeout)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // ContainerWait provides a mock function with given fields: ctx, containerID
 func (_m *MockClient) ContainerWait(ctx context.Context, containerID string) (int64, error) {
 	ret := _m.Called(ctx, containerID)
@@ -223,13 +276,27 @@ func (_m *MockClient) ImageInspectWithRaw(ctx context.Context, imageID string) (
 	return r0, r1, r2
 }
 
-// ImagePullBlocking provides a mock function with given fields: ctx, ref, options
-func (_m *MockClient) ImagePullBlocking(ctx context.Context, ref string, options types.ImagePullOptions) error {
-	ret := _m.Called(ctx, ref, options)
+// ImagePullBlocking provides a mock function with given fields: ctx, ref, options, progress
+func (_m *MockClient) ImagePullBlocking(ctx context.Context, ref string, options types.ImagePullOptions, progress PullProgressFunc) error {
+	ret := _m.Called(ctx, ref, options, progress)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, types.ImagePullOptions, PullProgressFunc) error); ok {
+		r0 = rf(ctx, ref, options, progress)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ImageTag provides a mock function with given fields: ctx, imageID, ref
+func (_m *MockClient) ImageTag(ctx context.Context, imageID string, ref string) error {
+	ret := _m.Called(ctx, imageID, ref)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, types.ImagePullOptions) error); ok {
-		r0 = rf(ctx, ref, options)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, imageID, ref)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -258,6 +325,62 @@ func (_m *MockClient) Info(ctx context.Context) (types.Info, error) {
 	return r0, r1
 }
 
+// NetworkCreate provides a mock function with given fields: ctx, name, options
+func (_m *MockClient) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	ret := _m.Called(ctx, name, options)
+
+	var r0 types.NetworkCreateResponse
+	if rf, ok := ret.Get(0).(func(context.Context, string, types.NetworkCreate) types.NetworkCreateResponse); ok {
+		r0 = rf(ctx, name, options)
+	} else {
+		r0 = ret.Get(0).(types.NetworkCreateResponse)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, types.NetworkCreate) error); ok {
+		r1 = rf(ctx, name, options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// NetworkRemove provides a mock function with given fields: ctx, networkID
+func (_m *MockClient) NetworkRemove(ctx context.Context, networkID string) error {
+	ret := _m.Called(ctx, networkID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, networkID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// NetworkInspect provides a mock function with given fields: ctx, networkID
+func (_m *MockClient) NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error) {
+	ret := _m.Called(ctx, networkID)
+
+	var r0 types.NetworkResource
+	if rf, ok := ret.Get(0).(func(context.Context, string) types.NetworkResource); ok {
+		r0 = rf(ctx, networkID)
+	} else {
+		r0 = ret.Get(0).(types.NetworkResource)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, networkID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // NetworkDisconnect provides a mock function with given fields: ctx, networkID, containerID, force
 func (_m *MockClient) NetworkDisconnect(ctx context.Context, networkID string, containerID string, force bool) error {
 	ret := _m.Called(ctx, networkID, containerID, force)
@@ -295,4 +418,60 @@ func (_m *MockClient) NetworkList(ctx context.Context, options types.NetworkList
 	return r0, r1
 }
 
+// ServerVersion provides a mock function with given fields: ctx
+func (_m *MockClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	ret := _m.Called(ctx)
+
+	var r0 types.Version
+	if rf, ok := ret.Get(0).(func(context.Context) types.Version); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(types.Version)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// VolumeCreate provides a mock function with given fields: ctx, options
+func (_m *MockClient) VolumeCreate(ctx context.Context, options volume.VolumesCreateBody) (types.Volume, error) {
+	ret := _m.Called(ctx, options)
+
+	var r0 types.Volume
+	if rf, ok := ret.Get(0).(func(context.Context, volume.VolumesCreateBody) types.Volume); ok {
+		r0 = rf(ctx, options)
+	} else {
+		r0 = ret.Get(0).(types.Volume)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, volume.VolumesCreateBody) error); ok {
+		r1 = rf(ctx, options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// VolumeRemove provides a mock function with given fields: ctx, volumeID, force
+func (_m *MockClient) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	ret := _m.Called(ctx, volumeID, force)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) error); ok {
+		r0 = rf(ctx, volumeID, force)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 var _ Client = (*MockClient)(nil)
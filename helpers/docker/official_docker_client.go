@@ -67,7 +67,7 @@ func (c *officialDockerClient) ImageImportBlocking(ctx context.Context, source t
 	return nil
 }
 
-func (c *officialDockerClient) ImagePullBlocking(ctx context.Context, ref string, options types.ImagePullOptions) error {
+func (c *officialDockerClient) ImagePullBlocking(ctx context.Context, ref string, options types.ImagePullOptions, progress PullProgressFunc) error {
 	readCloser, err := c.ImagePull(ctx, ref, options)
 	if err != nil {
 		return err
@@ -75,7 +75,7 @@ func (c *officialDockerClient) ImagePullBlocking(ctx context.Context, ref string
 	defer readCloser.Close()
 
 	// TODO: respect the context here
-	if _, err := io.Copy(ioutil.Discard, readCloser); err != nil {
+	if err := readPullProgress(readCloser, progress); err != nil {
 		return fmt.Errorf("Failed to pull image: %s: %s", ref, err)
 	}
 
@@ -0,0 +1,97 @@
+package docker_helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// PullProgress summarizes the progress of all layers of a pulled image
+type PullProgress struct {
+	Layers          int
+	CompletedLayers int
+	Downloaded      int64
+	Total           int64
+}
+
+// PullProgressFunc is called for every progress message received from the daemon
+type PullProgressFunc func(progress PullProgress)
+
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+type pullLayer struct {
+	current   int64
+	total     int64
+	completed bool
+}
+
+// readPullProgress consumes the JSON messages stream returned by the image
+// pull API and reports the summary of all layers to progress
+func readPullProgress(reader io.Reader, progress PullProgressFunc) error {
+	layers := make(map[string]*pullLayer)
+	var order []string
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var message pullMessage
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+
+		// messages without ID describe the whole image, not a single layer
+		if message.ID == "" || progress == nil {
+			continue
+		}
+
+		layer := layers[message.ID]
+		switch message.Status {
+		case "Pulling fs layer", "Waiting", "Already exists":
+		case "Downloading", "Verifying Checksum", "Download complete", "Extracting", "Pull complete":
+		default:
+			// other statuses (eg. "Pulling from library/ruby") don't describe layers
+			continue
+		}
+
+		if layer == nil {
+			layer = &pullLayer{}
+			layers[message.ID] = layer
+			order = append(order, message.ID)
+		}
+
+		switch message.Status {
+		case "Downloading":
+			layer.current = message.ProgressDetail.Current
+			layer.total = message.ProgressDetail.Total
+		case "Download complete":
+			layer.current = layer.total
+		case "Pull complete", "Already exists":
+			layer.current = layer.total
+			layer.completed = true
+		}
+
+		summary := PullProgress{Layers: len(order)}
+		for _, id := range order {
+			if layers[id].completed {
+				summary.CompletedLayers++
+			}
+			summary.Downloaded += layers[id].current
+			summary.Total += layers[id].total
+		}
+		progress(summary)
+	}
+}
@@ -0,0 +1,39 @@
+package docker_helpers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPullMessages = `{"status":"Pulling from library/ruby","id":"2.1"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"layer1"}
+{"status":"Already exists","progressDetail":{},"id":"layer2"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"layer3"}
+{"status":"Downloading","progressDetail":{"current":100,"total":1000},"id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":50,"total":500},"id":"layer3"}
+{"status":"Downloading","progressDetail":{"current":600,"total":1000},"id":"layer1"}
+{"status":"Download complete","progressDetail":{},"id":"layer1"}
+{"status":"Pull complete","progressDetail":{},"id":"layer1"}
+{"status":"Digest: sha256:0123"}
+`
+
+func TestReadPullProgress(t *testing.T) {
+	var reports []PullProgress
+	err := readPullProgress(strings.NewReader(testPullMessages), func(progress PullProgress) {
+		reports = append(reports, progress)
+	})
+	assert.NoError(t, err)
+
+	if assert.Equal(t, 8, len(reports)) {
+		assert.Equal(t, PullProgress{Layers: 3, CompletedLayers: 1, Downloaded: 650, Total: 1500}, reports[5])
+		assert.Equal(t, PullProgress{Layers: 3, CompletedLayers: 2, Downloaded: 1050, Total: 1500}, reports[7])
+	}
+}
+
+func TestReadPullProgressError(t *testing.T) {
+	messages := testPullMessages + `{"error":"unauthorized: authentication required"}` + "\n"
+	err := readPullProgress(strings.NewReader(messages), nil)
+	assert.EqualError(t, err, "unauthorized: authentication required")
+}
@@ -353,13 +353,23 @@ func (b *AbstractShell) writeDownloadArtifactsScript(w ShellWriter, info common.
 	return nil
 }
 
+// lineTracer is implemented by the writers which can echo the lines
+// of the user's script before running them
+type lineTracer interface {
+	// TraceLine returns false when the writer doesn't trace the lines
+	TraceLine(text string) bool
+}
+
 // Write the given string of commands using the provided ShellWriter object.
 func (b *AbstractShell) writeCommands(w ShellWriter, commands string) {
 	commands = strings.TrimSpace(commands)
 	for _, command := range strings.Split(commands, "\n") {
 		command = strings.TrimSpace(command)
 		if command != "" {
-			w.Notice("$ %s", command)
+			// the traced line replaces the notice
+			if tracer, ok := w.(lineTracer); !ok || !tracer.TraceLine(command) {
+				w.Notice("$ %s", command)
+			}
 		} else {
 			w.EmptyLine()
 		}
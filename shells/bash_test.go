@@ -1,9 +1,13 @@
 package shells
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 )
 
 func TestBash_CommandShellEscapes(t *testing.T) {
@@ -19,3 +23,24 @@ func TestBash_IfCmdShellEscapes(t *testing.T) {
 
 	assert.Equal(t, `if $'foo' "x&(y)" >/dev/null 2>/dev/null; then`+"\n", writer.String())
 }
+
+func TestBash_PreBuildScriptRunsBeforeBuildCommands(t *testing.T) {
+	build := &common.Build{}
+	build.Commands = "make test"
+	build.Variables = common.BuildVariables{{Key: "MIRROR", Value: "mirror.example.com"}}
+	info := common.ShellScriptInfo{
+		Build:          build,
+		PreBuildScript: "echo $MIRROR > /etc/mirror",
+	}
+
+	script, err := common.GetShell("bash").GenerateScript(common.BuildStageUserScript, info)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(script, "set -eo pipefail\n"), "a failing command fails the build")
+
+	exportIndex := strings.Index(script, "export MIRROR=")
+	preBuildIndex := strings.Index(script, `\necho $MIRROR > /etc/mirror\n`)
+	commandsIndex := strings.Index(script, `\nmake test\n`)
+	require.NotEqual(t, -1, preBuildIndex, script)
+	assert.True(t, exportIndex < preBuildIndex, "the variables are exported first")
+	assert.True(t, preBuildIndex < commandsIndex, "the pre-build script runs before the build commands")
+}
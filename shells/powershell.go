@@ -7,6 +7,8 @@ import (
 	"io"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
@@ -15,25 +17,71 @@ import (
 
 type PowerShell struct {
 	AbstractShell
+	Shell string
 }
 
 type PsWriter struct {
 	bytes.Buffer
 	TemporaryPath string
 	indent        int
+
+	// CleanupTemporaryPath removes the TemporaryPath at the end of the script
+	CleanupTemporaryPath bool
+
+	// UTF8BOM prefixes the script with a byte order mark, without it
+	// Windows PowerShell reads the script in the legacy ANSI code page
+	UTF8BOM bool
+
+	// DisableColors prints messages without the ANSI color codes
+	DisableColors bool
+
+	// TraceCommands echoes every line of the user's script before running
+	// it, it's a lighter alternative to tracing the whole script with Set-PSDebug
+	TraceCommands bool
+
+	// VariableScopes maps the keys of the variables which are also set
+	// at the User or Machine scope, instead of only in the process
+	VariableScopes map[string]string
+
+	// InMemoryFileVariables sets the small file variables to their content
+	// instead of writing them to a file in the TemporaryPath
+	InMemoryFileVariables bool
+
+	// EOL ends every line of the script, CRLF when empty
+	EOL string
+
+	// IndentString is written once per level of indentation,
+	// two spaces when empty
+	IndentString string
+
+	// ErrorActionStop tells that the script sets $ErrorActionPreference
+	// to Stop, so the errors of the probed commands have to be relaxed
+	ErrorActionStop bool
+
+	variableFiles []string // removed at the end of the script
 }
 
+const (
+	psDefaultEOL          = "\r\n"
+	psDefaultIndentString = "  "
+)
+
+// psMaxInMemoryFileVariableSize is the largest file variable kept in memory
+// with InMemoryFileVariables, far below the 32767 characters limit of the
+// environment variables
+const psMaxInMemoryFileVariableSize = 4096
+
 func psQuote(text string) string {
 	// taken from: http://www.robvanderwoude.com/escapechars.php
 	text = strings.Replace(text, "`", "``", -1)
 	// text = strings.Replace(text, "\0", "`0", -1)
 	text = strings.Replace(text, "\a", "`a", -1)
 	text = strings.Replace(text, "\b", "`b", -1)
-	text = strings.Replace(text, "\f", "^f", -1)
+	text = strings.Replace(text, "\f", "`f", -1)
 	text = strings.Replace(text, "\r", "`r", -1)
 	text = strings.Replace(text, "\n", "`n", -1)
-	text = strings.Replace(text, "\t", "^t", -1)
-	text = strings.Replace(text, "\v", "^v", -1)
+	text = strings.Replace(text, "\t", "`t", -1)
+	text = strings.Replace(text, "\v", "`v", -1)
 	text = strings.Replace(text, "#", "`#", -1)
 	text = strings.Replace(text, "'", "`'", -1)
 	text = strings.Replace(text, "\"", "`\"", -1)
@@ -46,12 +94,57 @@ func psQuoteVariable(text string) string {
 	return text
 }
 
+// psMaxPath is the length from which the Win32 APIs fail on directory paths,
+// MAX_PATH without the room for a 8.3 file name
+const psMaxPath = 248
+
+// psLongPath prefixes the long absolute paths with \\?\ (or \\?\UNC\ for
+// UNC paths), which lifts the MAX_PATH limit. It reports if the path has the
+// prefix, since it then needs to be passed with -LiteralPath, ? being a wildcard.
+func psLongPath(path string) (string, bool) {
+	path = helpers.ToBackslash(path)
+	switch {
+	case strings.HasPrefix(path, `\\?\`):
+		return path, true
+	case len(path) < psMaxPath:
+		return path, false
+	case strings.HasPrefix(path, `\\`):
+		return `\\?\UNC\` + path[2:], true
+	case len(path) > 2 && path[1] == ':' && path[2] == '\\':
+		return `\\?\` + path, true
+	}
+	return path, false
+}
+
+// psPathArgument quotes the path for the cmdlets taking -Path or -LiteralPath
+func psPathArgument(path string) string {
+	path, prefixed := psLongPath(path)
+	if prefixed {
+		return "-LiteralPath " + psQuote(path)
+	}
+	return psQuote(path)
+}
+
 func (b *PsWriter) GetTemporaryPath() string {
 	return b.TemporaryPath
 }
 
+func (b *PsWriter) eol() string {
+	if b.EOL == "" {
+		return psDefaultEOL
+	}
+	return b.EOL
+}
+
+func (b *PsWriter) indentString() string {
+	if b.IndentString == "" {
+		return psDefaultIndentString
+	}
+	return b.IndentString
+}
+
 func (b *PsWriter) Line(text string) {
-	b.WriteString(strings.Repeat("  ", b.indent) + text + "\r\n")
+	b.WriteString(strings.Repeat(b.indentString(), b.indent) + text + b.eol())
 }
 
 func (b *PsWriter) CheckForErrors() {
@@ -66,14 +159,41 @@ func (b *PsWriter) Unindent() {
 	b.indent--
 }
 
+// checkErrorLevel checks $? set by the cmdlets, and by the user
+// script lines, which can be cmdlets as well as external programs
 func (b *PsWriter) checkErrorLevel() {
 	b.Line("if(!$?) { Exit $LASTEXITCODE }")
 	b.Line("")
 }
 
+// checkExitCode checks the external command run by Command. Native programs
+// don't always clear $? when they return a non-zero exit code, so the exit
+// code is checked explicitly, and a command that couldn't be started at all
+// (with $? cleared but $LASTEXITCODE still 0) fails with 1.
+func (b *PsWriter) checkExitCode() {
+	b.Line("if(!$? -or $LASTEXITCODE -ne 0) { if($LASTEXITCODE -ne 0) { Exit $LASTEXITCODE } else { Exit 1 } }")
+	b.Line("")
+}
+
+// TraceLine echoes the line of the user's script before it's run, with
+// TraceCommands. The variables are printed unexpanded, so the secrets
+// referenced by the script don't end up in the trace.
+func (b *PsWriter) TraceLine(text string) bool {
+	if !b.TraceCommands {
+		return false
+	}
+
+	b.Line("Write-Host " + psQuoteVariable("+ "+text))
+	return true
+}
+
+// Command runs the external command, $LASTEXITCODE is reset first, so
+// a code left by an earlier program isn't taken as its failure
 func (b *PsWriter) Command(command string, arguments ...string) {
-	b.Line(b.buildCommand(command, arguments...))
-	b.checkErrorLevel()
+	list := b.buildCommand(command, arguments...)
+	b.Line("$global:LASTEXITCODE = 0")
+	b.Line(list)
+	b.checkExitCode()
 }
 
 func (b *PsWriter) buildCommand(command string, arguments ...string) string {
@@ -89,17 +209,45 @@ func (b *PsWriter) buildCommand(command string, arguments ...string) string {
 }
 
 func (b *PsWriter) Variable(variable common.BuildVariable) {
-	if variable.File {
+	if variable.File && !(b.InMemoryFileVariables && len(variable.Value) <= psMaxInMemoryFileVariableSize) {
 		variableFile := b.Absolute(path.Join(b.TemporaryPath, variable.Key))
 		variableFile = helpers.ToBackslash(variableFile)
-		b.Line(fmt.Sprintf("md %s -Force | out-null", psQuote(helpers.ToBackslash(b.TemporaryPath))))
+		b.MkDir(b.TemporaryPath)
+		b.Line(fmt.Sprintf("New-Item %s -ItemType File -Force | out-null", psQuote(variableFile)))
+		b.restrictAccess(variableFile)
 		b.Line(fmt.Sprintf("Set-Content %s -Value %s -Encoding UTF8 -Force", psQuote(variableFile), psQuoteVariable(variable.Value)))
 		b.Line("$" + variable.Key + "=" + psQuote(variableFile))
+		b.variableFiles = append(b.variableFiles, variableFile)
 	} else {
 		b.Line("$" + variable.Key + "=" + psQuoteVariable(variable.Value))
 	}
 
 	b.Line("$env:" + variable.Key + "=$" + variable.Key)
+
+	// persisted in the registry, for the processes that don't inherit the
+	// environment, where it outlives the build, so never for the secrets
+	isSecret := variable.File || !(variable.Public || variable.Internal)
+	if scope := b.VariableScopes[variable.Key]; scope != "" && !isSecret {
+		b.Line("[Environment]::SetEnvironmentVariable(" + psQuote(variable.Key) + ", $" + variable.Key + ", " + psQuote(scope) + ")")
+	}
+}
+
+// restrictAccess makes the file accessible only by the current user, before
+// the secret is written to it. The ACL is replaced with icacls on Windows,
+// PowerShell Core on other systems sets the file mode instead.
+func (b *PsWriter) restrictAccess(file string) {
+	b.Line("if($IsWindows -eq $false) {")
+	b.Indent()
+	b.Line("& chmod 600 " + psQuote(file))
+	b.Unindent()
+	b.Line("} else {")
+	b.Indent()
+	b.Line("& icacls " + psQuote(file) + " /inheritance:r /grant:r \"$([System.Security.Principal.WindowsIdentity]::GetCurrent().Name):F\" | out-null")
+	// $? is set by out-null, only the exit code tells that icacls failed
+	b.checkExitCode()
+	b.Unindent()
+	b.Line("}")
+	b.checkErrorLevel()
 }
 
 func (b *PsWriter) IfDirectory(path string) {
@@ -113,8 +261,20 @@ func (b *PsWriter) IfFile(path string) {
 }
 
 func (b *PsWriter) IfCmd(cmd string, arguments ...string) {
+	if !b.ErrorActionStop {
+		b.Line(b.buildCommand(cmd, arguments...) + " 2>$null")
+		b.Line("if($?) {")
+		b.Indent()
+		return
+	}
+
+	// a missing command, or the redirected standard error in Windows
+	// PowerShell, would stop the script instead of running the Else branch
+	b.Line("$ErrorActionPreference = \"Continue\"")
 	b.Line(b.buildCommand(cmd, arguments...) + " 2>$null")
-	b.Line("if($?) {")
+	b.Line("$GitLabRunnerCmdSucceeded = $?")
+	b.Line("$ErrorActionPreference = \"Stop\"")
+	b.Line("if($GitLabRunnerCmdSucceeded) {")
 	b.Indent()
 }
 
@@ -134,8 +294,11 @@ func (b *PsWriter) Cd(path string) {
 	b.checkErrorLevel()
 }
 
+// MkDir creates the directory with md (New-Item), which doesn't
+// expand wildcards, so the long path prefix can be passed as -Path
 func (b *PsWriter) MkDir(path string) {
-	b.Line(fmt.Sprintf("md %s -Force | out-null", psQuote(helpers.ToBackslash(path))))
+	path, _ = psLongPath(path)
+	b.Line(fmt.Sprintf("md %s -Force | out-null", psQuote(path)))
 }
 
 func (b *PsWriter) MkTmpDir(name string) string {
@@ -145,52 +308,53 @@ func (b *PsWriter) MkTmpDir(name string) string {
 	return path
 }
 
-func (b *PsWriter) RmDir(path string) {
-	path = psQuote(helpers.ToBackslash(path))
-	b.Line("if( (Get-Command -Name Remove-Item2 -Module NTFSSecurity -ErrorAction SilentlyContinue) -and (Test-Path " + path + " -PathType Container) ) {")
+// removeItem prefers Remove-Item2 from the NTFSSecurity module, which
+// handles paths longer than 260 characters and UNC paths on its own, so
+// only the built-in cmdlets get the long path prefix
+func (b *PsWriter) removeItem(path, pathType, options string) {
+	argument := psPathArgument(path)
+	b.Line("if( (Get-Command -Name Remove-Item2 -Module NTFSSecurity -ErrorAction SilentlyContinue) -and (Test-Path " + argument + " -PathType " + pathType + ") ) {")
 	b.Indent()
-	b.Line("Remove-Item2 -Force -Recurse " + path)
+	b.Line("Remove-Item2 " + options + " " + psQuote(helpers.ToBackslash(path)))
 	b.Unindent()
-	b.Line("} elseif(Test-Path " + path + ") {")
+	b.Line("} elseif(Test-Path " + argument + ") {")
 	b.Indent()
-	b.Line("Remove-Item -Force -Recurse " + path)
+	b.Line("Remove-Item " + options + " " + argument)
 	b.Unindent()
 	b.Line("}")
 	b.Line("")
 }
 
+func (b *PsWriter) RmDir(path string) {
+	b.removeItem(path, "Container", "-Force -Recurse")
+}
+
 func (b *PsWriter) RmFile(path string) {
-	path = psQuote(helpers.ToBackslash(path))
-	b.Line("if( (Get-Command -Name Remove-Item2 -Module NTFSSecurity -ErrorAction SilentlyContinue) -and (Test-Path " + path + " -PathType Leaf) ) {")
-	b.Indent()
-	b.Line("Remove-Item2 -Force " + path)
-	b.Unindent()
-	b.Line("} elseif(Test-Path " + path + ") {")
-	b.Indent()
-	b.Line("Remove-Item -Force " + path)
-	b.Unindent()
-	b.Line("}")
-	b.Line("")
+	b.removeItem(path, "Leaf", "-Force")
+}
+
+func (b *PsWriter) echo(prefix, suffix, format string, arguments ...interface{}) {
+	text := fmt.Sprintf(format, arguments...)
+	if !b.DisableColors {
+		text = prefix + text + suffix
+	}
+	b.Line("echo " + psQuoteVariable(text))
 }
 
 func (b *PsWriter) Print(format string, arguments ...interface{}) {
-	coloredText := helpers.ANSI_RESET + fmt.Sprintf(format, arguments...)
-	b.Line("echo " + psQuoteVariable(coloredText))
+	b.echo(helpers.ANSI_RESET, "", format, arguments...)
 }
 
 func (b *PsWriter) Notice(format string, arguments ...interface{}) {
-	coloredText := helpers.ANSI_BOLD_GREEN + fmt.Sprintf(format, arguments...) + helpers.ANSI_RESET
-	b.Line("echo " + psQuoteVariable(coloredText))
+	b.echo(helpers.ANSI_BOLD_GREEN, helpers.ANSI_RESET, format, arguments...)
 }
 
 func (b *PsWriter) Warning(format string, arguments ...interface{}) {
-	coloredText := helpers.ANSI_YELLOW + fmt.Sprintf(format, arguments...) + helpers.ANSI_RESET
-	b.Line("echo " + psQuoteVariable(coloredText))
+	b.echo(helpers.ANSI_YELLOW, helpers.ANSI_RESET, format, arguments...)
 }
 
 func (b *PsWriter) Error(format string, arguments ...interface{}) {
-	coloredText := helpers.ANSI_BOLD_RED + fmt.Sprintf(format, arguments...) + helpers.ANSI_RESET
-	b.Line("echo " + psQuoteVariable(coloredText))
+	b.echo(helpers.ANSI_BOLD_RED, helpers.ANSI_RESET, format, arguments...)
 }
 
 func (b *PsWriter) EmptyLine() {
@@ -206,36 +370,159 @@ func (b *PsWriter) Absolute(dir string) string {
 	return filepath.Join("$CurrentDirectory", dir)
 }
 
+func (b *PsWriter) indentBlock(text string) string {
+	var buffer bytes.Buffer
+	for _, line := range strings.SplitAfter(text, b.eol()) {
+		if line != "" && line != b.eol() {
+			buffer.WriteString(b.indentString())
+		}
+		buffer.WriteString(line)
+	}
+	return buffer.String()
+}
+
+// cleanup returns the removal of the temporary files, which is
+// run in the finally block wrapping the script
+func (b *PsWriter) cleanup() string {
+	w := &PsWriter{EOL: b.EOL, IndentString: b.IndentString}
+	if b.CleanupTemporaryPath && b.TemporaryPath != "" {
+		// best-effort, a leftover directory must not fail the build
+		w.removeItem(b.TemporaryPath, "Container", "-Force -Recurse -ErrorAction SilentlyContinue")
+	} else {
+		// the files are written again by the script of every stage
+		for _, variableFile := range b.variableFiles {
+			w.removeItem(variableFile, "Leaf", "-Force -ErrorAction SilentlyContinue")
+		}
+	}
+	return w.String()
+}
+
+// Finish returns the script. When there are temporary files to remove, the
+// script is wrapped in try/finally, so they are removed even when the script
+// exits early or throws; Exit in the try block keeps its exit code.
 func (b *PsWriter) Finish(trace bool) string {
 	var buffer bytes.Buffer
 	w := bufio.NewWriter(&buffer)
 
+	if b.UTF8BOM {
+		io.WriteString(w, "\xef\xbb\xbf")
+	}
+
 	if trace {
-		io.WriteString(w, "Set-PSDebug -Trace 2\r\n")
+		io.WriteString(w, "Set-PSDebug -Trace 2"+b.eol())
+	}
+
+	cleanup := b.cleanup()
+	if cleanup == "" {
+		io.WriteString(w, b.String())
+	} else {
+		io.WriteString(w, "try {"+b.eol())
+		io.WriteString(w, b.indentBlock(b.String()))
+		io.WriteString(w, "} finally {"+b.eol())
+		io.WriteString(w, b.indentBlock(cleanup))
+		io.WriteString(w, "}"+b.eol())
 	}
 
-	io.WriteString(w, b.String())
 	w.Flush()
 	return buffer.String()
 }
 
 func (b *PowerShell) GetName() string {
-	return "powershell"
+	return b.Shell
 }
 
 func (b *PowerShell) GetConfiguration(info common.ShellScriptInfo) (script *common.ShellConfiguration, err error) {
+	options := []string{"-noprofile", "-noninteractive", "-executionpolicy", "Bypass"}
+
+	// PowerShell Core has no execution policies outside of Windows
+	if b.Shell == "pwsh" {
+		options = []string{"-noprofile", "-noninteractive"}
+	}
+
 	script = &common.ShellConfiguration{
-		Command:   "powershell",
-		Arguments: []string{"-noprofile", "-noninteractive", "-executionpolicy", "Bypass", "-command"},
+		Command:   b.Shell,
+		Arguments: append(options, "-command"),
 		PassFile:  true,
 		Extension: "ps1",
 	}
+
+	// the scripts fitting the command line are passed inline, which doesn't
+	// need a temporary file, the longer ones are still passed as a file
+	if !isEncodedCommandDisabled(info) {
+		script.EncodedCommandArguments = append(options, "-EncodedCommand")
+	}
 	return
 }
 
+// isEncodedCommandDisabled checks if POWERSHELL_ENCODED_COMMAND is set to
+// false, to always pass the scripts as a file
+func isEncodedCommandDisabled(info common.ShellScriptInfo) bool {
+	if info.Build == nil {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(info.Build.GetAllVariables().Get("POWERSHELL_ENCODED_COMMAND"))
+	return err == nil && !enabled
+}
+
+// getLineEnding returns the line ending set with POWERSHELL_LINE_ENDING,
+// by default LF for pwsh outside of Windows and CRLF otherwise
+func (b *PowerShell) getLineEnding(info common.ShellScriptInfo) string {
+	switch strings.ToLower(info.Build.GetAllVariables().Get("POWERSHELL_LINE_ENDING")) {
+	case "lf":
+		return "\n"
+	case "crlf":
+		return "\r\n"
+	}
+
+	// only PowerShell Core runs outside of Windows
+	if b.Shell == "pwsh" && getScriptOS(info) != "windows" {
+		return "\n"
+	}
+	return "\r\n"
+}
+
+func getScriptOS(info common.ShellScriptInfo) string {
+	if info.OS != "" {
+		return info.OS
+	}
+	return runtime.GOOS
+}
+
+// getIndentString returns the indentation set with POWERSHELL_INDENT,
+// either tab or a number of spaces, the writer's default otherwise
+func getIndentString(info common.ShellScriptInfo) string {
+	indent := strings.ToLower(info.Build.GetAllVariables().Get("POWERSHELL_INDENT"))
+	if indent == "tab" {
+		return "\t"
+	}
+
+	spaces, err := strconv.Atoi(indent)
+	if err != nil || spaces < 1 || spaces > 8 {
+		return ""
+	}
+	return strings.Repeat(" ", spaces)
+}
+
 func (b *PowerShell) GenerateScript(buildStage common.BuildStage, info common.ShellScriptInfo) (script string, err error) {
 	w := &PsWriter{
-		TemporaryPath: info.Build.FullProjectDir() + ".tmp",
+		TemporaryPath:         info.Build.FullProjectDir() + ".tmp",
+		CleanupTemporaryPath:  isVariableEnabled(info, "POWERSHELL_CLEANUP_TEMPORARY_DIR"),
+		UTF8BOM:               b.Shell == "powershell",
+		DisableColors:         info.DisableColors,
+		TraceCommands:         isVariableEnabled(info, "POWERSHELL_TRACE_COMMANDS"),
+		VariableScopes:        getVariableScopes(info),
+		InMemoryFileVariables: isVariableEnabled(info, "POWERSHELL_IN_MEMORY_FILE_VARIABLES"),
+		EOL:                   b.getLineEnding(info),
+		IndentString:          getIndentString(info),
+		ErrorActionStop:       isVariableEnabled(info, "POWERSHELL_ERROR_ACTION_STOP"),
+	}
+
+	// every stage runs in a separate PowerShell process,
+	// so the preference has to be set for each of them
+	if w.ErrorActionStop {
+		w.Line("$ErrorActionPreference = \"Stop\"")
+		w.Line("")
 	}
 
 	if buildStage == common.BuildStagePrepare {
@@ -251,10 +538,32 @@ func (b *PowerShell) GenerateScript(buildStage common.BuildStage, info common.Sh
 	return
 }
 
+// isVariableEnabled checks the build variables that tune the generated script
+func isVariableEnabled(info common.ShellScriptInfo, key string) bool {
+	enabled, _ := strconv.ParseBool(info.Build.GetAllVariables().Get(key))
+	return enabled
+}
+
+// getVariableScopes returns the scopes of the variables listed in the
+// user_scope_variables and machine_scope_variables of the runner, the
+// Machine scope wins. They can't be set by the build, as the persisted
+// variables are visible to the later builds of all projects.
+func getVariableScopes(info common.ShellScriptInfo) map[string]string {
+	scopes := make(map[string]string)
+	for _, key := range info.UserScopeVariables {
+		scopes[key] = "User"
+	}
+	for _, key := range info.MachineScopeVariables {
+		scopes[key] = "Machine"
+	}
+	return scopes
+}
+
 func (b *PowerShell) IsDefault() bool {
 	return false
 }
 
 func init() {
-	common.RegisterShell(&PowerShell{})
+	common.RegisterShell(&PowerShell{Shell: "powershell"})
+	common.RegisterShell(&PowerShell{Shell: "pwsh"})
 }